@@ -3,6 +3,8 @@ package CA
 import (
 	"encoding/json"
 	"math/rand"
+	"strconv"
+	"time"
 
 	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
@@ -32,33 +34,43 @@ func GenerateRandomBitPositions(totalBits int, density float64) []int {
 type CRV struct {
 	CRV_pre_update *bitset.BitSet
 	CRV_current    *bitset.BitSet
+	// number of RIDs the CRV covers, committed in every SRH
+	Size uint
+	// unix time each RID was revoked, served in the CRL and OCSP views
+	Revoked_at map[uint]int64
 	//CRV_cache      map[string]*bitset.BitSet
 }
 
-type Revocation struct {
-	Period    string
-	Delta_CRV []byte
-	SRH       string
-}
+type Revocation = definition.Revocation
 
 func CRV_init() *CRV {
+	return New_CRV(definition.DefaultCRVSize)
+}
+
+func New_CRV(size uint) *CRV {
 	CRV := new(CRV)
-	CRV.CRV_pre_update = bitset.New(1000000)
-	CRV.CRV_current = bitset.New(1000000)
+	CRV.CRV_pre_update = bitset.New(size)
+	CRV.CRV_current = bitset.New(size)
+	CRV.Size = size
+	CRV.Revoked_at = make(map[uint]int64)
 	//CRV.CRV_cache = make(map[string]*bitset.BitSet)
 	return CRV
 }
 
+// grow the CRV, doubling its size, until it covers n RIDs
+func (crv *CRV) Grow(n uint) {
+	for crv.Size < n {
+		crv.Size *= 2
+	}
+}
+
 // Compute delta between CRV_pre_update and CRV_current
 func (crv *CRV) GetDeltaCRV() []byte {
 	// compute delta between CRV_pre_update and CRV_current
-	//fmt.Println("preupdate == current?: ", crv.CRV_pre_update == crv.CRV_current)
-	if crv.CRV_pre_update == crv.CRV_current {
-		empty := bitset.New(1000000)
-		bytes, _ := empty.MarshalBinary()
-		return bytes
+	CRV_delta, err := definition.CanonicalCRV(crv.CRV_current.SymmetricDifference(crv.CRV_pre_update), crv.Size)
+	if err != nil {
+		panic(err)
 	}
-	CRV_delta := crv.CRV_current.SymmetricDifference(crv.CRV_pre_update)
 	bytes, err := CRV_delta.MarshalBinary()
 	if err != nil {
 		panic(err)
@@ -80,53 +92,72 @@ func (crv *CRV) GetDeltaCRVCache(LastUpdatePeriod string) []byte {
 
 // revoke by revocation ID
 func (crv *CRV) Revoke(index int) {
+	crv.RevokeAt(index, time.Now())
+}
+
+// revoke by revocation ID at time t, a RID keeps the time it was first revoked
+func (crv *CRV) RevokeAt(index int, t time.Time) {
+	crv.Grow(uint(index) + 1)
 	crv.CRV_current.Set(uint(index))
+	if _, ok := crv.Revoked_at[uint(index)]; !ok {
+		crv.Revoked_at[uint(index)] = t.Unix()
+	}
 }
 
 func (crv *CRV) MassRevoke(ratio float64) {
 	// generate random bit positions
-	positions := GenerateRandomBitPositions(1000000, ratio)
+	positions := GenerateRandomBitPositions(int(crv.Size), ratio)
 	for _, position := range positions {
-		crv.CRV_current.Set(uint(position))
+		crv.RevokeAt(position, time.Now())
+	}
+}
+
+// the time RID was revoked, if the CRV has it
+func (crv *CRV) RevocationTime(rid uint) (time.Time, bool) {
+	t, ok := crv.Revoked_at[rid]
+	if !ok {
+		return time.Time{}, false
 	}
+	return time.Unix(t, 0).UTC(), true
 }
 
 func Generate_Revocation(c *CAContext, Period string, REV_type int) definition.Gossip_object {
 	// if REV_type == 1 generate a REV based on another Delta_CRV
-	// hash c.CRV.CRVcurrent
-	hashmsg, _ := c.CRV.CRV_current.MarshalBinary()
-	hash, _ := crypto.GenerateSHA256(hashmsg)
-	var hashmsgdelta []byte
-	// hash delta CRV
-	if REV_type == 0 {
-		hashmsgdelta = c.CRV.GetDeltaCRV()
-	} else {
-		// get Delta CRV from first
-		m1 := c.CRV.GetDeltaCRV()
-		// Unmarshal m1
-		var m2 bitset.BitSet
-		err := m2.UnmarshalBinary(m1)
-		if err != nil {
-			panic(err)
-		}
-		m2.Set(1 + uint(c.OnlineDuration))
-		hashmsgdelta, err = m2.MarshalBinary()
-		if err != nil {
-			panic(err)
-		}
+	size := c.CRV.Size
+	var delta bitset.BitSet
+	err := delta.UnmarshalBinary(c.CRV.GetDeltaCRV())
+	if err != nil {
+		panic(err)
+	}
+	crv := c.CRV.CRV_current
+	if REV_type == 1 {
+		delta.Set(1 + uint(c.OnlineDuration))
+		crv = crv.Union(&delta)
+	}
+	hashmsgdelta, _ := delta.MarshalBinary()
+	// the REV is chained to the last REV published
+	prev_period, prev_srh := "", ""
+	if c.Last_REV.SRH != "" {
+		prev_period, prev_srh = c.Last_REV.Period, definition.SRH_chain(c.Last_REV.SRH)
+	}
+	// hash Period||hash CRVcurrent||hash delta CRV||size||prev period||prev SRH
+	hash_revocation, err := definition.SRH_hash(Period, crv, &delta, size, prev_period, prev_srh)
+	if err != nil {
+		panic(err)
 	}
-	hash_delta, _ := crypto.GenerateSHA256(hashmsgdelta)
-	// hash Period||hash CRVcurrent||hash delta CRV
-	hash_revocation, _ := crypto.GenerateSHA256([]byte(Period + string(hash) + string(hash_delta)))
 	// sign hash_revocation
 	signature, _ := crypto.RSASign(hash_revocation, &c.CA_crypto_config.SignSecretKey, c.CA_crypto_config.SelfID)
 	// compress Delta CRV
 	compress_delta, _ := util.CompressData(hashmsgdelta)
 	// create revocation object
 	revocation := Revocation{
-		Period:    Period,
-		Delta_CRV: compress_delta,
-		SRH:       signature.String(),
+		Period:      Period,
+		Delta_CRV:   compress_delta,
+		SRH:         signature.String(),
+		Size:        size,
+		Prev_period: prev_period,
+		Prev_SRH:    prev_srh,
+		Sequence:    c.Last_REV.Sequence + 1,
 	}
 	// create gossip object
 	payload3, _ := json.Marshal(revocation)
@@ -144,3 +175,75 @@ func Generate_Revocation(c *CAContext, Period string, REV_type int) definition.G
 	//fmt.Println("compressed delta CRV: ", compress_delta)
 	return gossipREV
 }
+
+// Generate_Checkpoint publishes the full CRV as of Period, the CRV committed in the SRH of the REV of the same period
+// The caller must hold CRV_lock
+func Generate_Checkpoint(c *CAContext, Period string) definition.Gossip_object {
+	size := c.CRV.Size
+	crv, err := definition.CanonicalCRV(c.CRV.CRV_current, size)
+	if err != nil {
+		panic(err)
+	}
+	// the checkpoint carries the SRH of the REV of Period, the REVs after it are chained to that SRH
+	srh, sequence := "", uint64(0)
+	if c.Last_REV.Period == Period {
+		srh, sequence = c.Last_REV.SRH, c.Last_REV.Sequence
+	}
+	hash_checkpoint, _ := definition.Checkpoint_hash(Period, crv, size, srh)
+	signature, _ := crypto.RSASign(hash_checkpoint, &c.CA_crypto_config.SignSecretKey, c.CA_crypto_config.SelfID)
+	crvbytes, _ := crv.MarshalBinary()
+	compress_crv, _ := util.CompressData(crvbytes)
+	checkpoint := definition.Checkpoint{
+		Period:    Period,
+		CRV:       compress_crv,
+		Size:      size,
+		SRH:       srh,
+		Sequence:  sequence,
+		Signature: signature.String(),
+	}
+	payload3, _ := json.Marshal(checkpoint)
+	payload := string(c.CA_private_config.Signer) + "CRV_CHECKPOINT" + string(payload3)
+	sig, _ := crypto.RSASign([]byte(payload), &c.CA_crypto_config.SignSecretKey, c.CA_crypto_config.SelfID)
+	return definition.Gossip_object{
+		Application:   "CTng",
+		Type:          definition.CKP_INIT,
+		Period:        Period,
+		Signer:        c.CA_private_config.Signer,
+		Signature:     [2]string{sig.String(), ""},
+		Crypto_Scheme: "RSA",
+		Payload:       [3]string{c.CA_private_config.Signer, "CRV_CHECKPOINT", string(payload3)},
+	}
+}
+
+// a checkpoint is published with the REV of every Checkpoint_interval-th period
+func CheckpointDue(c *CAContext, Period string) bool {
+	if c.CA_private_config.Checkpoint_interval <= 0 {
+		return false
+	}
+	periodnum, err := strconv.Atoi(Period)
+	if err != nil {
+		return false
+	}
+	return periodnum%c.CA_private_config.Checkpoint_interval == 0
+}
+
+// Publish_Revocation generates the REV of Period, and its checkpoint if one is due, and starts the next delta
+// It returns true if a checkpoint was published
+// The caller must hold CRV_lock
+func Publish_Revocation(c *CAContext, Period string) bool {
+	rev := Generate_Revocation(c, Period, 0)
+	fake_rev := Generate_Revocation(c, Period, 1)
+	revocation, _, _ := definition.ExtractRevocation(rev)
+	revocation.Delta_CRV = nil
+	c.Last_REV = revocation
+	c.REV_storage[Period] = rev
+	c.REV_storage_fake[Period] = fake_rev
+	published := false
+	if CheckpointDue(c, Period) {
+		c.Checkpoint = Generate_Checkpoint(c, Period)
+		published = true
+	}
+	// update CRV
+	c.CRV.CRV_pre_update = c.CRV.CRV_current.Clone()
+	return published
+}
@@ -0,0 +1,96 @@
+package CA
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// RFC 5280 CRLReason codes
+var RevocationReasons = map[int]string{
+	0:  "unspecified",
+	1:  "keyCompromise",
+	2:  "cACompromise",
+	3:  "affiliationChanged",
+	4:  "superseded",
+	5:  "cessationOfOperation",
+	6:  "certificateHold",
+	8:  "removeFromCRL",
+	9:  "privilegeWithdrawn",
+	10: "aACompromise",
+}
+
+// a bit set in the CRV is never cleared, so holds and their removal cannot be expressed
+func ValidRevocationReason(reason int) bool {
+	_, ok := RevocationReasons[reason]
+	return ok && reason != 6 && reason != 8
+}
+
+// revocation requested by an operator, the certificate is named by serial number (hex) or by RID
+type RevocationRequest struct {
+	SerialNumber string `json:"serial_number,omitempty"`
+	RID          *int   `json:"rid,omitempty"`
+	Reason       int    `json:"reason"`
+}
+
+type RevocationRecord struct {
+	Timestamp    string
+	RID          int
+	SerialNumber string
+	Reason       int
+	Requester    string
+}
+
+// AuditLog is an append-only file of revocation records, one JSON record per line
+type AuditLog struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: f}, nil
+}
+
+// write the record and sync it to disk before the revocation takes effect
+func (a *AuditLog) Append(record RevocationRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err = a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+// read every complete record of an audit log, a torn last line is ignored
+func ReadAuditLog(path string) ([]RevocationRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := []RevocationRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record RevocationRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			break
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
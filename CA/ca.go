@@ -5,6 +5,8 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -18,6 +20,28 @@ import (
 
 // Unsigned Pre-certificate
 func Genrate_Unsigned_PreCert(host string, validFor time.Duration, isCA bool, issuer pkix.Name, subject pkix.Name, ctx *CAContext) *x509.Certificate {
+	template := precert_template(validFor, isCA, issuer, subject, ctx)
+	hosts := strings.Split(host, ",")
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	return template
+}
+
+// Unsigned Pre-certificate for the subject and SANs of a CSR
+func Generate_Unsigned_PreCert_from_CSR(csr *x509.CertificateRequest, validFor time.Duration, issuer pkix.Name, ctx *CAContext) *x509.Certificate {
+	template := precert_template(validFor, false, issuer, csr.Subject, ctx)
+	template.DNSNames = csr.DNSNames
+	template.IPAddresses = csr.IPAddresses
+	return template
+}
+
+// template with the CTng extension carrying the next RID
+func precert_template(validFor time.Duration, isCA bool, issuer pkix.Name, subject pkix.Name, ctx *CAContext) *x509.Certificate {
 	ctngext := CTngExtension{SequenceNumber: SequenceNumber{RID: ctx.CertCounter}}
 	keyUsage := x509.KeyUsageDigitalSignature
 	// Only RSA subject keys should have the KeyEncipherment KeyUsage bits set. In
@@ -43,17 +67,9 @@ func Genrate_Unsigned_PreCert(host string, validFor time.Duration, isCA bool, is
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
-	hosts := strings.Split(host, ",")
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
-		}
-	}
 	if isCA {
 		template.IsCA = true
-		template.KeyUsage |= x509.KeyUsageCertSign
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
 	}
 
 	template.ExtraExtensions = []pkix.Extension{
@@ -67,18 +83,23 @@ func Genrate_Unsigned_PreCert(host string, validFor time.Duration, isCA bool, is
 	return &template
 }
 
+// SubjectKeyId given by Sign_certificate to the certificates of a public key
+func GetSubjectKeyId(pub *rsa.PublicKey) []byte {
+	//Marshal public key
+	pub_key_M, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		log.Fatalf("Failed to marshal public key: %v", err)
+	}
+	//hash public key
+	key_hash, _ := crypto.GenerateSHA256(pub_key_M)
+	return key_hash
+}
+
 // Signed certificate with Root certificate
 func Sign_certificate(cert *x509.Certificate, root_cert *x509.Certificate, root bool, pub *rsa.PublicKey, priv *rsa.PrivateKey) *x509.Certificate {
 	// if subjectkeyid is not set, set it to the hash of the public key
 	if len(cert.SubjectKeyId) == 0 {
-		//Marshal public key
-		pub_key_M, err := x509.MarshalPKIXPublicKey(pub)
-		if err != nil {
-			log.Fatalf("Failed to marshal public key: %v", err)
-		}
-		//hash public key
-		key_hash, _ := crypto.GenerateSHA256(pub_key_M)
-		cert.SubjectKeyId = key_hash
+		cert.SubjectKeyId = GetSubjectKeyId(pub)
 	}
 	derBytes, err := x509.CreateCertificate(rand.Reader, cert, root_cert, pub, priv)
 	if err != nil {
@@ -112,6 +133,13 @@ func Generate_Signed_PreCert(c *CAContext, host string, validFor time.Duration,
 	return signed_precert
 }
 
+// generate signed precert for a CSR that passed CheckCSR
+func Generate_Signed_PreCert_from_CSR(c *CAContext, csr *x509.CertificateRequest, validFor time.Duration) *x509.Certificate {
+	issuer := Generate_Issuer(c.CA_private_config.Signer)
+	pre_cert := Generate_Unsigned_PreCert_from_CSR(csr, validFor, issuer, c)
+	return Sign_certificate(pre_cert, c.Rootcert, false, csr.PublicKey.(*rsa.PublicKey), &c.PrivateKey)
+}
+
 func Generate_Selfsigned_root_cert(c *CAContext, host string, validFor time.Duration, isCA bool, issuer pkix.Name, subject pkix.Name, root_cert *x509.Certificate, root bool, pub *rsa.PublicKey, priv *rsa.PrivateKey) *x509.Certificate {
 	// Generate precert
 	pre_cert := Genrate_Unsigned_PreCert(host, validFor, isCA, issuer, subject, c)
@@ -188,6 +216,78 @@ func Generate_N_Signed_PreCert_with_priv(c *CAContext, N int, host string, valid
 	return precerts, privkeys
 }
 
+// ParseCSR reads a PKCS#10 CSR in PEM or DER form
+func ParseCSR(data []byte) (*x509.CertificateRequest, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		data = block.Bytes
+	}
+	return x509.ParseCertificateRequest(data)
+}
+
+// CheckCSR verifies the CSR signature and that every name it asks for can go into a certificate
+func CheckCSR(csr *x509.CertificateRequest) error {
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("invalid CSR signature: %v", err)
+	}
+	pub, ok := csr.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("only RSA keys are supported")
+	}
+	if pub.N.BitLen() < MinRSAKeySize {
+		return fmt.Errorf("RSA key must be at least %d bits", MinRSAKeySize)
+	}
+	if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return errors.New("only DNS and IP address SANs are supported")
+	}
+	if len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 {
+		return errors.New("CSR has no SANs")
+	}
+	for _, name := range csr.DNSNames {
+		if !validDNSName(name) {
+			return fmt.Errorf("invalid DNS name %q", name)
+		}
+	}
+	// the common name, if any, must be one of the SANs
+	if cn := csr.Subject.CommonName; cn != "" {
+		found := false
+		for _, name := range csr.DNSNames {
+			found = found || strings.EqualFold(name, cn)
+		}
+		for _, ip := range csr.IPAddresses {
+			found = found || ip.String() == cn
+		}
+		if !found {
+			return fmt.Errorf("common name %q is not in the SANs", cn)
+		}
+	}
+	return nil
+}
+
+// DNS name made of LDH labels, a wildcard is only allowed as the whole leftmost label
+func validDNSName(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if i == 0 && label == "*" && len(labels) > 2 {
+			continue
+		}
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Marshall signed precert to json
 func Marshall_Signed_PreCert(precert *x509.Certificate) []byte {
 	return precert.Raw
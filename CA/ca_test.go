@@ -1,10 +1,27 @@
 package CA
 
 import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +30,8 @@ import (
 	"github.com/jik18001/CTngV2/util"
 
 	"github.com/bits-and-blooms/bitset"
+	"github.com/gorilla/mux"
+	merkletree "github.com/txaty/go-merkletree"
 )
 
 func testCRV(t *testing.T) {
@@ -147,3 +166,490 @@ func TestTask(t *testing.T) {
 	ctx.RevocationRatio = 0.001
 	StartCA(ctx)
 }
+
+func TestPrecertLeaf(t *testing.T) {
+	ctx := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
+	issuer := Generate_Issuer(ctx.CA_private_config.Signer)
+	certs := Generate_N_Signed_PreCert(ctx, 2, "www.example.com", 365*24*time.Hour, false, issuer, ctx.Rootcert, false, &ctx.PrivateKey, 0)
+	cert_to_sign := GetPrecertfromCert(certs[0])
+	ctx.CurrentCertificatePool.AddCert(cert_to_sign)
+	newloggerinfo := LoggerInfo{
+		STH: definition.Gossip_object{Type: definition.STH_INIT, Signer: "localhost:3333"},
+		POI: crypto.POI_for_transmission{SubjectKeyId: cert_to_sign.SubjectKeyId},
+	}
+	UpdateCTngExtension(cert_to_sign, newloggerinfo)
+	final := SignAllCerts(ctx)[0]
+	if len(ParseCTngextension(final).LoggerInformation) != 1 {
+		t.Fatalf("final certificate has no logger information")
+	}
+	// the final certificate must hash to the leaf the logger logged for the precert
+	precert_leaf, err1 := crypto.PrecertLeafData(certs[0])
+	final_leaf, err2 := crypto.PrecertLeafData(final)
+	if err1 != nil || err2 != nil || string(precert_leaf) != string(final_leaf) {
+		t.Errorf("leaf of the final certificate differs from the precert leaf")
+	}
+	other_leaf, _ := crypto.PrecertLeafData(certs[1])
+	if string(other_leaf) == string(precert_leaf) {
+		t.Errorf("two precerts share the same leaf")
+	}
+}
+
+func TestCTngExtensionDER(t *testing.T) {
+	ext := CTngExtension{
+		SequenceNumber: SequenceNumber{RID: 7},
+		LoggerInformation: []LoggerInfo{{
+			STH: definition.Gossip_object{
+				Application: "CTng", Period: "3", Type: definition.STH_FULL, Signer: "",
+				Signers:       []string{"localhost:8000", "localhost:8001"},
+				Signature:     [2]string{`{"sig":"00ff"}`, ""},
+				Timestamp:     "2026-10-18T09:00:00Z",
+				Crypto_Scheme: "BLS",
+				Payload:       [3]string{"localhost:9000", "7b22526f6f7448617368223a22227d", ""},
+			},
+			POI: crypto.POI_for_transmission{
+				Poi:          &merkletree.Proof{Siblings: [][]byte{{1, 2, 3}, {4, 5, 6}}, Path: 2},
+				SubjectKeyId: []byte{9, 9},
+				LoggerID:     "localhost:9000",
+			},
+		}},
+	}
+	der := EncodeCTngExtension(ext)
+	if der[0] != 0x30 {
+		t.Fatalf("extension is not a DER SEQUENCE")
+	}
+	if decoded := DecodeCTngExtension(der); !reflect.DeepEqual(decoded, ext) {
+		t.Errorf("DER round trip changed the extension: %+v", decoded)
+	}
+	// certificates issued before the DER form keep their JSON extension
+	legacy, err := EncodeCTngExtensionJSON(ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded := DecodeCTngExtension(legacy); !reflect.DeepEqual(decoded, ext) {
+		t.Errorf("legacy extension not decoded: %+v", decoded)
+	}
+	if len(der) >= len(legacy) {
+		t.Errorf("DER extension (%d bytes) is not smaller than the JSON one (%d bytes)", len(der), len(legacy))
+	}
+	v2, _ := asn1.Marshal(ctngExtensionASN1{Version: 2, LoggerInformation: []loggerInfoASN1{}})
+	if _, err := UnmarshalCTngExtension(v2); err == nil {
+		t.Errorf("unknown extension version accepted")
+	}
+}
+
+func TestCTngExtensionStrict(t *testing.T) {
+	ctx := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
+	issuer := Generate_Issuer(ctx.CA_private_config.Signer)
+	precert := Generate_N_Signed_PreCert(ctx, 2, "www.example.com", 365*24*time.Hour, false, issuer, ctx.Rootcert, false, &ctx.PrivateKey, 0)[1]
+	if rid, err := ExtractRID(precert); err != nil || rid != GetRIDfromCert(precert) {
+		t.Fatalf("RID of a precert not extracted: %d %v", rid, err)
+	}
+	json_value := func(content string) []byte {
+		value, _ := asn1.Marshal([]byte(content))
+		return value
+	}
+	with_extensions := func(values ...[]byte) *x509.Certificate {
+		cert := &x509.Certificate{}
+		for _, value := range values {
+			cert.Extensions = append(cert.Extensions, pkix.Extension{Id: OIDCTngExtension, Value: value})
+		}
+		return cert
+	}
+	cases := []struct {
+		cert *x509.Certificate
+		err  error
+	}{
+		{with_extensions(), ErrNoCTngExtension},
+		{with_extensions(EncodeCTngExtension(CTngExtension{}), EncodeCTngExtension(CTngExtension{})), ErrDuplicateCTngExtension},
+		{with_extensions([]byte{0x30, 0x01}), ErrMalformedCTngExtension},
+		{with_extensions(json_value(`{"LoggerInformation":[]}`)), ErrMissingSequenceNumber},
+		{with_extensions(json_value(`{"SequenceNumber":{}}`)), ErrMissingSequenceNumber},
+		{with_extensions(json_value(`{"SequenceNumber":{"RID":-1}}`)), ErrMalformedCTngExtension},
+		{with_extensions(EncodeCTngExtension(CTngExtension{SequenceNumber: SequenceNumber{RID: -1}})), ErrMalformedCTngExtension},
+	}
+	for i, c := range cases {
+		if _, err := ExtractRID(c.cert); !errors.Is(err, c.err) {
+			t.Errorf("case %d: expected %v, got %v", i, c.err, err)
+		}
+	}
+	if rid, err := ExtractRID(with_extensions(json_value(`{"SequenceNumber":{"RID":0}}`))); err != nil || rid != 0 {
+		t.Errorf("RID 0 not read from a JSON extension: %v", err)
+	}
+	known := func(loggerID string) bool { return loggerID == "localhost:9000" || loggerID == "localhost:9001" }
+	info := func(loggerID string) LoggerInfo {
+		return LoggerInfo{STH: definition.Gossip_object{Payload: [3]string{loggerID, "", ""}}, POI: crypto.POI_for_transmission{LoggerID: loggerID}}
+	}
+	if err := ValidateLoggerInformation(CTngExtension{}, known); !errors.Is(err, ErrNoLoggerInformation) {
+		t.Errorf("empty logger information accepted")
+	}
+	if err := ValidateLoggerInformation(CTngExtension{LoggerInformation: []LoggerInfo{info("localhost:9000"), info("localhost:9999")}}, known); !errors.Is(err, ErrUnknownLogger) {
+		t.Errorf("unknown logger accepted")
+	}
+	if err := ValidateLoggerInformation(CTngExtension{LoggerInformation: []LoggerInfo{info("localhost:9000"), info("localhost:9000")}}, known); !errors.Is(err, ErrDuplicateLogger) {
+		t.Errorf("duplicate logger accepted")
+	}
+	if err := ValidateLoggerInformation(CTngExtension{LoggerInformation: []LoggerInfo{info("localhost:9000"), info("localhost:9001")}}, known); err != nil {
+		t.Errorf("valid logger information rejected: %v", err)
+	}
+}
+
+func TestIssueCert(t *testing.T) {
+	ctx := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
+	key, _ := crypto.NewRSAPrivateKey()
+	new_csr := func(template *x509.CertificateRequest) *x509.CertificateRequest {
+		der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := ParseCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csr
+	}
+	bad_csrs := []*x509.CertificateRequest{
+		{Subject: pkix.Name{CommonName: "www.example.com"}},
+		{DNSNames: []string{"bad_name.example.com"}},
+		{DNSNames: []string{"*.*.example.com"}},
+		{Subject: pkix.Name{CommonName: "other.example.com"}, DNSNames: []string{"www.example.com"}},
+		{DNSNames: []string{"www.example.com"}, EmailAddresses: []string{"admin@example.com"}},
+	}
+	for i, template := range bad_csrs {
+		if CheckCSR(new_csr(template)) == nil {
+			t.Errorf("bad CSR %d was accepted", i)
+		}
+	}
+	csr := new_csr(&x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.example.com"},
+		DNSNames: []string{"www.example.com", "*.example.com"},
+	})
+	if err := CheckCSR(csr); err != nil {
+		t.Fatal(err)
+	}
+	csr.Signature[0] ^= 0xff
+	if CheckCSR(csr) == nil {
+		t.Errorf("CSR with a broken signature was accepted")
+	}
+	csr.Signature[0] ^= 0xff
+	// a key already being issued is refused before a RID is spent on it
+	ski := string(GetSubjectKeyId(csr.PublicKey.(*rsa.PublicKey)))
+	ctx.Pending_storage[ski] = &PendingCert{}
+	counter, issued := ctx.CertCounter, len(ctx.Issued_storage)
+	w := httptest.NewRecorder()
+	issue_cert(ctx, w, httptest.NewRequest("POST", "/ctng/v2/issue-cert", bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))))
+	if w.Code != 409 || ctx.CertCounter != counter || len(ctx.Issued_storage) != issued {
+		t.Errorf("conflicting request got %d and spent a RID", w.Code)
+	}
+	delete(ctx.Pending_storage, ski)
+	rid := ctx.CertCounter
+	precert := Generate_Signed_PreCert_from_CSR(ctx, csr, IssuedCertValidity)
+	if GetRIDfromCert(precert) != rid || ctx.CertCounter != rid+1 {
+		t.Errorf("precert does not carry the next RID")
+	}
+	// two loggers accepted the precert, their POIs complete the certificate
+	leaf, _ := crypto.PrecertLeafHash(precert)
+	tree := crypto.NewMerkleLog()
+	tree.AppendLeafHash(leaf)
+	tree.AppendLeafHash(make([]byte, 32))
+	root := tree.RootHash()
+	for _, logger := range []string{"localhost:9000", "localhost:9001"} {
+		sth, _ := json.Marshal(definition.STH{Signer: logger, RootHash: hex.EncodeToString(root), TreeSize: 2})
+		ctx.STH_storage[logger] = definition.Gossip_object{Type: definition.STH_INIT, Signer: logger, Payload: [3]string{logger, hex.EncodeToString(sth), ""}}
+		ctx.Receipt_storage[ski] = append(ctx.Receipt_storage[ski], definition.Precert_Receipt{Signer: logger, LeafHash: hex.EncodeToString(leaf)})
+	}
+	pending := &PendingCert{Cert: GetPrecertfromCert(precert), Expected: 2, Done: make(chan *x509.Certificate, 1)}
+	ctx.Pending_storage[ski] = pending
+	send_poi := func(logger string, index int) int {
+		proof, _ := tree.InclusionProof(index, 2)
+		poi, _ := json.Marshal(crypto.POI_for_transmission{Poi: proof, SubjectKeyId: precert.SubjectKeyId, LoggerID: logger})
+		w := httptest.NewRecorder()
+		receive_poi(ctx, w, httptest.NewRequest("POST", "/CA/receive-poi", bytes.NewReader(poi)))
+		return w.Code
+	}
+	// a resent POI does not stand for a second logger
+	if send_poi("localhost:9000", 0) != 200 || send_poi("localhost:9000", 0) != 200 || len(pending.Done) != 0 {
+		t.Fatalf("certificate signed with the POI of a single logger")
+	}
+	// the proof of another leaf does not prove the precert
+	if send_poi("localhost:9001", 1) != 400 || len(pending.Done) != 0 {
+		t.Fatalf("POI of another leaf was accepted")
+	}
+	send_poi("localhost:9001", 0)
+	var final *x509.Certificate
+	select {
+	case final = <-pending.Done:
+	default:
+		t.Fatalf("final certificate was not signed after the POIs")
+	}
+	if len(ctx.Pending_storage) != 0 || len(ParseCTngextension(final).LoggerInformation) != 2 {
+		t.Errorf("final certificate does not carry the logger information")
+	}
+	if err := final.CheckSignatureFrom(ctx.Rootcert); err != nil {
+		t.Errorf("final certificate is not signed by the CA: %v", err)
+	}
+	if final.Subject.CommonName != "www.example.com" || len(final.DNSNames) != 2 {
+		t.Errorf("final certificate lost the names of the CSR")
+	}
+	precert_leaf, _ := crypto.PrecertLeafData(precert)
+	final_leaf, _ := crypto.PrecertLeafData(final)
+	if string(precert_leaf) != string(final_leaf) {
+		t.Errorf("leaf of the final certificate differs from the precert leaf")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
+	ctx.CA_private_config.Admin_token = "secret"
+	auditpath := filepath.Join(t.TempDir(), "revocations.log")
+	ctx.AuditLog, _ = OpenAuditLog(auditpath)
+	issuer := Generate_Issuer(ctx.CA_private_config.Signer)
+	certs := Generate_N_Signed_PreCert(ctx, 3, "www.example.com", 365*24*time.Hour, false, issuer, ctx.Rootcert, false, &ctx.PrivateKey, 0)
+	record_issued_certs(ctx, certs)
+	revoke := func(token string, body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/ctng/v2/revoke", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("X-Forwarded-For", "203.0.113.9")
+		revoke_cert(ctx, w, r)
+		return w.Code
+	}
+	serial := certs[1].SerialNumber.Text(16)
+	rid := GetRIDfromCert(certs[1])
+	if code := revoke("wrong", `{"serial_number":"`+serial+`","reason":1}`); code != 401 {
+		t.Errorf("expected 401, got %d", code)
+	}
+	audit := ctx.AuditLog
+	ctx.AuditLog = nil
+	if code := revoke("secret", `{"serial_number":"`+serial+`","reason":1}`); code != 503 || ctx.CRV.CRV_current.Test(uint(rid)) {
+		t.Errorf("revocation without an audit log got %d", code)
+	}
+	ctx.AuditLog = audit
+	if code := revoke("secret", `{"serial_number":"`+serial+`","reason":7}`); code != 400 {
+		t.Errorf("expected 400 for an unknown reason, got %d", code)
+	}
+	if code := revoke("secret", `{"serial_number":"abcdef","reason":1}`); code != 404 {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code := revoke("secret", `{"serial_number":"`+serial+`","reason":1}`); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := revoke("secret", `{"rid":`+strconv.Itoa(rid)+`,"reason":4}`); code != 409 {
+		t.Errorf("expected 409, got %d", code)
+	}
+	records, err := ReadAuditLog(auditpath)
+	if err != nil || len(records) != 1 || records[0].RID != rid || records[0].Reason != 1 || records[0].Requester != "192.0.2.1:1234" {
+		t.Errorf("audit log does not hold the revocation: %v", records)
+	}
+	// the revocation is in the delta CRV of the next REV
+	rev := Generate_Revocation(ctx, "1", 0)
+	var revca Revocation
+	json.Unmarshal([]byte(rev.Payload[2]), &revca)
+	delta_bytes, _ := util.DecompressData(revca.Delta_CRV)
+	delta := new(bitset.BitSet)
+	delta.UnmarshalBinary(delta_bytes)
+	if delta.Count() != 1 || !delta.Test(uint(rid)) {
+		t.Errorf("delta CRV does not carry the revocation")
+	}
+}
+
+func TestCAStorage(t *testing.T) {
+	dir := t.TempDir()
+	ctx := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
+	ctx.CA_private_config.Admin_token = "secret"
+	if err := RecoverCA(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	issuer := Generate_Issuer(ctx.CA_private_config.Signer)
+	certs := Generate_N_Signed_PreCert(ctx, 4, "www.example.com", 365*24*time.Hour, false, issuer, ctx.Rootcert, false, &ctx.PrivateKey, 0)
+	record_issued_certs(ctx, certs)
+	revoke := func(rid int) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/ctng/v2/revoke", strings.NewReader(`{"rid":`+strconv.Itoa(rid)+`,"reason":1}`))
+		r.Header.Set("Authorization", "Bearer secret")
+		revoke_cert(ctx, w, r)
+		if w.Code != 200 {
+			t.Fatalf("revocation of RID %d failed: %d", rid, w.Code)
+		}
+	}
+	// the final certificate signed at the end of the period is stored with its record
+	cert_to_sign := GetPrecertfromCert(certs[3])
+	UpdateCTngExtension(cert_to_sign, LoggerInfo{STH: definition.Gossip_object{Type: definition.STH_INIT, Signer: "localhost:9000"}})
+	ctx.CurrentCertificatePool.AddCert(cert_to_sign)
+	final := SignAllCerts(ctx)[0]
+	// end of a period: one revocation is in the snapshot, the other one only in the audit log
+	revoke(GetRIDfromCert(certs[0]))
+	// a revocation outside the audit log keeps the time it was made
+	revoked_at := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	ctx.CRV.RevokeAt(GetRIDfromCert(certs[1]), revoked_at)
+	ctx.Fresh = false
+	ctx.CRV.CRV_pre_update = ctx.CRV.CRV_current.Clone()
+	if err := SaveCAState(ctx); err != nil {
+		t.Fatal(err)
+	}
+	revoke(GetRIDfromCert(certs[2]))
+	counter := ctx.CertCounter
+	ctx.Storage.Close()
+	ctx.AuditLog.Close()
+
+	restarted := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
+	if err := RecoverCA(restarted, dir); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Storage.Close()
+	defer restarted.AuditLog.Close()
+	if restarted.CertCounter != counter || restarted.Fresh {
+		t.Errorf("RID counter %d not restored, expected %d", restarted.CertCounter, counter)
+	}
+	if len(restarted.Issued_storage) != 4 || len(restarted.Revocations) != 2 {
+		t.Errorf("issued certificates or revocations not restored")
+	}
+	if !bytes.Equal(restarted.Issued_storage[GetRIDfromCert(final)].Certificate, final.Raw) {
+		t.Errorf("final certificate signed at the end of the period not restored")
+	}
+	delta := restarted.CRV.CRV_current.SymmetricDifference(restarted.CRV.CRV_pre_update)
+	if !restarted.CRV.CRV_pre_update.Test(uint(GetRIDfromCert(certs[0]))) || delta.Count() != 1 || !delta.Test(uint(GetRIDfromCert(certs[2]))) {
+		t.Errorf("CRV not restored")
+	}
+	if status := GetCertStatus(restarted, certs[1].SerialNumber); !status.Revoked || !status.RevocationTime.Equal(revoked_at) {
+		t.Errorf("revocation time %v not restored, expected %v", status.RevocationTime, revoked_at)
+	}
+	// new certificates never reuse a RID
+	more := Generate_N_Signed_PreCert(restarted, 1, "www.example.com", 365*24*time.Hour, false, issuer, restarted.Rootcert, false, &restarted.PrivateKey, 0)
+	if GetRIDfromCert(more[0]) != counter {
+		t.Errorf("RID %d reused after restart", GetRIDfromCert(more[0]))
+	}
+}
+
+func TestGrowableCRV(t *testing.T) {
+	ctx := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
+	ctx.CRV = New_CRV(64)
+	// a verifier that keeps the CRV of the CA and applies each delta after checking the SRH
+	var known *bitset.BitSet
+	apply := func(rev definition.Gossip_object) error {
+		var revocation Revocation
+		json.Unmarshal([]byte(rev.Payload[2]), &revocation)
+		delta_bytes, _ := util.DecompressData(revocation.Delta_CRV)
+		delta := new(bitset.BitSet)
+		delta.UnmarshalBinary(delta_bytes)
+		updated, err := definition.ApplyDeltaCRV(known, delta, revocation.Size)
+		if err != nil {
+			return err
+		}
+		hash, err := definition.SRH_hash(rev.Period, updated, delta, revocation.Size, revocation.Prev_period, revocation.Prev_SRH)
+		if err != nil {
+			return err
+		}
+		sig, _ := crypto.RSASigFromString(revocation.SRH)
+		if err = crypto.RSAVerify(hash, sig, &ctx.PublicKey); err != nil {
+			return err
+		}
+		known = updated
+		return nil
+	}
+	next_period := func(period string) definition.Gossip_object {
+		rev := Generate_Revocation(ctx, period, 0)
+		ctx.CRV.CRV_pre_update = ctx.CRV.CRV_current.Clone()
+		return rev
+	}
+	ctx.CRV.Revoke(3)
+	if err := apply(next_period("1")); err != nil {
+		t.Fatal(err)
+	}
+	// a RID beyond the size grows the CRV, the delta still applies to the smaller CRV
+	ctx.CRV.Revoke(100)
+	if ctx.CRV.Size != 128 {
+		t.Fatalf("CRV size is %d after revoking RID 100", ctx.CRV.Size)
+	}
+	if err := apply(next_period("2")); err != nil {
+		t.Fatal(err)
+	}
+	if known.Len() != 128 || !known.Test(3) || !known.Test(100) {
+		t.Errorf("CRV of the verifier is wrong")
+	}
+	// a REV claiming a smaller size cannot hide a known revocation
+	if _, err := definition.ApplyDeltaCRV(known, bitset.New(64), 64); err == nil {
+		t.Errorf("truncated CRV was accepted")
+	}
+	// the split-world REV is still signed over the CRV it claims
+	known = nil
+	ctx.CRV.CRV_pre_update = bitset.New(0)
+	if err := apply(Generate_Revocation(ctx, "3", 1)); err != nil {
+		t.Errorf("fake REV does not verify: %v", err)
+	}
+}
+
+func TestCRLAndOCSP(t *testing.T) {
+	ctx := InitializeCAContext("testFiles/ca_testconfig/1/CA_public_config.json", "testFiles/ca_testconfig/1/CA_private_config.json", "testFiles/ca_testconfig/1/CA_crypto_config.json")
+	ctx.CA_private_config.Admin_token = "secret"
+	ctx.AuditLog, _ = OpenAuditLog(filepath.Join(t.TempDir(), "revocations.log"))
+	issuer := Generate_Issuer(ctx.CA_private_config.Signer)
+	certs := Generate_N_Signed_PreCert(ctx, 2, "www.example.com", 365*24*time.Hour, false, issuer, ctx.Rootcert, false, &ctx.PrivateKey, 0)
+	record_issued_certs(ctx, certs)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/ctng/v2/revoke", strings.NewReader(`{"rid":`+strconv.Itoa(GetRIDfromCert(certs[1]))+`,"reason":1}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	revoke_cert(ctx, w, r)
+	if w.Code != 200 {
+		t.Fatalf("revocation failed: %d", w.Code)
+	}
+	// the CRL lists the revoked certificate with its reason
+	w = httptest.NewRecorder()
+	requestCRL(ctx, w, httptest.NewRequest("GET", "/ctng/v2/crl", nil))
+	crl, err := x509.ParseRevocationList(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crl.CheckSignatureFrom(ctx.Rootcert); err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificates) != 1 || crl.RevokedCertificates[0].SerialNumber.Cmp(certs[1].SerialNumber) != 0 {
+		t.Fatalf("CRL does not list the revoked certificate")
+	}
+	if ext := crl.RevokedCertificates[0].Extensions; len(ext) != 1 || !ext[0].Id.Equal(oidCRLReason) {
+		t.Errorf("CRL entry does not carry the reason")
+	}
+	// OCSP for a good, a revoked and an unknown serial number
+	name_hash := sha1.Sum(ctx.Rootcert.RawSubject)
+	key_hash := issuer_key_hash(ctx, sha1.New())
+	request := ocspRequest{}
+	for _, serial := range []*big.Int{certs[0].SerialNumber, certs[1].SerialNumber, big.NewInt(42)} {
+		request.TBSRequest.RequestList = append(request.TBSRequest.RequestList, ocspSingleRequest{Cert: ocspCertID{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+			NameHash:      name_hash[:],
+			IssuerKeyHash: key_hash,
+			SerialNumber:  serial,
+		}})
+	}
+	der, _ := asn1.Marshal(request)
+	w = httptest.NewRecorder()
+	handle_ocsp(ctx, w, httptest.NewRequest("POST", "/ctng/v2/ocsp", bytes.NewReader(der)))
+	var resp ocspResponse
+	if _, err = asn1.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status != OCSPSuccessful {
+		t.Fatalf("OCSP request failed: %v %d", err, resp.Status)
+	}
+	var basic ocspBasicResponse
+	if _, err = asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(basic.TBSResponseData.Raw)
+	if err = rsa.VerifyPKCS1v15(&ctx.PublicKey, stdcrypto.SHA256, digest[:], basic.Signature.Bytes); err != nil {
+		t.Fatalf("OCSP response signature does not verify: %v", err)
+	}
+	responses := basic.TBSResponseData.Responses
+	if len(responses) != 3 || !responses[0].Good || responses[1].Revoked.Reason != 1 || !responses[2].Unknown {
+		t.Errorf("wrong OCSP statuses: %+v", responses)
+	}
+	// the same request over GET, and a request that is not DER
+	r = httptest.NewRequest("GET", "/ctng/v2/ocsp/x", nil)
+	r = mux.SetURLVars(r, map[string]string{"request": base64.StdEncoding.EncodeToString(der)})
+	w = httptest.NewRecorder()
+	handle_ocsp(ctx, w, r)
+	if _, err = asn1.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status != OCSPSuccessful {
+		t.Errorf("OCSP GET request failed")
+	}
+	w = httptest.NewRecorder()
+	handle_ocsp(ctx, w, httptest.NewRequest("POST", "/ctng/v2/ocsp", strings.NewReader("not an OCSP request")))
+	if _, err = asn1.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status != OCSPMalformedRequest {
+		t.Errorf("malformed OCSP request not rejected")
+	}
+}
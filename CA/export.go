@@ -0,0 +1,287 @@
+package CA
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+	"math/big"
+	"time"
+)
+
+// CRL and OCSP views of the CRV for consumers that do not speak CTng
+// Only RIDs with an issued certificate can be exported, a revoked RID without a serial number is left out
+
+var (
+	oidCRLReason          = asn1.ObjectIdentifier{2, 5, 29, 21}
+	oidOCSPBasic          = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSHA1               = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA256WithRSA      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	ErrOCSPMalformed      = errors.New("malformed OCSP request")
+	ErrOCSPUnsupportedAlg = errors.New("unsupported hash algorithm in OCSP request")
+)
+
+// OCSP response status, RFC 6960 4.2.1
+const (
+	OCSPSuccessful       = 0
+	OCSPMalformedRequest = 1
+	OCSPInternalError    = 2
+)
+
+// status of a certificate in the CRV
+type CertStatus struct {
+	RID            int
+	Known          bool // the serial number was issued by this CA
+	Revoked        bool
+	RevocationTime time.Time
+	Reason         int
+}
+
+// revoked certificates of the CRV with their serial numbers, reasons from the audit log and revocation times
+func revoked_entries(c *CAContext) []pkix.RevokedCertificate {
+	c.CRV_lock.Lock()
+	revoked := []uint{}
+	// revocations outside the audit log, such as the mass revocation of experiments, carry the time kept in the CRV
+	times := make(map[uint]time.Time)
+	for rid, ok := c.CRV.CRV_current.NextSet(0); ok; rid, ok = c.CRV.CRV_current.NextSet(rid + 1) {
+		revoked = append(revoked, rid)
+		times[rid], _ = c.CRV.RevocationTime(rid)
+	}
+	records := make(map[int]RevocationRecord)
+	for _, record := range c.Revocations {
+		records[record.RID] = record
+	}
+	c.CRV_lock.Unlock()
+	c.Issued_lock.Lock()
+	defer c.Issued_lock.Unlock()
+	entries := []pkix.RevokedCertificate{}
+	for _, rid := range revoked {
+		issued, ok := c.Issued_storage[int(rid)]
+		if !ok {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(issued.SerialNumber, 16)
+		if !ok {
+			continue
+		}
+		entry := pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: times[rid]}
+		if record, ok := records[int(rid)]; ok {
+			if t, err := time.Parse(time.RFC3339, record.Timestamp); err == nil {
+				entry.RevocationTime = t
+			}
+			if record.Reason != 0 {
+				reason, _ := asn1.Marshal(asn1.Enumerated(record.Reason))
+				entry.Extensions = []pkix.Extension{{Id: oidCRLReason, Value: reason}}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Generate_CRL returns a DER RFC 5280 CRL of CRV_current signed with the root certificate of the CA
+// The CRL is valid for one MMD, its number is the time it was generated
+func Generate_CRL(c *CAContext) ([]byte, error) {
+	now := time.Now().UTC()
+	template := &x509.RevocationList{
+		RevokedCertificates: revoked_entries(c),
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(time.Duration(c.CA_public_config.MMD) * time.Second),
+	}
+	return x509.CreateRevocationList(rand.Reader, template, c.Rootcert, &c.PrivateKey)
+}
+
+// GetCertStatus looks up a serial number issued by this CA in CRV_current
+func GetCertStatus(c *CAContext, serial *big.Int) CertStatus {
+	c.Issued_lock.Lock()
+	rid, ok := c.Serial_index[serial.Text(16)]
+	c.Issued_lock.Unlock()
+	if !ok {
+		return CertStatus{}
+	}
+	status := CertStatus{RID: rid, Known: true}
+	c.CRV_lock.Lock()
+	defer c.CRV_lock.Unlock()
+	if !c.CRV.CRV_current.Test(uint(rid)) {
+		return status
+	}
+	status.Revoked = true
+	status.RevocationTime, _ = c.CRV.RevocationTime(uint(rid))
+	for _, record := range c.Revocations {
+		if record.RID == rid {
+			if t, err := time.Parse(time.RFC3339, record.Timestamp); err == nil {
+				status.RevocationTime = t
+			}
+			status.Reason = record.Reason
+		}
+	}
+	return status
+}
+
+// ASN.1 structures of RFC 6960
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type tbsRequest struct {
+	Version       int              `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName pkix.RDNSequence `asn1:"explicit,tag:1,optional"`
+	RequestList   []ocspSingleRequest
+}
+
+type ocspSingleRequest struct {
+	Cert ocspCertID
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Raw         asn1.RawContent
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// hash of the public key of the root certificate, without its algorithm, as OCSP names the issuer
+func issuer_key_hash(c *CAContext, h hash.Hash) []byte {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	asn1.Unmarshal(c.Rootcert.RawSubjectPublicKeyInfo, &spki)
+	h.Write(spki.PublicKey.RightAlign())
+	return h.Sum(nil)
+}
+
+// the certificate is issued by this CA if the issuer hashes match the root certificate
+func issued_by(c *CAContext, id ocspCertID) (bool, error) {
+	var newhash func() hash.Hash
+	switch {
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA1):
+		newhash = sha1.New
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA256):
+		newhash = sha256.New
+	default:
+		return false, ErrOCSPUnsupportedAlg
+	}
+	h := newhash()
+	h.Write(c.Rootcert.RawSubject)
+	return string(h.Sum(nil)) == string(id.NameHash) && string(issuer_key_hash(c, newhash())) == string(id.IssuerKeyHash), nil
+}
+
+// OCSP_error returns an unsigned OCSP response with an error status
+func OCSP_error(status int) []byte {
+	resp, _ := asn1.Marshal(ocspResponse{Status: asn1.Enumerated(status)})
+	return resp
+}
+
+// Generate_OCSP_response answers a DER OCSP request from CRV_current, signed with the key of the root certificate
+// A serial number not issued by this CA, or a certificate of another issuer, is unknown
+// The answer is valid for one MMD, the time the next REV reaches the monitors
+func Generate_OCSP_response(c *CAContext, request []byte) ([]byte, error) {
+	var req ocspRequest
+	rest, err := asn1.Unmarshal(request, &req)
+	if err != nil || len(rest) > 0 || len(req.TBSRequest.RequestList) == 0 {
+		return OCSP_error(OCSPMalformedRequest), ErrOCSPMalformed
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	next := now.Add(time.Duration(c.CA_public_config.MMD) * time.Second)
+	responses := []ocspSingleResponse{}
+	for _, single := range req.TBSRequest.RequestList {
+		id := single.Cert
+		if id.SerialNumber == nil {
+			return OCSP_error(OCSPMalformedRequest), ErrOCSPMalformed
+		}
+		ours, err := issued_by(c, id)
+		if err != nil {
+			return OCSP_error(OCSPMalformedRequest), err
+		}
+		response := ocspSingleResponse{CertID: id, ThisUpdate: now, NextUpdate: next}
+		status := CertStatus{}
+		if ours {
+			status = GetCertStatus(c, id.SerialNumber)
+		}
+		switch {
+		case !status.Known:
+			response.Unknown = true
+		case status.Revoked:
+			response.Revoked = ocspRevokedInfo{RevocationTime: status.RevocationTime.UTC(), Reason: asn1.Enumerated(status.Reason)}
+		default:
+			response.Good = true
+		}
+		responses = append(responses, response)
+	}
+	// the responder is named by the hash of its key
+	keyhash, _ := asn1.Marshal(issuer_key_hash(c, sha1.New()))
+	tbs, err := asn1.Marshal(ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyhash},
+		ProducedAt:  now,
+		Responses:   responses,
+	})
+	if err != nil {
+		return OCSP_error(OCSPInternalError), err
+	}
+	digest := sha256.Sum256(tbs)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, &c.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return OCSP_error(OCSPInternalError), err
+	}
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    ocspResponseData{Raw: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+		Certificates:       []asn1.RawValue{{FullBytes: c.Rootcert.Raw}},
+	})
+	if err != nil {
+		return OCSP_error(OCSPInternalError), err
+	}
+	return asn1.Marshal(ocspResponse{
+		Status:   OCSPSuccessful,
+		Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic},
+	})
+}
@@ -0,0 +1,323 @@
+package CA
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jik18001/CTngV2/crypto"
+	"github.com/jik18001/CTngV2/definition"
+
+	merkletree "github.com/txaty/go-merkletree"
+)
+
+// DER encoding of the CTng extension, the ASN.1 module of version 1 is
+//
+//	CTngExtension ::= SEQUENCE {
+//	    version            INTEGER,                 -- 1
+//	    sequenceNumber     SequenceNumber,
+//	    loggerInformation  SEQUENCE OF LoggerInfo }
+//
+//	SequenceNumber ::= SEQUENCE { rid INTEGER }
+//
+//	LoggerInfo ::= SEQUENCE { sth STH, poi POI }
+//
+//	STH ::= SEQUENCE {                              -- the STH_FULL gossip object
+//	    application   UTF8String,
+//	    period        UTF8String,
+//	    type          UTF8String,
+//	    signer        UTF8String,
+//	    signers       SEQUENCE OF UTF8String,
+//	    signature     SEQUENCE OF UTF8String,       -- 2 entries
+//	    timestamp     UTF8String,
+//	    cryptoScheme  UTF8String,
+//	    payload       SEQUENCE OF UTF8String }      -- 3 entries
+//
+//	POI ::= SEQUENCE {
+//	    siblings      SEQUENCE OF OCTET STRING,
+//	    path          INTEGER,
+//	    subjectKeyId  OCTET STRING,
+//	    issuer        UTF8String,
+//	    loggerID      UTF8String }
+//
+// Certificates issued before carry the extension as JSON in an OCTET STRING, DecodeCTngExtension reads both
+
+const CTngExtensionVersion = 1
+
+type ctngExtensionASN1 struct {
+	Version           int
+	SequenceNumber    sequenceNumberASN1
+	LoggerInformation []loggerInfoASN1
+}
+
+type sequenceNumberASN1 struct {
+	RID int
+}
+
+type loggerInfoASN1 struct {
+	STH sthASN1
+	POI poiASN1
+}
+
+type sthASN1 struct {
+	Application   string `asn1:"utf8"`
+	Period        string `asn1:"utf8"`
+	Type          string `asn1:"utf8"`
+	Signer        string `asn1:"utf8"`
+	Signers       []asn1.RawValue
+	Signature     []asn1.RawValue
+	Timestamp     string `asn1:"utf8"`
+	Crypto_Scheme string `asn1:"utf8"`
+	Payload       []asn1.RawValue
+}
+
+type poiASN1 struct {
+	Siblings     [][]byte
+	Path         int64
+	SubjectKeyId []byte
+	Issuer       string `asn1:"utf8"`
+	LoggerID     string `asn1:"utf8"`
+}
+
+// SEQUENCE OF UTF8String, encoding/asn1 would pick the string type of each element by its content
+func utf8_sequence(strs []string) []asn1.RawValue {
+	seq := make([]asn1.RawValue, len(strs))
+	for i, str := range strs {
+		seq[i] = asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagUTF8String, Bytes: []byte(str)}
+	}
+	return seq
+}
+
+func from_utf8_sequence(seq []asn1.RawValue) ([]string, error) {
+	strs := make([]string, len(seq))
+	for i, value := range seq {
+		if value.Class != asn1.ClassUniversal || value.Tag != asn1.TagUTF8String {
+			return nil, errors.New("expected a UTF8String")
+		}
+		strs[i] = string(value.Bytes)
+	}
+	return strs, nil
+}
+
+// MarshalCTngExtension returns the DER encoding of the extension value
+func MarshalCTngExtension(ctngext CTngExtension) ([]byte, error) {
+	ext := ctngExtensionASN1{
+		Version:           CTngExtensionVersion,
+		SequenceNumber:    sequenceNumberASN1{RID: ctngext.SequenceNumber.RID},
+		LoggerInformation: []loggerInfoASN1{},
+	}
+	for _, info := range ctngext.LoggerInformation {
+		sth := info.STH
+		poi := poiASN1{
+			Siblings:     [][]byte{},
+			SubjectKeyId: info.POI.SubjectKeyId,
+			Issuer:       info.POI.Issuer,
+			LoggerID:     info.POI.LoggerID,
+		}
+		if info.POI.Poi != nil {
+			poi.Siblings = info.POI.Poi.Siblings
+			poi.Path = int64(info.POI.Poi.Path)
+		}
+		ext.LoggerInformation = append(ext.LoggerInformation, loggerInfoASN1{
+			STH: sthASN1{
+				Application:   sth.Application,
+				Period:        sth.Period,
+				Type:          sth.Type,
+				Signer:        sth.Signer,
+				Signers:       utf8_sequence(sth.Signers),
+				Signature:     utf8_sequence(sth.Signature[:]),
+				Timestamp:     sth.Timestamp,
+				Crypto_Scheme: sth.Crypto_Scheme,
+				Payload:       utf8_sequence(sth.Payload[:]),
+			},
+			POI: poi,
+		})
+	}
+	return asn1.Marshal(ext)
+}
+
+// UnmarshalCTngExtension decodes the DER encoding of the extension value
+func UnmarshalCTngExtension(der []byte) (CTngExtension, error) {
+	var ctngext CTngExtension
+	var ext ctngExtensionASN1
+	rest, err := asn1.Unmarshal(der, &ext)
+	if err != nil {
+		return ctngext, err
+	}
+	if len(rest) != 0 {
+		return ctngext, errors.New("trailing data after the CTng extension")
+	}
+	if ext.Version != CTngExtensionVersion {
+		return ctngext, fmt.Errorf("unsupported CTng extension version %d", ext.Version)
+	}
+	ctngext.SequenceNumber.RID = ext.SequenceNumber.RID
+	for _, info := range ext.LoggerInformation {
+		signers, err := from_utf8_sequence(info.STH.Signers)
+		if err != nil {
+			return ctngext, err
+		}
+		signature, err := from_utf8_sequence(info.STH.Signature)
+		if err != nil {
+			return ctngext, err
+		}
+		payload, err := from_utf8_sequence(info.STH.Payload)
+		if err != nil {
+			return ctngext, err
+		}
+		if len(signature) != 2 || len(payload) != 3 {
+			return ctngext, errors.New("STH in the CTng extension needs 2 signatures and 3 payloads")
+		}
+		if info.POI.Path < 0 || info.POI.Path > int64(^uint32(0)) {
+			return ctngext, errors.New("POI path out of range")
+		}
+		sth := definition.Gossip_object{
+			Application:   info.STH.Application,
+			Period:        info.STH.Period,
+			Type:          info.STH.Type,
+			Signer:        info.STH.Signer,
+			Timestamp:     info.STH.Timestamp,
+			Crypto_Scheme: info.STH.Crypto_Scheme,
+		}
+		if len(signers) > 0 {
+			sth.Signers = signers
+		}
+		copy(sth.Signature[:], signature)
+		copy(sth.Payload[:], payload)
+		ctngext.LoggerInformation = append(ctngext.LoggerInformation, LoggerInfo{
+			STH: sth,
+			POI: crypto.POI_for_transmission{
+				Poi:          &merkletree.Proof{Siblings: info.POI.Siblings, Path: uint32(info.POI.Path)},
+				SubjectKeyId: info.POI.SubjectKeyId,
+				Issuer:       info.POI.Issuer,
+				LoggerID:     info.POI.LoggerID,
+			},
+		})
+	}
+	return ctngext, nil
+}
+
+// the extension of certificates issued before the DER form: JSON in an OCTET STRING
+func unmarshalCTngExtensionJSON(value []byte) (CTngExtension, error) {
+	var ctngext CTngExtension
+	var octets []byte
+	rest, err := asn1.Unmarshal(value, &octets)
+	if err != nil {
+		return ctngext, err
+	}
+	if len(rest) != 0 {
+		return ctngext, errors.New("trailing data after the CTng extension")
+	}
+	err = json.Unmarshal(octets, &ctngext)
+	return ctngext, err
+}
+
+// EncodeCTngExtensionJSON returns the legacy JSON form of the extension value
+func EncodeCTngExtensionJSON(ctngext CTngExtension) ([]byte, error) {
+	ctngextbytes, err := json.Marshal(ctngext)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ctngextbytes)
+}
+
+// errors of the strict extension parsers, wrapped with the details of the certificate
+var (
+	ErrNoCTngExtension        = errors.New("certificate has no CTng extension")
+	ErrDuplicateCTngExtension = errors.New("certificate has more than one CTng extension")
+	ErrMalformedCTngExtension = errors.New("malformed CTng extension")
+	ErrMissingSequenceNumber  = errors.New("CTng extension has no sequence number")
+	ErrNoLoggerInformation    = errors.New("CTng extension has no logger information")
+	ErrUnknownLogger          = errors.New("CTng extension names an unknown logger")
+	ErrDuplicateLogger        = errors.New("CTng extension names a logger twice")
+)
+
+// ParseCTngExtensionValue decodes the value of a CTng extension, DER or legacy JSON
+// The RID must be present, a JSON extension without it would otherwise read as RID 0
+func ParseCTngExtensionValue(value []byte) (CTngExtension, error) {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(value, &raw); err != nil {
+		return CTngExtension{}, fmt.Errorf("%w: %v", ErrMalformedCTngExtension, err)
+	}
+	var ctngext CTngExtension
+	var err error
+	if raw.Class == asn1.ClassUniversal && raw.Tag == asn1.TagSequence {
+		// the DER form cannot omit the sequence number
+		ctngext, err = UnmarshalCTngExtension(value)
+	} else {
+		ctngext, err = unmarshalCTngExtensionJSON(value)
+		if err == nil && !has_json_rid(value) {
+			return CTngExtension{}, ErrMissingSequenceNumber
+		}
+	}
+	if err != nil {
+		return CTngExtension{}, fmt.Errorf("%w: %v", ErrMalformedCTngExtension, err)
+	}
+	if ctngext.SequenceNumber.RID < 0 {
+		return CTngExtension{}, fmt.Errorf("%w: negative RID %d", ErrMalformedCTngExtension, ctngext.SequenceNumber.RID)
+	}
+	return ctngext, nil
+}
+
+// the JSON form carries the RID itself, not just an empty sequence number
+func has_json_rid(value []byte) bool {
+	var octets []byte
+	var ext struct {
+		SequenceNumber map[string]json.RawMessage
+	}
+	asn1.Unmarshal(value, &octets)
+	if json.Unmarshal(octets, &ext) != nil {
+		return false
+	}
+	_, ok := ext.SequenceNumber["RID"]
+	return ok
+}
+
+// ExtractCTngExtension returns the CTng extension of a certificate, which must carry exactly one
+func ExtractCTngExtension(cert *x509.Certificate) (CTngExtension, error) {
+	var value []byte
+	found := false
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(OIDCTngExtension) {
+			if found {
+				return CTngExtension{}, ErrDuplicateCTngExtension
+			}
+			value, found = ext.Value, true
+		}
+	}
+	if !found {
+		return CTngExtension{}, ErrNoCTngExtension
+	}
+	return ParseCTngExtensionValue(value)
+}
+
+// ExtractRID returns the RID of a certificate from its CTng extension
+func ExtractRID(cert *x509.Certificate) (int, error) {
+	ctngext, err := ExtractCTngExtension(cert)
+	if err != nil {
+		return 0, err
+	}
+	return ctngext.SequenceNumber.RID, nil
+}
+
+// ValidateLoggerInformation checks the logger information of a final certificate:
+// at least one logger, each logger once, and every logger known to the verifier
+// A logger is named by the log URL in its STH, the POI must come from the same logger
+func ValidateLoggerInformation(ctngext CTngExtension, known func(loggerID string) bool) error {
+	if len(ctngext.LoggerInformation) == 0 {
+		return ErrNoLoggerInformation
+	}
+	seen := make(map[string]bool)
+	for _, info := range ctngext.LoggerInformation {
+		loggerID := info.STH.Payload[0]
+		if !known(loggerID) || (info.POI.LoggerID != "" && info.POI.LoggerID != loggerID) {
+			return fmt.Errorf("%w: %q", ErrUnknownLogger, loggerID)
+		}
+		if seen[loggerID] {
+			return fmt.Errorf("%w: %q", ErrDuplicateLogger, loggerID)
+		}
+		seen[loggerID] = true
+	}
+	return nil
+}
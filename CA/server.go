@@ -9,11 +9,16 @@ import (
 	"github.com/jik18001/CTngV2/util"
 
 	//"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 
-	//"io/ioutil"
 	"crypto/x509"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"time"
@@ -21,7 +26,10 @@ import (
 	//"strings"
 	"bytes"
 	"crypto/rsa"
+	"crypto/subtle"
+	"math/big"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -48,6 +56,16 @@ func handleCARequests(c *CAContext) {
 	gorillaRouter.HandleFunc("/CA/receive-poi", bindCAContext(c, receive_poi)).Methods("POST")
 	// receive get request from monitor
 	gorillaRouter.HandleFunc("/ctng/v2/get-revocation", bindCAContext(c, requestREV)).Methods("GET")
+	// latest CRV checkpoint, for monitors
+	gorillaRouter.HandleFunc("/ctng/v2/get-checkpoint", bindCAContext(c, requestCheckpoint)).Methods("GET")
+	// issue a certificate for a CSR
+	gorillaRouter.HandleFunc("/ctng/v2/issue-cert", bindCAContext(c, issue_cert)).Methods("POST")
+	// revoke a certificate, for the operator of the CA
+	gorillaRouter.HandleFunc("/ctng/v2/revoke", bindCAContext(c, revoke_cert)).Methods("POST")
+	// CRL and OCSP views of the CRV, for TLS stacks that do not verify CTng
+	gorillaRouter.HandleFunc("/ctng/v2/crl", bindCAContext(c, requestCRL)).Methods("GET")
+	gorillaRouter.HandleFunc("/ctng/v2/ocsp", bindCAContext(c, handle_ocsp)).Methods("POST")
+	gorillaRouter.HandleFunc("/ctng/v2/ocsp/{request:.+}", bindCAContext(c, handle_ocsp)).Methods("GET")
 	// Start the HTTP server.
 	http.Handle("/", gorillaRouter)
 	// Listen on port set by config until server is stopped.
@@ -135,6 +153,11 @@ func requestREV(c *CAContext, w http.ResponseWriter, r *http.Request) {
 	if c.Max_latency > 0 {
 		time.Sleep(time.Duration(util.GetRandomLatency(c.Min_latency, c.Max_latency)) * time.Millisecond) // Delay before sending
 	}
+	// ?period= asks for the REV of an earlier period, for a monitor that missed it
+	if period := r.URL.Query().Get("period"); period != "" {
+		requestPastREV(c, w, period)
+		return
+	}
 	req_count := 1
 	if c.CA_Type != 0 {
 		c.Request_Count_lock.Lock()
@@ -209,6 +232,32 @@ func requestREV(c *CAContext, w http.ResponseWriter, r *http.Request) {
 
 }
 
+// serve the latest CRV checkpoint, the split-world CA does not fork its checkpoints
+func requestCheckpoint(c *CAContext, w http.ResponseWriter, r *http.Request) {
+	c.CRV_lock.Lock()
+	checkpoint := c.Checkpoint
+	c.CRV_lock.Unlock()
+	if checkpoint.Type == "" {
+		http.Error(w, "no checkpoint published yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checkpoint)
+}
+
+// serve the REV of a past period
+func requestPastREV(c *CAContext, w http.ResponseWriter, period string) {
+	c.CRV_lock.Lock()
+	rev, ok := c.REV_storage[period]
+	c.CRV_lock.Unlock()
+	if !ok {
+		http.Error(w, "no REV for this period", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
 // receive STH from logger
 func receive_sth(c *CAContext, w http.ResponseWriter, r *http.Request) {
 	// Unmarshal the request body into a STH
@@ -243,9 +292,13 @@ func receive_poi(c *CAContext, w http.ResponseWriter, r *http.Request) {
 	}
 	//fmt.Println("POI received: ", poi)
 	//fmt.Println("Logger ID in this poi: ", poi.LoggerID)
-	// Get the STH of the logger
-	sth := c.STH_storage[poi.LoggerID]
-	//fmt.Println("sth: ", sth, c.STH_storage)
+	// Get the STH of the logger, the POI must prove the leaf of its receipt in that STH
+	sth, err := check_poi(c, poi)
+	if err != nil {
+		fmt.Println(util.RED+"POI rejected: ", err, util.RESET)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	// Construct the logger info
 
 	Logger_info := LoggerInfo{
@@ -260,34 +313,316 @@ func receive_poi(c *CAContext, w http.ResponseWriter, r *http.Request) {
 		c.CurrentCertificatePool.UpdateCertBySubjectKeyID(string(poi.SubjectKeyId), target_cert)
 		c.Certpool_lock.Unlock()
 	}
+	c.Pending_lock.Lock()
+	defer c.Pending_lock.Unlock()
+	if pending, ok := c.Pending_storage[string(poi.SubjectKeyId)]; ok && pending.Cert != nil {
+		// a resent POI does not count twice, UpdateCTngExtension keeps one entry per logger
+		pending.Cert = UpdateCTngExtension(pending.Cert, Logger_info)
+		finish_pending_cert(c, string(poi.SubjectKeyId), pending)
+	}
+}
+
+// check a POI against the latest STH of its logger and the leaf the logger signed a receipt for
+func check_poi(c *CAContext, poi crypto.POI_for_transmission) (definition.Gossip_object, error) {
+	c.STH_storage_lock.Lock()
+	sth, ok := c.STH_storage[poi.LoggerID]
+	c.STH_storage_lock.Unlock()
+	if !ok {
+		return sth, errors.New("no STH from logger " + poi.LoggerID)
+	}
+	root, err := definition.ExtractRootHash(sth)
+	if err != nil {
+		return sth, err
+	}
+	var leaf []byte
+	c.Receipt_lock.Lock()
+	for _, receipt := range c.Receipt_storage[string(poi.SubjectKeyId)] {
+		if receipt.Signer == poi.LoggerID {
+			leaf, _ = hex.DecodeString(receipt.LeafHash)
+		}
+	}
+	c.Receipt_lock.Unlock()
+	if leaf == nil {
+		return sth, errors.New("no receipt from logger " + poi.LoggerID + " for this precert")
+	}
+	if !crypto.VerifyInclusion(root, leaf, poi.Poi) {
+		return sth, errors.New("POI from logger " + poi.LoggerID + " does not match its STH")
+	}
+	return sth, nil
+}
+
+// sign the final certificate once every logger that accepted the precert has sent its POI
+// the caller must hold Pending_lock
+func finish_pending_cert(c *CAContext, ski string, pending *PendingCert) {
+	if pending.Expected == 0 || len(ParseCTngextension(pending.Cert).LoggerInformation) < pending.Expected {
+		return
+	}
+	delete(c.Pending_storage, ski)
+	final := SignCert(c, pending.Cert)
+	if err := record_issued_certs(c, []*x509.Certificate{final}); err != nil {
+		fmt.Println(util.RED+"Failed to record the final certificate: ", err, util.RESET)
+	}
+	pending.Done <- final
+}
+
+// issue a certificate for a PKCS#10 CSR
+// the precert is sent to the loggers and the final certificate is returned once their STHs and POIs are embedded
+func issue_cert(c *CAContext, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxCSRSize))
+	if err != nil {
+		http.Error(w, "failed to read CSR", http.StatusBadRequest)
+		return
+	}
+	csr, err := ParseCSR(body)
+	if err != nil {
+		http.Error(w, "invalid CSR: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = CheckCSR(csr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// reserve the key before a RID is spent on it
+	ski := string(GetSubjectKeyId(csr.PublicKey.(*rsa.PublicKey)))
+	pending := &PendingCert{
+		Done: make(chan *x509.Certificate, 1),
+	}
+	c.Pending_lock.Lock()
+	if _, ok := c.Pending_storage[ski]; ok {
+		c.Pending_lock.Unlock()
+		http.Error(w, "a certificate for this key is already being issued", http.StatusConflict)
+		return
+	}
+	c.Pending_storage[ski] = pending
+	c.Pending_lock.Unlock()
+	c.CertCounter_lock.Lock()
+	precert := Generate_Signed_PreCert_from_CSR(c, csr, IssuedCertValidity)
+	c.CertCounter_lock.Unlock()
+	if err = record_issued_certs(c, []*x509.Certificate{precert}); err != nil {
+		fmt.Println(util.RED+"Failed to record the issued certificate: ", err, util.RESET)
+		c.Pending_lock.Lock()
+		delete(c.Pending_storage, ski)
+		c.Pending_lock.Unlock()
+		http.Error(w, "failed to record the certificate", http.StatusInternalServerError)
+		return
+	}
+	c.Pending_lock.Lock()
+	pending.Cert = GetPrecertfromCert(precert)
+	c.Pending_lock.Unlock()
+	// the loggers that return a valid receipt are expected to send a POI, earlier receipts for the key do not count
+	c.Receipt_lock.Lock()
+	delete(c.Receipt_storage, ski)
+	c.Receipt_lock.Unlock()
+	Send_Signed_PreCert_To_Loggers(c, precert, c.CA_private_config.Loggerlist)
+	loggers := make(map[string]bool)
+	c.Receipt_lock.Lock()
+	for _, receipt := range c.Receipt_storage[ski] {
+		loggers[receipt.Signer] = true
+	}
+	c.Receipt_lock.Unlock()
+	accepted := len(loggers)
+	c.Pending_lock.Lock()
+	if accepted == 0 {
+		delete(c.Pending_storage, ski)
+		c.Pending_lock.Unlock()
+		http.Error(w, "no logger accepted the precert", http.StatusBadGateway)
+		return
+	}
+	pending.Expected = accepted
+	finish_pending_cert(c, ski, pending)
+	c.Pending_lock.Unlock()
+	fmt.Println(util.BLUE+"Precert with RID", GetRIDfromCert(precert), "accepted by", accepted, "loggers", util.RESET)
+	select {
+	case cert := <-pending.Done:
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	case <-time.After(time.Duration(3*c.CA_public_config.MMD) * time.Second):
+		c.Pending_lock.Lock()
+		delete(c.Pending_storage, ski)
+		c.Pending_lock.Unlock()
+		http.Error(w, "timed out waiting for the POIs of the loggers", http.StatusGatewayTimeout)
+	}
+}
+
+// remember the serial numbers and RIDs of issued certificates so they can be revoked later
+// with a storage they are on disk before the precerts leave the CA, so RIDs survive a restart
+func record_issued_certs(c *CAContext, certs []*x509.Certificate) error {
+	issued := []IssuedCert{}
+	for _, cert := range certs {
+		record := IssuedCert{
+			RID:          GetRIDfromCert(cert),
+			SerialNumber: cert.SerialNumber.Text(16),
+			Subject:      cert.Subject.CommonName,
+		}
+		// precerts are not kept, only final certificates
+		if len(ParseCTngextension(cert).LoggerInformation) > 0 {
+			record.Certificate = cert.Raw
+		}
+		issued = append(issued, record)
+	}
+	if c.Storage != nil {
+		if err := c.Storage.AppendIssued(issued); err != nil {
+			return err
+		}
+	}
+	max_rid := 0
+	c.Issued_lock.Lock()
+	for _, record := range issued {
+		c.Issued_storage[record.RID] = record
+		c.Serial_index[record.SerialNumber] = record.RID
+		if record.RID > max_rid {
+			max_rid = record.RID
+		}
+	}
+	c.Issued_lock.Unlock()
+	// every issued RID must be covered by the CRV
+	c.CRV_lock.Lock()
+	c.CRV.Grow(uint(max_rid) + 1)
+	c.CRV_lock.Unlock()
+	return nil
+}
+
+func authorized(c *CAContext, r *http.Request) bool {
+	token := c.CA_private_config.Admin_token
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+}
+
+// revoke a certificate by serial number or RID
+// the revocation is written to the audit log first and is carried by the delta CRV of the next REV
+func revoke_cert(c *CAContext, w http.ResponseWriter, r *http.Request) {
+	if !authorized(c, r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// no revocation without an audit record
+	if c.AuditLog == nil {
+		http.Error(w, "revocation needs an audit log, set a storage directory", http.StatusServiceUnavailable)
+		return
+	}
+	var req RevocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid revocation request", http.StatusBadRequest)
+		return
+	}
+	if !ValidRevocationReason(req.Reason) {
+		http.Error(w, "unsupported revocation reason "+strconv.Itoa(req.Reason), http.StatusBadRequest)
+		return
+	}
+	if (req.RID == nil) == (req.SerialNumber == "") {
+		http.Error(w, "exactly one of serial_number and rid is required", http.StatusBadRequest)
+		return
+	}
+	c.Issued_lock.Lock()
+	var issued IssuedCert
+	found := false
+	if req.RID != nil {
+		issued, found = c.Issued_storage[*req.RID]
+	} else if serial, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(req.SerialNumber), "0x"), 16); ok {
+		var rid int
+		rid, found = c.Serial_index[serial.Text(16)]
+		issued = c.Issued_storage[rid]
+	}
+	c.Issued_lock.Unlock()
+	if !found {
+		http.Error(w, "unknown certificate", http.StatusNotFound)
+		return
+	}
+	c.CRV_lock.Lock()
+	defer c.CRV_lock.Unlock()
+	if c.CRV.CRV_current.Test(uint(issued.RID)) {
+		http.Error(w, "certificate already revoked", http.StatusConflict)
+		return
+	}
+	record := RevocationRecord{
+		Timestamp:    util.GetCurrentTimestamp(),
+		RID:          issued.RID,
+		SerialNumber: issued.SerialNumber,
+		Reason:       req.Reason,
+		// the admin token names no one, record the peer of the connection rather than a forwarded header
+		Requester: r.RemoteAddr,
+	}
+	if err := c.AuditLog.Append(record); err != nil {
+		fmt.Println(util.RED+"Failed to write the audit log: ", err, util.RESET)
+		http.Error(w, "failed to record the revocation", http.StatusInternalServerError)
+		return
+	}
+	c.Revocations = append(c.Revocations, record)
+	c.CRV.Revoke(issued.RID)
+	fmt.Println(util.BLUE+"Revoked RID", issued.RID, "reason:", RevocationReasons[req.Reason], util.RESET)
+	json.NewEncoder(w).Encode(record)
+}
+
+// serve a CRL of the CRV
+func requestCRL(c *CAContext, w http.ResponseWriter, r *http.Request) {
+	crl, err := Generate_CRL(c)
+	if err != nil {
+		fmt.Println(util.RED+"Failed to generate the CRL: ", err, util.RESET)
+		http.Error(w, "failed to generate the CRL", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
 }
 
-// send a signed precert to a logger
+// answer an OCSP request, sent as the POST body or base64 encoded in the GET path (RFC 6960 A.1)
+func handle_ocsp(c *CAContext, w http.ResponseWriter, r *http.Request) {
+	var request []byte
+	var err error
+	if r.Method == http.MethodGet {
+		request, err = base64.StdEncoding.DecodeString(mux.Vars(r)["request"])
+	} else {
+		request, err = ioutil.ReadAll(io.LimitReader(r.Body, 1<<16))
+	}
+	var response []byte
+	if err != nil {
+		response = OCSP_error(OCSPMalformedRequest)
+	} else if response, err = Generate_OCSP_response(c, request); err != nil {
+		fmt.Println(util.RED+"OCSP request failed: ", err, util.RESET)
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
+
+// send a signed precert to a logger and keep the receipt it returns
 func Send_Signed_PreCert_To_Logger(c *CAContext, precert *x509.Certificate, logger string) {
 	precert_json := Marshall_Signed_PreCert(precert)
-	//fmt.Println(precert_json)
-	//fmt.Println(logger)
-	//fmt.Println(precert_json)
 	resp, err := c.Client.Post(PROTOCOL+logger+"/Logger/receive-precerts", "application/json", bytes.NewBuffer(precert_json))
 	if err != nil {
 		fmt.Println("Failed to send precert to loggers: ", err)
+		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Println(util.RED+"Logger "+logger+" rejected precert: ", resp.Status, string(body), util.RESET)
+		return
+	}
+	var receipt definition.Precert_Receipt
+	err = json.NewDecoder(resp.Body).Decode(&receipt)
+	if err != nil {
+		fmt.Println(util.RED+"Failed to decode receipt from "+logger+": ", err, util.RESET)
+		return
+	}
+	err = receipt.Verify(c.CA_crypto_config)
+	if err != nil {
+		fmt.Println(util.RED+"Receipt verification failed for "+logger+": ", err, util.RESET)
+		return
+	}
+	leaf, _ := crypto.PrecertLeafHash(precert)
+	if receipt.LeafHash != hex.EncodeToString(leaf) {
+		fmt.Println(util.RED+"Receipt from "+logger+" does not match the precert", util.RESET)
+		return
+	}
+	c.Receipt_lock.Lock()
+	c.Receipt_storage[string(precert.SubjectKeyId)] = append(c.Receipt_storage[string(precert.SubjectKeyId)], receipt)
+	c.Receipt_lock.Unlock()
 }
 
 // send a signed precert to all loggers
 func Send_Signed_PreCert_To_Loggers(c *CAContext, precert *x509.Certificate, loggers []string) {
-	//fmt.Println(loggers)
 	for i := 0; i < len(loggers); i++ {
-		precert_json := Marshall_Signed_PreCert(precert)
-		//fmt.Println(precert_json)
-		//fmt.Println(loggers[i])
-		resp, err := c.Client.Post(PROTOCOL+loggers[i]+"/Logger/receive-precerts", "application/json", bytes.NewBuffer(precert_json))
-		if err != nil {
-			fmt.Println("Failed to send precert to loggers: ", err)
-		} else {
-			defer resp.Body.Close()
-		}
+		Send_Signed_PreCert_To_Logger(c, precert, loggers[i])
 	}
 }
 
@@ -313,9 +648,19 @@ func SignAllCerts(c *CAContext) []*x509.Certificate {
 		signed_cert := Sign_certificate(cert, root, false, rsaPub, &priv)
 		signed_certs = append(signed_certs, signed_cert)
 	}
+	// keep the final certificates, like the ones issued by request
+	if err := record_issued_certs(c, signed_certs); err != nil {
+		fmt.Println(util.RED+"Failed to record the final certificates: ", err, util.RESET)
+	}
 	return signed_certs
 }
 
+// sign a single final certificate with the logger information in its CTng extension
+func SignCert(c *CAContext, cert *x509.Certificate) *x509.Certificate {
+	rsaPub, _ := cert.PublicKey.(*rsa.PublicKey)
+	return Sign_certificate(UpdateforSigning(cert), c.Rootcert, false, rsaPub, &c.CA_crypto_config.SignSecretKey)
+}
+
 func GetCurrentPeriod() string {
 	timerfc := time.Now().UTC().Format(time.RFC3339)
 	Miniutes, err := strconv.Atoi(timerfc[14:16])
@@ -351,7 +696,13 @@ func PeriodicTask(ctx *CAContext) {
 	isCA := false
 	// generate pre-certificates
 	//certs := Generate_N_Signed_PreCert(ctx, ctx.CA_private_config.Cert_per_period, host, validFor, isCA, issuer, ctx.Rootcert, false, &ctx.PrivateKey, 0)
+	ctx.CertCounter_lock.Lock()
 	certs, privkeys := Generate_N_Signed_PreCert_with_priv(ctx, ctx.CA_private_config.Cert_per_period, host, validFor, isCA, issuer, ctx.Rootcert, false, &ctx.PrivateKey, ctx.CertCounter)
+	ctx.CertCounter_lock.Unlock()
+	if err := record_issued_certs(ctx, certs); err != nil {
+		fmt.Println(util.RED+"Failed to record the issued certificates, no precerts sent this period: ", err, util.RESET)
+		return
+	}
 	ctx.CurrentKeyPool = privkeys
 	tbscerts := make([]x509.Certificate, 0)
 	for i := 0; i < len(certs); i++ {
@@ -381,6 +732,7 @@ func PeriodicTask(ctx *CAContext) {
 		//mass revoke for the first period
 		//if ctx.OnlineDuration == 0 {
 		fmt.Println(ctx.RevocationRatio)
+		ctx.CRV_lock.Lock()
 		var prebinary []byte
 		var postbinary []byte
 
@@ -416,13 +768,13 @@ func PeriodicTask(ctx *CAContext) {
 			period = "0" + strconv.Itoa(periodnum)
 		}
 		period = strconv.Itoa(periodnum)
-		rev := Generate_Revocation(ctx, period, 0)
-		//fmt.Println(rev)
-		fake_rev := Generate_Revocation(ctx, period, 1)
-		// update CRV
-		ctx.CRV.CRV_pre_update = ctx.CRV.CRV_current
-		ctx.REV_storage[period] = rev
-		ctx.REV_storage_fake[period] = fake_rev
+		if Publish_Revocation(ctx, period) {
+			fmt.Println("CA Published CRV Checkpoint for period ", period)
+		}
+		if err := SaveCAState(ctx); err != nil {
+			fmt.Println(util.RED+"Failed to save the CA state: ", err, util.RESET)
+		}
+		ctx.CRV_lock.Unlock()
 		fmt.Println("Fake REV = Real REV? ", reflect.DeepEqual(ctx.REV_storage[period].Payload, ctx.REV_storage_fake[period].Payload))
 		//fmt.Println(ctx.REV_storage_fake[period].Verify(ctx.CA_crypto_config))
 		//fmt.Println(ctx.REV_storage[period].Verify(ctx.CA_crypto_config))
@@ -439,8 +791,8 @@ func PeriodicTask(ctx *CAContext) {
 	time.AfterFunc(time.Duration(ctx.CA_public_config.MMD-20)*time.Second, f1)
 }
 
-// Our CA does not create certificate by requests
-// The purpose of the CA is for testing purposes only
+// Besides the certificates issued through /ctng/v2/issue-cert,
+// the CA generates Cert_per_period dummy certificates every period for testing purposes
 func StartCA(c *CAContext) {
 	currentsecond := GerCurrentSecond()
 	// convert string to int
@@ -462,6 +814,11 @@ func StartCA(c *CAContext) {
 	c.Client = &http.Client{
 		Transport: tr,
 	}
+	if c.StorageDirectory != "" {
+		if err := RecoverCA(c, c.StorageDirectory); err != nil {
+			log.Fatalf("Failed to recover the CA state: %v", err)
+		}
+	}
 	// Start HTTP server loop on the main thread
 	go PeriodicTask(c)
 	handleCARequests(c)
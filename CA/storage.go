@@ -0,0 +1,260 @@
+package CA
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/util"
+)
+
+// CAStorage keeps the state a CA needs after a restart in its storage directory:
+// issued.log records every RID before the precert leaves the CA, revocations.log is the audit log,
+// and state.json is a snapshot of the CRV, the REVs, the head of the REV chain and the latest checkpoint taken every period
+type CAStorage struct {
+	Directory  string
+	issuedFile *os.File
+	lock       sync.Mutex
+}
+
+const (
+	issuedFileName = "issued.log"
+	auditFileName  = "revocations.log"
+	stateFileName  = "state.json"
+)
+
+type caState struct {
+	CertCounter      int
+	CRV_current      []byte
+	CRV_pre_update   []byte
+	CRV_size         uint
+	Revoked_at       map[uint]int64
+	REV_storage      map[string]definition.Gossip_object
+	REV_storage_fake map[string]definition.Gossip_object
+	Checkpoint       definition.Gossip_object
+	Last_REV         definition.Revocation
+	Fresh            bool
+}
+
+func NewCAStorage(directory string) (*CAStorage, error) {
+	util.CreateDir(directory)
+	f, err := os.OpenFile(filepath.Join(directory, issuedFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &CAStorage{Directory: directory, issuedFile: f}, nil
+}
+
+// append issued certificates, one JSON record per line, and sync them to disk
+// a later record for the same RID replaces the earlier one
+func (s *CAStorage) AppendIssued(issued []IssuedCert) error {
+	buf := []byte{}
+	for _, record := range issued {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.issuedFile.Write(buf); err != nil {
+		return err
+	}
+	return s.issuedFile.Sync()
+}
+
+func (s *CAStorage) LoadIssued() ([]IssuedCert, error) {
+	f, err := os.Open(filepath.Join(s.Directory, issuedFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	issued := []IssuedCert{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record IssuedCert
+		// a torn last line is ignored
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			break
+		}
+		issued = append(issued, record)
+	}
+	return issued, scanner.Err()
+}
+
+// write the snapshot to a temporary file and rename it, so a crash leaves either the old or the new state
+func (s *CAStorage) SaveState(state caState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Directory, stateFileName)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// load the last snapshot, the bool is false if none was taken yet
+func (s *CAStorage) LoadState() (caState, bool, error) {
+	var state caState
+	data, err := os.ReadFile(filepath.Join(s.Directory, stateFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, err
+	}
+	return state, true, json.Unmarshal(data, &state)
+}
+
+func (s *CAStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.issuedFile.Close()
+}
+
+// snapshot the CRV and the REVs, the caller must hold CRV_lock
+func SaveCAState(c *CAContext) error {
+	if c.Storage == nil {
+		return nil
+	}
+	current, err := c.CRV.CRV_current.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	pre_update, err := c.CRV.CRV_pre_update.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	c.CertCounter_lock.Lock()
+	counter := c.CertCounter
+	c.CertCounter_lock.Unlock()
+	return c.Storage.SaveState(caState{
+		CertCounter:      counter,
+		CRV_current:      current,
+		CRV_pre_update:   pre_update,
+		CRV_size:         c.CRV.Size,
+		Revoked_at:       c.CRV.Revoked_at,
+		REV_storage:      c.REV_storage,
+		REV_storage_fake: c.REV_storage_fake,
+		Checkpoint:       c.Checkpoint,
+		Last_REV:         c.Last_REV,
+		Fresh:            c.Fresh,
+	})
+}
+
+// RecoverCA restores a CA from its storage directory and opens the storage and the audit log for appending
+// The snapshot is loaded first, then the issued certificates and the revocations recorded since are replayed
+func RecoverCA(c *CAContext, directory string) error {
+	storage, err := NewCAStorage(directory)
+	if err != nil {
+		return err
+	}
+	state, found, err := storage.LoadState()
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	issued, err := storage.LoadIssued()
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	auditpath := filepath.Join(directory, auditFileName)
+	revocations := []RevocationRecord{}
+	if _, err := os.Stat(auditpath); err == nil {
+		if revocations, err = ReadAuditLog(auditpath); err != nil {
+			storage.Close()
+			return err
+		}
+	}
+	auditlog, err := OpenAuditLog(auditpath)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	crv := New_CRV(c.CRV.Size)
+	if found && state.CRV_size > 0 {
+		crv.Size = state.CRV_size
+	}
+	if found {
+		if err = crv.CRV_current.UnmarshalBinary(state.CRV_current); err == nil {
+			err = crv.CRV_pre_update.UnmarshalBinary(state.CRV_pre_update)
+		}
+		if err != nil {
+			storage.Close()
+			auditlog.Close()
+			return err
+		}
+	}
+	for rid, t := range state.Revoked_at {
+		crv.Revoked_at[rid] = t
+	}
+	// revocations after the snapshot are not in CRV_pre_update yet, so they go into the next delta
+	for _, record := range revocations {
+		t, err := time.Parse(time.RFC3339, record.Timestamp)
+		if err != nil {
+			t = time.Now()
+		}
+		crv.RevokeAt(record.RID, t)
+	}
+	// RIDs revoked before their times were kept are dated when the CA comes back
+	for rid, ok := crv.CRV_current.NextSet(0); ok; rid, ok = crv.CRV_current.NextSet(rid + 1) {
+		if _, dated := crv.Revoked_at[rid]; !dated {
+			crv.Revoked_at[rid] = time.Now().Unix()
+		}
+	}
+	counter := state.CertCounter
+	issued_storage := make(map[int]IssuedCert)
+	serial_index := make(map[string]int)
+	for _, record := range issued {
+		issued_storage[record.RID] = record
+		serial_index[record.SerialNumber] = record.RID
+		// RIDs are never reused, even if the snapshot is older than the last issuance
+		if record.RID >= counter {
+			counter = record.RID + 1
+		}
+	}
+	crv.Grow(uint(counter))
+	c.CRV_lock.Lock()
+	c.CRV = crv
+	c.Revocations = revocations
+	c.AuditLog = auditlog
+	if found {
+		c.REV_storage = state.REV_storage
+		c.REV_storage_fake = state.REV_storage_fake
+		c.Checkpoint = state.Checkpoint
+		c.Last_REV = state.Last_REV
+		c.Fresh = state.Fresh
+	}
+	c.CRV_lock.Unlock()
+	c.CertCounter_lock.Lock()
+	if counter > c.CertCounter {
+		c.CertCounter = counter
+	}
+	c.CertCounter_lock.Unlock()
+	c.Issued_lock.Lock()
+	c.Issued_storage = issued_storage
+	c.Serial_index = serial_index
+	c.Issued_lock.Unlock()
+	c.Storage = storage
+	return nil
+}
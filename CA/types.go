@@ -5,13 +5,13 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/asn1"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
@@ -37,19 +37,55 @@ type CAContext struct {
 	OnlineDuration         int                                 //Only used for sometimes unreponsive CA and Split-world CA
 	REV_storage            map[string]definition.Gossip_object //for monitor to query
 	REV_storage_fake       map[string]definition.Gossip_object //for monitor to query
+	Checkpoint             definition.Gossip_object            //latest CRV checkpoint, for monitor to query
+	Last_REV               definition.Revocation               //last REV published without its delta, the next REV is chained to it
 	MisbehaviorInterval    int                                 //for sometimes unreponsive CA and Split-world CA, misbehave every x requests
 	StoragePath1           string
 	StoragePath2           string
-	STH_storage            map[string]definition.Gossip_object //store the STH by LID
+	STH_storage            map[string]definition.Gossip_object     //store the STH by LID
+	Receipt_storage        map[string][]definition.Precert_Receipt //receipts from loggers by SubjectKeyId
 	Request_Count_lock     *sync.Mutex
 	Min_latency            int
 	Max_latency            int
 	RevocationRatio        float64
 	STH_storage_lock       *sync.Mutex
 	Certpool_lock          *sync.Mutex
+	Receipt_lock           *sync.Mutex
+	Pending_storage        map[string]*PendingCert //certificates issued by request, by SubjectKeyId
+	Pending_lock           *sync.Mutex
+	CertCounter_lock       *sync.Mutex
+	Issued_storage         map[int]IssuedCert //certificates issued by this CA, by RID
+	Serial_index           map[string]int     //RID by serial number (hex)
+	Issued_lock            *sync.Mutex
+	CRV_lock               *sync.Mutex
+	Revocations            []RevocationRecord
+	AuditLog               *AuditLog
+	Storage                *CAStorage
+	StorageDirectory       string
 	Fresh                  bool
 }
 
+type IssuedCert struct {
+	RID          int
+	SerialNumber string
+	Subject      string
+	Certificate  []byte `json:",omitempty"` // DER of the final certificate, once it is signed
+}
+
+// a certificate issued by request, waiting for the POIs of the loggers that accepted its precert
+type PendingCert struct {
+	Cert     *x509.Certificate
+	Expected int
+	Done     chan *x509.Certificate
+}
+
+const (
+	MinRSAKeySize = 2048
+	MaxCSRSize    = 64 * 1024
+	// validity of the certificates issued by request
+	IssuedCertValidity = 365 * 24 * time.Hour
+)
+
 type CA_public_config struct {
 	All_CA_URLs     []string
 	All_Logger_URLs []string
@@ -65,6 +101,10 @@ type CA_private_config struct {
 	Monitorlist     []string
 	Gossiperlist    []string
 	Cert_per_period int
+	Admin_token     string // bearer token for the revocation endpoint, revocation is disabled if empty
+	CRV_size        uint   // initial size of the CRV, it grows as RIDs are issued
+	// periods between two CRV checkpoints, no checkpoints are published if 0
+	Checkpoint_interval int
 }
 
 // RID is self generated by the CA
@@ -74,7 +114,7 @@ type LoggerInfo struct {
 }
 
 type SequenceNumber struct {
-	RID int `json:"RID,omitempty"`
+	RID int `json:"RID"`
 }
 
 type CTngExtension struct {
@@ -83,41 +123,26 @@ type CTngExtension struct {
 }
 
 var (
-	OIDCTngExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 67847871}
+	OIDCTngExtension = crypto.OIDCTngExtension
 )
 
 type CTngCertPoolStorage struct {
 	Certpools map[string]crypto.CertPool
 }
 
+// DER encoding of the extension, see extension.go
 func EncodeCTngExtension(ctngext CTngExtension) []byte {
-	// encode the ctngext to bytes using json marshal
-	ctngextbytes, err := json.Marshal(ctngext)
-	if err != nil {
-		fmt.Println("Error in EncodeCTngExtension: ", err)
-	}
-	// encode the json bytes to asn1 bytes
-	OctectString := asn1.RawValue{
-		Tag:   asn1.TagOctetString,
-		Bytes: ctngextbytes,
-	}
-	ctngextasn1bytes, err := asn1.Marshal(OctectString)
+	ctngextasn1bytes, err := MarshalCTngExtension(ctngext)
 	if err != nil {
 		fmt.Println("Error in EncodeCTngExtension: ", err)
 	}
 	return ctngextasn1bytes
 }
 
+// decode the DER extension, or the JSON one of certificates issued before the DER form
+// the extension is empty if it is malformed, ParseCTngExtensionValue returns the error
 func DecodeCTngExtension(ctngextasn1bytes []byte) CTngExtension {
-	// decode the asn1 bytes to json bytes
-	var OctectString asn1.RawValue
-	_, err := asn1.Unmarshal(ctngextasn1bytes, &OctectString)
-	if err != nil {
-		fmt.Println("Error in DecodeCTngExtension: ", err)
-	}
-	var ctngext CTngExtension
-	// decode the json bytes to ctngext
-	err = json.Unmarshal(OctectString.Bytes, &ctngext)
+	ctngext, err := ParseCTngExtensionValue(ctngextasn1bytes)
 	if err != nil {
 		fmt.Println("Error in DecodeCTngExtension: ", err)
 	}
@@ -159,12 +184,11 @@ func UpdateAllforSigning(certs []*x509.Certificate) []*x509.Certificate {
 	return certs
 }
 
+// lenient parsers for the certificates the CA builds itself, verifiers use ExtractCTngExtension and ExtractRID
 func ParseCTngextension(cert *x509.Certificate) CTngExtension {
-	var ctngext CTngExtension
-	for _, ext := range cert.Extensions {
-		if ext.Id.Equal(OIDCTngExtension) {
-			ctngext = DecodeCTngExtension(ext.Value)
-		}
+	ctngext, err := ExtractCTngExtension(cert)
+	if err != nil && err != ErrNoCTngExtension {
+		fmt.Println("Error in ParseCTngextension: ", err)
 	}
 	return ctngext
 }
@@ -326,9 +350,19 @@ func InitializeCAContext(public_config_path string, private_config_file_path str
 		Min_latency:            0,
 		Max_latency:            290,
 		STH_storage:            make(map[string]definition.Gossip_object),
+		Receipt_storage:        make(map[string][]definition.Precert_Receipt),
 		Request_Count_lock:     &sync.Mutex{},
 		STH_storage_lock:       &sync.Mutex{},
 		Certpool_lock:          &sync.Mutex{},
+		Receipt_lock:           &sync.Mutex{},
+		Pending_storage:        make(map[string]*PendingCert),
+		Pending_lock:           &sync.Mutex{},
+		CertCounter_lock:       &sync.Mutex{},
+		Issued_storage:         make(map[int]IssuedCert),
+		Serial_index:           make(map[string]int),
+		Issued_lock:            &sync.Mutex{},
+		CRV_lock:               &sync.Mutex{},
+		Revocations:            []RevocationRecord{},
 		Fresh:                  true,
 	}
 	// Initialize http client
@@ -339,6 +373,9 @@ func InitializeCAContext(public_config_path string, private_config_file_path str
 	// Generate root certificate
 	caContext.Rootcert = Generate_Root_Certificate(caContext)
 	newCRV := CRV_init()
+	if privconf.CRV_size > 0 {
+		newCRV = New_CRV(privconf.CRV_size)
+	}
 	caContext.CRV = newCRV
 	return caContext
 }
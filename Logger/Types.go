@@ -38,23 +38,37 @@ type LoggerContext struct {
 	PublicKey             rsa.PublicKey
 	PrivateKey            rsa.PrivateKey
 	CurrentPrecertPool    *crypto.CertPool
+	MerkleLog             *crypto.MerkleLog  //append-only log of every precert logged so far
+	LogEntries            []x509.Certificate //entries of the log, in leaf order
+	LeafIndex             map[string]int     //hex leaf hash to the index of its first occurrence
+	Storage               LogStorage         //durable storage of the log, nil keeps the log in memory only
 	PrecertStorage        *PrecertStorage
 	OnlinePeriod          int
+	Last_STH_period       int                                 //period of the latest STH, receipts promise inclusion in the next one
 	Logger_Type           int                                 //0 for normal Logger, 1 for Split-world Logger, 2 for always unreponsive Logger, 3 for sometimes unreponsive Logger
 	Request_Count         int                                 //Only used for sometimes unreponsive Logger and Split-world Logger
 	STH_storage           map[string]definition.Gossip_object //for monitor to query
+	STH_history           []definition.Gossip_object          //every STH published, in order, periods wrap every hour
 	STH_storage_fake      map[string]definition.Gossip_object //for monitor to query
 	MisbehaviorInterval   int                                 //for sometimes unreponsive Logger and Split-world Logger, misbehave every x requests
 	OnlineDuration        int                                 //for sometimes unreponsive Logger and Split-world Logger, misbehave every x requests
-	StorageDirectory      string
+	StorageDirectory      string                              //durable storage of the log, empty keeps the log in memory only
 	StorageFile           string
 	Request_Count_lock    *sync.Mutex
 	CertPool_lock         *sync.Mutex
+	Log_lock              *sync.RWMutex
+	STH_lock              *sync.RWMutex
 	StoragePath           string
 	Max_latency           int
 	Min_latency           int
 }
 
+// entries returned by a single get-entries request
+const MaxEntriesPerRequest = 1000
+
+// STHs returned by a single get-sth-history request
+const MaxSTHsPerRequest = 100
+
 type PrecertStorage struct {
 	PrecertPools map[string]*crypto.CertPool
 }
@@ -111,6 +125,9 @@ func InitializeLoggerContext(public_config_path string, private_config_file_path
 		PublicKey:             cryptoconfig.SignPublicMap[cryptoconfig.SelfID],
 		PrivateKey:            cryptoconfig.SignSecretKey,
 		CurrentPrecertPool:    crypto.NewCertPool(),
+		MerkleLog:             crypto.NewMerkleLog(),
+		LogEntries:            []x509.Certificate{},
+		LeafIndex:             make(map[string]int),
 		PrecertStorage:        &PrecertStorage{PrecertPools: make(map[string]*crypto.CertPool)},
 		OnlinePeriod:          0,
 		Logger_Type:           0,
@@ -119,10 +136,14 @@ func InitializeLoggerContext(public_config_path string, private_config_file_path
 		Max_latency:           290,
 		Min_latency:           0,
 		STH_storage:           make(map[string]definition.Gossip_object),
+		STH_history:           []definition.Gossip_object{},
 		STH_storage_fake:      make(map[string]definition.Gossip_object),
 		MisbehaviorInterval:   0,
+		StorageDirectory:      "Logger_log/" + privconf.Signer + "/",
 		Request_Count_lock:    &sync.Mutex{},
 		CertPool_lock:         &sync.Mutex{},
+		Log_lock:              &sync.RWMutex{},
+		STH_lock:              &sync.RWMutex{},
 	}
 	// Initialize http client
 	tr := &http.Transport{}
@@ -167,11 +188,11 @@ func GenerateLogger_crypto_config_template() *crypto.StoredCryptoConfig {
 	}
 }
 
-func SaveToStorage(ctx LoggerContext) {
-	certs := ctx.CurrentPrecertPool.GetCerts()
+func SaveToStorage(ctx LoggerContext, pool *crypto.CertPool) {
+	certs := pool.GetCerts()
 	data := [][]any{}
 	for _, cert := range certs {
-		cert_json, _ := json.Marshal(cert)
+		cert_json, _ := json.Marshal(util.ParseTBSCertificate(&cert))
 		data = append(data, []any{cert_json})
 	}
 	util.WriteData(ctx.StoragePath, data)
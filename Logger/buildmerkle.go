@@ -11,26 +11,100 @@ import (
 	"github.com/jik18001/CTngV2/util"
 )
 
+// build a standalone tree from the certs, used for one-off trees such as the split-world STH
 func BuildMerkleTreeFromCerts(certs []x509.Certificate, ctx LoggerContext, periodNum int) (definition.Gossip_object, []byte, []crypto.POI_for_transmission) {
+	return ExtendMerkleLog(crypto.NewMerkleLog(), certs, ctx, periodNum)
+}
+
+// append the certs to the log, sign an STH over every entry logged so far and return the POIs of the new entries
+func ExtendMerkleLog(tree *crypto.MerkleLog, certs []x509.Certificate, ctx LoggerContext, periodNum int) (definition.Gossip_object, []byte, []crypto.POI_for_transmission) {
 	leafs := make([]crypto.POI_for_transmission, 0)
-	blocks := crypto.GenerateDataBlocks(certs)
-	tree, _ := crypto.GenerateMerkleTree(blocks)
-	POI := crypto.GeneratePOI(tree)
-	roothash := crypto.GenerateRootHash(tree)
+	start := tree.Size()
+	for _, cert := range certs {
+		tree.Append(&crypto.Certblock{Content: cert})
+	}
+	roothash := tree.RootHash()
 	for i, cert := range certs {
+		POI, _ := tree.InclusionProof(start+i, tree.Size())
 		leafs = append(leafs, crypto.POI_for_transmission{
-			Poi:          POI[i],
+			Poi:          POI,
 			SubjectKeyId: cert.SubjectKeyId,
 			Issuer:       cert.Issuer.CommonName,
 			LoggerID:     ctx.Logger_private_config.Signer,
 		})
 	}
+	return Generate_STH(ctx, roothash, tree.Size(), periodNum), roothash, leafs
+}
+
+// persist the entries appended to the log from index start and record them, the caller holds Log_lock
+// Nothing is recorded if they can not be persisted
+func RecordLogEntries(ctx *LoggerContext, start int, certs []x509.Certificate) error {
+	leaves := [][]byte{}
+	for i := range certs {
+		leaf, _ := ctx.MerkleLog.LeafHash(start + i)
+		leaves = append(leaves, leaf)
+	}
+	if ctx.Storage != nil {
+		if err := ctx.Storage.AppendEntries(certs, leaves); err != nil {
+			return err
+		}
+	}
+	for i, cert := range certs {
+		ctx.LogEntries = append(ctx.LogEntries, cert)
+		if _, ok := ctx.LeafIndex[hex.EncodeToString(leaves[i])]; !ok {
+			ctx.LeafIndex[hex.EncodeToString(leaves[i])] = start + i
+		}
+	}
+	return nil
+}
+
+// append the certs to the Logger's log and persist them, the log is rolled back if they can not be persisted
+func AppendToLog(ctx *LoggerContext, certs []x509.Certificate, periodNum int) (definition.Gossip_object, []byte, []crypto.POI_for_transmission, error) {
+	ctx.Log_lock.Lock()
+	defer ctx.Log_lock.Unlock()
+	rollback := ctx.MerkleLog.Copy()
+	start := ctx.MerkleLog.Size()
+	STH, sth, POIs := ExtendMerkleLog(ctx.MerkleLog, certs, *ctx, periodNum)
+	if err := RecordLogEntries(ctx, start, certs); err != nil {
+		ctx.MerkleLog = rollback
+		return definition.Gossip_object{}, nil, nil, err
+	}
+	return STH, sth, POIs, nil
+}
+
+// sign a receipt promising the precert will be covered by the next STH, the caller holds CertPool_lock
+func Generate_Receipt(ctx *LoggerContext, cert *x509.Certificate) (definition.Precert_Receipt, error) {
+	leaf, err := crypto.PrecertLeafHash(cert)
+	if err != nil {
+		return definition.Precert_Receipt{}, err
+	}
+	// the STH of this period is already out once the periodic task ran, the precert goes into the next one
+	periodint, _ := strconv.Atoi(util.GetCurrentPeriod())
+	if ctx.Last_STH_period == periodint+1 {
+		periodint = periodint + 1
+	}
+	receipt := definition.Precert_Receipt{
+		Signer:    ctx.Logger_private_config.Signer,
+		Timestamp: util.GetCurrentTimestamp(),
+		Period:    strconv.Itoa(periodint + 1),
+		LeafHash:  hex.EncodeToString(leaf),
+	}
+	signature, err := crypto.RSASign([]byte(receipt.Payload()), &ctx.PrivateKey, crypto.CTngID(ctx.Logger_private_config.Signer))
+	if err != nil {
+		return definition.Precert_Receipt{}, err
+	}
+	receipt.Signature = signature.String()
+	return receipt, nil
+}
+
+// sign an STH for a tree of treesize entries
+func Generate_STH(ctx LoggerContext, roothash []byte, treesize int, periodNum int) definition.Gossip_object {
 	STH1 := definition.STH{
 		Signer:    string(ctx.Logger_private_config.Signer),
 		Timestamp: util.GetCurrentTimestamp(),
 		Period:    util.GetCurrentPeriod(),
 		RootHash:  hex.EncodeToString(roothash),
-		TreeSize:  len(blocks),
+		TreeSize:  treesize,
 	}
 	payload0 := string(ctx.Logger_private_config.Signer)
 	sth_payload, _ := json.Marshal(STH1)
@@ -47,5 +121,5 @@ func BuildMerkleTreeFromCerts(certs []x509.Certificate, ctx LoggerContext, perio
 		Crypto_Scheme: "RSA",
 		Payload:       [3]string{payload0, payload1, payload2},
 	}
-	return gossipSTH, roothash, leafs
+	return gossipSTH
 }
@@ -1,26 +1,28 @@
 package Logger
 
 import (
+	"bytes"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/jik18001/CTngV2/CA"
 	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
 	"github.com/jik18001/CTngV2/util"
 )
 
 func TestMerkle(t *testing.T) {
-	certs := make([]x509.Certificate, 0)
-	for i := 0; i < 2; i++ {
-		subjectKeyIdBytes := []byte(strconv.Itoa(i))
-		certs = append(certs, x509.Certificate{
-			SubjectKeyId: subjectKeyIdBytes,
-		})
-	}
+	certs := crypto.Generatedummycertlist(2)
 	periodNum := 0
 	ctx := InitializeLoggerContext("../tests/networktests/logger_testconfig/1/Logger_public_config.json",
 		"../tests/networktests/logger_testconfig/1/Logger_private_config.json",
@@ -33,13 +35,9 @@ func TestMerkle(t *testing.T) {
 		t.Errorf("Root hash is not correct")
 	}
 	testExistsSubjectKeyId := []byte("1")
-	testExistsCert := x509.Certificate{
-		SubjectKeyId: testExistsSubjectKeyId,
-	}
+	testExistsCert := certs[1]
 	testNotExistsSubjectKeyId := []byte("4")
-	testNotExistsCert := x509.Certificate{
-		SubjectKeyId: testNotExistsSubjectKeyId,
-	}
+	testNotExistsCert := crypto.Generatedummycertlist(5)[4]
 	counter := 0
 	// Verify the POI
 	// try encode and decode the leaves to see whether the POI is correct
@@ -94,3 +92,204 @@ func TestCertPoolMerk(t *testing.T) {
 		fmt.Println(cert.Issuer)
 	}
 }
+
+func TestQueryAPI(t *testing.T) {
+	ctx := InitializeLoggerContext("../tests/networktests/logger_testconfig/1/Logger_public_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_private_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_crypto_config.json",
+	)
+	certs := crypto.Generatedummycertlist(5)
+	// two periods of entries
+	for i, batch := range [][]x509.Certificate{certs[:2], certs[2:]} {
+		start := ctx.MerkleLog.Size()
+		sth, _, _ := ExtendMerkleLog(ctx.MerkleLog, batch, *ctx, i+1)
+		RecordLogEntries(ctx, start, batch)
+		ctx.STH_storage[fmt.Sprintf("%02d", i+1)] = sth
+		ctx.STH_history = append(ctx.STH_history, sth)
+	}
+	w := httptest.NewRecorder()
+	requestEntries(ctx, w, httptest.NewRequest("GET", "/ctng/v2/get-entries?start=1&end=10", nil))
+	var entries []definition.Log_Entry
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if len(entries) != 4 || entries[0].Index != 1 {
+		t.Fatalf("get-entries returned %d entries", len(entries))
+	}
+	w = httptest.NewRecorder()
+	requestProofByHash(ctx, w, httptest.NewRequest("GET", "/ctng/v2/get-proof-by-hash?hash="+entries[2].LeafHash+"&tree_size=4", nil))
+	var proof definition.Inclusion_Proof
+	json.Unmarshal(w.Body.Bytes(), &proof)
+	root, _ := ctx.MerkleLog.RootHashAt(4)
+	if pass, _ := crypto.VerifyPOI(root, proof.Poi, certs[3]); !pass || proof.Leaf_index != 3 {
+		t.Errorf("get-proof-by-hash returned an invalid proof")
+	}
+	// the leaf is not in the tree of size 3
+	w = httptest.NewRecorder()
+	requestProofByHash(ctx, w, httptest.NewRequest("GET", "/ctng/v2/get-proof-by-hash?hash="+entries[2].LeafHash+"&tree_size=3", nil))
+	if w.Code != 404 {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	requestSTH(ctx, w, httptest.NewRequest("GET", "/ctng/v2/get-sth?period=2", nil))
+	var sth definition.Gossip_object
+	json.Unmarshal(w.Body.Bytes(), &sth)
+	if sth_info, err := definition.ExtractSTH(sth); err != nil || sth_info.TreeSize != 5 {
+		t.Errorf("get-sth returned the wrong STH for period 2")
+	}
+	w = httptest.NewRecorder()
+	requestSTH(ctx, w, httptest.NewRequest("GET", "/ctng/v2/get-sth?period=3", nil))
+	if w.Code != 404 {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	requestSTH(ctx, w, httptest.NewRequest("GET", "/ctng/v2/get-sth?period=-1", nil))
+	if w.Code != 400 {
+		t.Errorf("expected 400 for a negative period, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	requestSTHHistory(ctx, w, httptest.NewRequest("GET", "/ctng/v2/get-sth-history?start=1&count=5", nil))
+	var history definition.STH_History
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if history.Total != 2 || len(history.STHs) != 1 || history.STHs[0].Period != "2" {
+		t.Errorf("get-sth-history returned %d of %d STHs", len(history.STHs), history.Total)
+	}
+}
+
+func TestReceivePrecert(t *testing.T) {
+	ctx := InitializeLoggerContext("../tests/networktests/logger_testconfig/1/Logger_public_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_private_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_crypto_config.json",
+	)
+	ctx_ca := CA.InitializeCAContext("../tests/networktests/ca_testconfig/1/CA_public_config.json",
+		"../tests/networktests/ca_testconfig/1/CA_private_config.json",
+		"../tests/networktests/ca_testconfig/1/CA_crypto_config.json",
+	)
+	issuer := CA.Generate_Issuer(ctx_ca.CA_private_config.Signer)
+	precerts := CA.Generate_N_Signed_PreCert(ctx_ca, 1, "www.example.com", time.Hour, false, issuer, ctx_ca.Rootcert, false, &ctx_ca.PrivateKey, 0)
+	w := httptest.NewRecorder()
+	receive_pre_cert(ctx, w, httptest.NewRequest("POST", "/Logger/receive-precerts", bytes.NewReader(precerts[0].Raw)))
+	if w.Code != 200 {
+		t.Fatalf("valid precert rejected: %d %s", w.Code, w.Body.String())
+	}
+	var receipt definition.Precert_Receipt
+	json.Unmarshal(w.Body.Bytes(), &receipt)
+	leaf, _ := crypto.PrecertLeafHash(precerts[0])
+	if receipt.Verify(ctx_ca.CA_crypto_config) != nil || receipt.LeafHash != hex.EncodeToString(leaf) {
+		t.Errorf("invalid receipt")
+	}
+	if len(ctx.CurrentPrecertPool.GetCerts()) != 1 {
+		t.Errorf("precert not added to the pool")
+	}
+	// malformed submission
+	w = httptest.NewRecorder()
+	receive_pre_cert(ctx, w, httptest.NewRequest("POST", "/Logger/receive-precerts", bytes.NewReader([]byte("not a certificate"))))
+	if w.Code != 400 {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	// precert from an issuer the logger does not accept
+	ctx.Logger_private_config.CAlist = []string{}
+	w = httptest.NewRecorder()
+	receive_pre_cert(ctx, w, httptest.NewRequest("POST", "/Logger/receive-precerts", bytes.NewReader(precerts[0].Raw)))
+	if w.Code != 403 {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	ctx := InitializeLoggerContext("../tests/networktests/logger_testconfig/1/Logger_public_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_private_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_crypto_config.json",
+	)
+	ctx_ca := CA.InitializeCAContext("../tests/networktests/ca_testconfig/1/CA_public_config.json",
+		"../tests/networktests/ca_testconfig/1/CA_private_config.json",
+		"../tests/networktests/ca_testconfig/1/CA_crypto_config.json",
+	)
+	issuer := CA.Generate_Issuer(ctx_ca.CA_private_config.Signer)
+	precerts := CA.Generate_N_Signed_PreCert(ctx_ca, 3, "www.example.com", time.Hour, false, issuer, ctx_ca.Rootcert, false, &ctx_ca.PrivateKey, 0)
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RecoverLog(ctx, storage)
+	for period, batch := range [][]*x509.Certificate{precerts[:1], precerts[1:]} {
+		certs := []x509.Certificate{}
+		for _, precert := range batch {
+			certs = append(certs, *precert)
+		}
+		start := ctx.MerkleLog.Size()
+		STH, _, _ := ExtendMerkleLog(ctx.MerkleLog, certs, *ctx, period)
+		if err := RecordLogEntries(ctx, start, certs); err != nil {
+			t.Fatal(err)
+		}
+		storage.SaveSTH(strconv.Itoa(period), STH, STH)
+	}
+	// an hour later the period comes back, the history keeps both STHs
+	STH, _, _ := ExtendMerkleLog(ctx.MerkleLog, []x509.Certificate{}, *ctx, 1)
+	storage.SaveSTH("1", STH, STH)
+	storage.Close()
+	// simulate a crash in the middle of a write
+	f, _ := os.OpenFile(filepath.Join(dir, entriesFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0, 0, 1, 0, 42})
+	f.Close()
+	ctx2 := InitializeLoggerContext("../tests/networktests/logger_testconfig/1/Logger_public_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_private_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_crypto_config.json",
+	)
+	storage2, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage2.Close()
+	if err := RecoverLog(ctx2, storage2); err != nil {
+		t.Fatal(err)
+	}
+	if ctx2.MerkleLog.Size() != 3 || string(ctx2.MerkleLog.RootHash()) != string(ctx.MerkleLog.RootHash()) {
+		t.Errorf("recovered log does not match")
+	}
+	if _, ok := ctx2.STH_storage["1"]; !ok || len(ctx2.STH_storage) != 2 {
+		t.Errorf("STH history not recovered")
+	}
+	if len(ctx2.STH_history) != 3 {
+		t.Errorf("STH history has %d STHs, expected 3", len(ctx2.STH_history))
+	}
+	// entries are served in DER
+	w := httptest.NewRecorder()
+	requestEntries(ctx2, w, httptest.NewRequest("GET", "/ctng/v2/get-entries?start=0&end=0", nil))
+	var entries []definition.Log_Entry
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if len(entries) != 1 || !bytes.Equal(entries[0].Precert, precerts[0].Raw) {
+		t.Errorf("get-entries did not serve the DER of the precert")
+	}
+}
+
+// storage whose disk is full
+type failingStorage struct {
+	LogStorage
+}
+
+func (s failingStorage) AppendEntries(entries []x509.Certificate, leaves [][]byte) error {
+	return errors.New("no space left on device")
+}
+
+func TestAppendToLogFailure(t *testing.T) {
+	ctx := InitializeLoggerContext("../tests/networktests/logger_testconfig/1/Logger_public_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_private_config.json",
+		"../tests/networktests/logger_testconfig/1/Logger_crypto_config.json",
+	)
+	certs := crypto.Generatedummycertlist(3)
+	if _, _, _, err := AppendToLog(ctx, certs[:2], 1); err != nil {
+		t.Fatal(err)
+	}
+	root := ctx.MerkleLog.RootHash()
+	ctx.Storage = failingStorage{}
+	if _, _, _, err := AppendToLog(ctx, certs[2:], 2); err == nil {
+		t.Fatal("entries that were not persisted were logged")
+	}
+	// the log is back to the last persisted state
+	if ctx.MerkleLog.Size() != 2 || !bytes.Equal(ctx.MerkleLog.RootHash(), root) {
+		t.Errorf("log not rolled back, %d entries", ctx.MerkleLog.Size())
+	}
+	if len(ctx.LogEntries) != 2 || len(ctx.LeafIndex) != 2 {
+		t.Errorf("entries recorded without being persisted")
+	}
+}
@@ -3,15 +3,16 @@ package Logger
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/jik18001/CTngV2/CA"
 	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
 	"github.com/jik18001/CTngV2/util"
@@ -37,6 +38,14 @@ func handleLoggerRequests(ctx *LoggerContext) {
 	gorillaRouter.HandleFunc("/Logger/receive-precerts", bindLoggerContext(ctx, receive_pre_cert)).Methods("POST")
 	// get sth request from Monitor
 	gorillaRouter.HandleFunc("/ctng/v2/get-sth", bindLoggerContext(ctx, requestSTH)).Methods("GET")
+	// get all published STHs, paginated
+	gorillaRouter.HandleFunc("/ctng/v2/get-sth-history", bindLoggerContext(ctx, requestSTHHistory)).Methods("GET")
+	// get consistency proof between two tree sizes
+	gorillaRouter.HandleFunc("/ctng/v2/get-sth-consistency", bindLoggerContext(ctx, requestConsistency)).Methods("GET")
+	// get logged precerts
+	gorillaRouter.HandleFunc("/ctng/v2/get-entries", bindLoggerContext(ctx, requestEntries)).Methods("GET")
+	// get inclusion proof of a leaf hash
+	gorillaRouter.HandleFunc("/ctng/v2/get-proof-by-hash", bindLoggerContext(ctx, requestProofByHash)).Methods("GET")
 	//start the HTTP server
 	http.Handle("/", gorillaRouter)
 	// Listen on port set by config until server is stopped.
@@ -44,27 +53,51 @@ func handleLoggerRequests(ctx *LoggerContext) {
 }
 
 func requestSTH(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
+	// STH of an earlier period, for monitors catching up and clients checking older certificates
+	if r.URL.Query().Has("period") {
+		periodint, err := strconv.Atoi(r.URL.Query().Get("period"))
+		if err != nil || periodint < 1 || periodint > 60 {
+			http.Error(w, "period must be a number from 1 to 60", http.StatusBadRequest)
+			return
+		}
+		period := strconv.Itoa(periodint)
+		if periodint < 10 {
+			period = "0" + period
+		}
+		c.STH_lock.RLock()
+		sth, ok := c.STH_storage[period]
+		c.STH_lock.RUnlock()
+		if !ok {
+			http.Error(w, "no STH for period "+period, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(sth)
+		return
+	}
 	if c.Max_latency > 0 {
 		time.Sleep(time.Duration(util.GetRandomLatency(c.Min_latency, c.Max_latency)) * time.Millisecond) // Delay before sending
 	}
 	// get current period
 	Period := util.GetCurrentPeriod()
+	c.STH_lock.RLock()
+	sth, sth_fake := c.STH_storage[Period], c.STH_storage_fake[Period]
+	c.STH_lock.RUnlock()
 	c.Request_Count_lock.Lock()
 	defer c.Request_Count_lock.Unlock()
 	c.Request_Count = c.Request_Count + 1
 	switch c.Logger_Type {
 	case 0:
 		// normal logger
-		json.NewEncoder(w).Encode(c.STH_storage[Period])
+		json.NewEncoder(w).Encode(sth)
 		return
 	case 1:
 		// split-world logger
 		if c.Request_Count%c.MisbehaviorInterval == 0 && c.OnlineDuration == 1 {
 			// misbehave
-			json.NewEncoder(w).Encode(c.STH_storage_fake[Period])
+			json.NewEncoder(w).Encode(sth_fake)
 			return
 		} else {
-			json.NewEncoder(w).Encode(c.STH_storage[Period])
+			json.NewEncoder(w).Encode(sth)
 			return
 		}
 	case 2:
@@ -77,16 +110,16 @@ func requestSTH(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
 			// misbehave
 			return
 		} else {
-			json.NewEncoder(w).Encode(c.STH_storage[Period])
+			json.NewEncoder(w).Encode(sth)
 			return
 		}
 	case 4:
 		// Split-world-logger on second round since requested by monitor, behave normally on other rounds
 		if c.Request_Count%c.MisbehaviorInterval == 0 && c.OnlineDuration == 1 {
-			json.NewEncoder(w).Encode(c.STH_storage_fake[Period])
+			json.NewEncoder(w).Encode(sth_fake)
 			return
 		} else {
-			json.NewEncoder(w).Encode(c.STH_storage[Period])
+			json.NewEncoder(w).Encode(sth)
 			return
 		}
 	case 5:
@@ -94,7 +127,7 @@ func requestSTH(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
 		if c.OnlineDuration == 1 {
 			return
 		} else {
-			json.NewEncoder(w).Encode(c.STH_storage[Period])
+			json.NewEncoder(w).Encode(sth)
 			return
 		}
 	case 6:
@@ -102,30 +135,161 @@ func requestSTH(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
 		if c.Request_Count%c.MisbehaviorInterval == 0 && c.OnlineDuration == 1 {
 			return
 		} else {
-			json.NewEncoder(w).Encode(c.STH_storage[Period])
+			json.NewEncoder(w).Encode(sth)
 			return
 		}
 	}
 }
 
+// serve the STH history oldest first, count STHs from offset start
+func requestSTHHistory(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
+	start, count := 0, MaxSTHsPerRequest
+	var err1, err2 error
+	if r.URL.Query().Has("start") {
+		start, err1 = strconv.Atoi(r.URL.Query().Get("start"))
+	}
+	if r.URL.Query().Has("count") {
+		count, err2 = strconv.Atoi(r.URL.Query().Get("count"))
+	}
+	if err1 != nil || err2 != nil || start < 0 || count < 1 {
+		http.Error(w, "start and count must be positive numbers", http.StatusBadRequest)
+		return
+	}
+	if count > MaxSTHsPerRequest {
+		count = MaxSTHsPerRequest
+	}
+	c.STH_lock.RLock()
+	sths := c.STH_history
+	c.STH_lock.RUnlock()
+	history := definition.STH_History{
+		Total: len(sths),
+		Start: start,
+		STHs:  []definition.Gossip_object{},
+	}
+	if start < len(sths) {
+		end := start + count
+		if end > len(sths) {
+			end = len(sths)
+		}
+		history.STHs = sths[start:end]
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+// serve the consistency proof between the trees of size first and second
+func requestConsistency(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
+	first, err1 := strconv.Atoi(r.URL.Query().Get("first"))
+	second, err2 := strconv.Atoi(r.URL.Query().Get("second"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "first and second must be tree sizes", http.StatusBadRequest)
+		return
+	}
+	c.Log_lock.RLock()
+	proof, err := c.MerkleLog.ConsistencyProof(first, second)
+	c.Log_lock.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(definition.STH_Consistency{
+		First:  first,
+		Second: second,
+		Proof:  proof,
+	})
+}
+
+// serve the log entries from start to end (inclusive), at most MaxEntriesPerRequest are returned
+func requestEntries(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
+	start, err1 := strconv.Atoi(r.URL.Query().Get("start"))
+	end, err2 := strconv.Atoi(r.URL.Query().Get("end"))
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		http.Error(w, "start and end must be leaf indices with start <= end", http.StatusBadRequest)
+		return
+	}
+	c.Log_lock.RLock()
+	defer c.Log_lock.RUnlock()
+	if start >= len(c.LogEntries) {
+		http.Error(w, "start is beyond the end of the log", http.StatusBadRequest)
+		return
+	}
+	if end >= len(c.LogEntries) {
+		end = len(c.LogEntries) - 1
+	}
+	if end-start+1 > MaxEntriesPerRequest {
+		end = start + MaxEntriesPerRequest - 1
+	}
+	entries := []definition.Log_Entry{}
+	for i := start; i <= end; i++ {
+		leaf, _ := c.MerkleLog.LeafHash(i)
+		entries = append(entries, definition.Log_Entry{
+			Index:    i,
+			LeafHash: hex.EncodeToString(leaf),
+			Precert:  c.LogEntries[i].Raw,
+		})
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// serve the inclusion proof of the leaf with the given hex hash in the tree of tree_size entries
+func requestProofByHash(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("hash")
+	tree_size, err := strconv.Atoi(r.URL.Query().Get("tree_size"))
+	if _, err1 := hex.DecodeString(hash); err1 != nil || hash == "" || err != nil {
+		http.Error(w, "hash must be a hex leaf hash and tree_size a tree size", http.StatusBadRequest)
+		return
+	}
+	c.Log_lock.RLock()
+	defer c.Log_lock.RUnlock()
+	index, ok := c.LeafIndex[strings.ToLower(hash)]
+	if !ok || index >= tree_size {
+		http.Error(w, "leaf not found in the tree", http.StatusNotFound)
+		return
+	}
+	poi, err := c.MerkleLog.InclusionProof(index, tree_size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(definition.Inclusion_Proof{
+		Leaf_index: index,
+		Tree_size:  tree_size,
+		Poi:        poi,
+	})
+}
+
 // receive precert from CA
 func receive_pre_cert(c *LoggerContext, w http.ResponseWriter, r *http.Request) {
-	// Unmarshal the request body into a precert
-	var cert_ca *x509.Certificate
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	// Parse the DER-encoded certificate
-	cert_ca = CA.Unmarshall_Signed_PreCert(body)
-	// remove signature
-	precert := util.ParseTBSCertificate(cert_ca)
-	fmt.Println(precert.SubjectKeyId)
-	// add to precert pool
+	cert_ca, err := x509.ParseCertificate(body)
+	if err != nil {
+		http.Error(w, "malformed precert: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !inList(cert_ca.Issuer.CommonName, c.Logger_private_config.CAlist) {
+		http.Error(w, "issuer "+cert_ca.Issuer.CommonName+" is not accepted by this logger", http.StatusForbidden)
+		return
+	}
+	if !Verifyprecert(*cert_ca, *c) {
+		http.Error(w, "precert signature verification failed", http.StatusBadRequest)
+		return
+	}
+	// keep the parsed DER form, the leaf is computed over the precert TBS
 	c.CertPool_lock.Lock()
-	c.CurrentPrecertPool.AddCert(precert)
+	receipt, err := Generate_Receipt(c, cert_ca)
+	if err == nil {
+		c.CurrentPrecertPool.AddCert(cert_ca)
+	}
 	c.CertPool_lock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(receipt)
 }
 
 // send STH to CA
@@ -158,13 +322,13 @@ func Send_POI_to_CA(c *LoggerContext, poi crypto.POI_for_transmission, ca string
 	defer resp.Body.Close()
 }
 
-func Send_POIs_to_CAs(c *LoggerContext, POIs []crypto.POI_for_transmission, roothash []byte) {
+func Send_POIs_to_CAs(c *LoggerContext, pool *crypto.CertPool, POIs []crypto.POI_for_transmission, roothash []byte) {
 	//iterate over the POIs
 	for i := 0; i < len(POIs); i++ {
 		// create POI, using merkle node.ProofofInclusion and node.SubjectKeyId
 		if len(POIs[i].SubjectKeyId) != 0 {
 			//fmt.Println([]byte(POIs[i].SubjectKeyId))
-			precert := c.CurrentPrecertPool.GetCertBySubjectKeyID(string(POIs[i].SubjectKeyId))
+			precert := pool.GetCertBySubjectKeyID(string(POIs[i].SubjectKeyId))
 			pass, err := crypto.VerifyPOI(roothash, POIs[i].Poi, *precert)
 			if err != nil || pass == false {
 				fmt.Println("POI verification failed: ", err)
@@ -174,7 +338,7 @@ func Send_POIs_to_CAs(c *LoggerContext, POIs []crypto.POI_for_transmission, root
 			ca := POIs[i].Issuer
 			// send POI to CA
 			Send_POI_to_CA(c, POIs[i], ca)
-			SaveToStorage(*c)
+			SaveToStorage(*c, pool)
 		}
 	}
 }
@@ -221,34 +385,63 @@ func PeriodicTask(ctx *LoggerContext) {
 			period = "0" + period
 		}
 		// update STH
-		certlist := ctx.CurrentPrecertPool.GetCerts()
+		// swap the cert pool, precerts received from now on go into the next STH
+		ctx.CertPool_lock.Lock()
+		pool := ctx.CurrentPrecertPool
+		ctx.CurrentPrecertPool = crypto.NewCertPool()
+		ctx.Last_STH_period = periodint
+		ctx.CertPool_lock.Unlock()
+		certlist := pool.GetCerts()
 		fmt.Println("len of certlist: ", len(certlist))
 		//fmt.Println("certlist: ", certlist)
-		STH, sth, POIs := BuildMerkleTreeFromCerts(certlist, *ctx, periodint)
-		// duplicate the STH for testing
-		certlist2 := ctx.CurrentPrecertPool.GetCerts()
-		certlist2 = append(certlist2, certlist2[0])
+		// append the new precerts to the log, the STH covers all entries logged so far
+		ctx.Log_lock.RLock()
+		forked_log := ctx.MerkleLog.Copy()
+		ctx.Log_lock.RUnlock()
+		STH, sth, POIs, err := AppendToLog(ctx, certlist, periodint)
+		if err != nil {
+			// no STH is published for entries that would be lost on restart, they go into the next one
+			fmt.Println(util.RED+"Failed to persist log entries: ", err, util.RESET)
+			ctx.CertPool_lock.Lock()
+			for i := range certlist {
+				ctx.CurrentPrecertPool.AddCert(&certlist[i])
+			}
+			ctx.CertPool_lock.Unlock()
+			return
+		}
+		// duplicate the STH for testing, the fake STH is computed on a fork of the log
+		certlist2 := pool.GetCerts()
+		if len(certlist2) > 0 {
+			certlist2 = append(certlist2, certlist2[0])
+		}
 		fmt.Println("len of certlist2: ", len(certlist2))
-		STH_FAKE, _, _ := BuildMerkleTreeFromCerts(certlist2, *ctx, periodint)
+		STH_FAKE, _, _ := ExtendMerkleLog(forked_log, certlist2, *ctx, periodint)
 		//fmt.Println("STH: ", STH)
 		// update STH storage
+		ctx.STH_lock.Lock()
 		ctx.STH_storage[period] = STH
 		ctx.STH_storage_fake[period] = STH_FAKE
+		ctx.STH_history = append(ctx.STH_history, STH)
+		ctx.STH_lock.Unlock()
+		if ctx.Storage != nil {
+			err = ctx.Storage.SaveSTH(period, STH, STH_FAKE)
+			if err != nil {
+				fmt.Println(util.RED+"Failed to persist STH: ", err, util.RESET)
+			}
+		}
 		// send STH to all CAs
 		// fmt.Println(ctx.Logger_public_config.All_CA_URLs)
 		for i := 0; i < len(ctx.Logger_public_config.All_CA_URLs); i++ {
 			Send_STH_to_CA(ctx, STH, ctx.Logger_public_config.All_CA_URLs[i])
 		}
 		// send POI to the Issuer CA
-		Send_POIs_to_CAs(ctx, POIs, sth)
+		Send_POIs_to_CAs(ctx, pool, POIs, sth)
 		ctx.Request_Count_lock.Lock()
 		if ctx.Request_Count > 0 {
 			ctx.OnlineDuration = ctx.OnlineDuration + 1
 		}
 		ctx.Request_Count = 0
 		ctx.Request_Count_lock.Unlock()
-		// clear the cert pool
-		ctx.CurrentPrecertPool = crypto.NewCertPool()
 	}
 	time.AfterFunc(time.Duration(ctx.Logger_public_config.MMD-20)*time.Second, f1)
 }
@@ -265,6 +458,18 @@ func StartLogger(c *LoggerContext) {
 	c.Client = &http.Client{
 		Transport: tr,
 	}
+	// resume the log from disk, unless it is kept in memory only
+	if c.StorageDirectory != "" {
+		storage, err := NewFileStorage(c.StorageDirectory)
+		if err != nil {
+			log.Fatalf("Failed to open log storage: %v", err)
+		}
+		err = RecoverLog(c, storage)
+		if err != nil {
+			log.Fatalf("Failed to recover log: %v", err)
+		}
+		fmt.Println("Logger resumed with", c.MerkleLog.Size(), "entries")
+	}
 	// start at second 0
 	currentsecond := GerCurrentSecond()
 	// if current second is not 0
@@ -0,0 +1,291 @@
+package Logger
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jik18001/CTngV2/crypto"
+	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/util"
+)
+
+// LogStorage persists the log entries, the leaves of the tree and the STH history of a Logger
+// Internal tree nodes are recomputed from the leaves when the log is recovered
+type LogStorage interface {
+	// store new entries and their leaf hashes, in leaf order
+	AppendEntries(entries []x509.Certificate, leaves [][]byte) error
+	// load every stored entry and leaf hash, in leaf order
+	LoadEntries() ([]x509.Certificate, [][]byte, error)
+	// store the STH (and the split-world STH) published for a period
+	SaveSTH(period string, sth definition.Gossip_object, sth_fake definition.Gossip_object) error
+	// load the STH history, in the order the STHs were saved
+	LoadSTHs() ([]STH_Record, error)
+	Close() error
+}
+
+type STH_Record struct {
+	Period   string
+	STH      definition.Gossip_object
+	STH_fake definition.Gossip_object
+}
+
+// FileStorage keeps the log in two append-only files of checksummed records
+// A record torn by a crash is dropped when the storage is opened again
+type FileStorage struct {
+	Directory   string
+	entriesFile *os.File
+	sthFile     *os.File
+	lock        sync.Mutex
+}
+
+const (
+	entriesFileName = "entries.log"
+	sthFileName     = "sth.log"
+)
+
+func NewFileStorage(directory string) (*FileStorage, error) {
+	util.CreateDir(directory)
+	entriesFile, err := openRecordFile(filepath.Join(directory, entriesFileName))
+	if err != nil {
+		return nil, err
+	}
+	sthFile, err := openRecordFile(filepath.Join(directory, sthFileName))
+	if err != nil {
+		entriesFile.Close()
+		return nil, err
+	}
+	return &FileStorage{
+		Directory:   directory,
+		entriesFile: entriesFile,
+		sthFile:     sthFile,
+	}, nil
+}
+
+// open a record file for appending, cutting off a torn record at the end
+func openRecordFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, valid, err := readRecords(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// record layout: length (4 bytes) | payload | crc32 of the payload (4 bytes)
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, 4, len(payload)+8)
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	record = append(record, payload...)
+	return binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(payload))
+}
+
+// read all complete records from the start of the file and return the length of the valid prefix
+func readRecords(f *os.File) ([][]byte, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := [][]byte{}
+	offset := 0
+	for offset+4 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if offset+8+size > len(data) {
+			break
+		}
+		payload := data[offset+4 : offset+4+size]
+		if binary.BigEndian.Uint32(data[offset+4+size:]) != crc32.ChecksumIEEE(payload) {
+			break
+		}
+		records = append(records, payload)
+		offset += 8 + size
+	}
+	return records, int64(offset), nil
+}
+
+// write the records with a single write and sync them to disk
+// The file is cut back to its previous end if they can not be written
+func appendRecords(f *os.File, payloads [][]byte) error {
+	buf := []byte{}
+	for _, payload := range payloads {
+		buf = append(buf, encodeRecord(payload)...)
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(end)
+		f.Seek(end, io.SeekStart)
+	}
+	return err
+}
+
+func (s *FileStorage) AppendEntries(entries []x509.Certificate, leaves [][]byte) error {
+	if len(entries) != len(leaves) {
+		return errors.New("entries and leaves do not match")
+	}
+	payloads := [][]byte{}
+	for i, entry := range entries {
+		if len(entry.Raw) == 0 {
+			return errors.New("entry has no DER encoding")
+		}
+		payloads = append(payloads, append(append([]byte{}, leaves[i]...), entry.Raw...))
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return appendRecords(s.entriesFile, payloads)
+}
+
+func (s *FileStorage) LoadEntries() ([]x509.Certificate, [][]byte, error) {
+	s.lock.Lock()
+	records, valid, err := readRecords(s.entriesFile)
+	if err == nil {
+		_, err = s.entriesFile.Seek(valid, io.SeekStart)
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := []x509.Certificate{}
+	leaves := [][]byte{}
+	for i, record := range records {
+		if len(record) < 32 {
+			return nil, nil, fmt.Errorf("entry %d is malformed", i)
+		}
+		cert, err := x509.ParseCertificate(record[32:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("entry %d is malformed: %v", i, err)
+		}
+		entries = append(entries, *cert)
+		leaves = append(leaves, record[:32])
+	}
+	return entries, leaves, nil
+}
+
+func (s *FileStorage) SaveSTH(period string, sth definition.Gossip_object, sth_fake definition.Gossip_object) error {
+	payload, err := json.Marshal(STH_Record{Period: period, STH: sth, STH_fake: sth_fake})
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return appendRecords(s.sthFile, [][]byte{payload})
+}
+
+func (s *FileStorage) LoadSTHs() ([]STH_Record, error) {
+	s.lock.Lock()
+	records, valid, err := readRecords(s.sthFile)
+	if err == nil {
+		_, err = s.sthFile.Seek(valid, io.SeekStart)
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	sths := []STH_Record{}
+	for _, record := range records {
+		var r STH_Record
+		if err := json.Unmarshal(record, &r); err != nil {
+			return nil, err
+		}
+		sths = append(sths, r)
+	}
+	return sths, nil
+}
+
+func (s *FileStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err1 := s.entriesFile.Close()
+	err2 := s.sthFile.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// RecoverLog rebuilds the Logger's tree and STH history from its storage
+// The rebuilt tree must match the largest STH the Logger has published
+func RecoverLog(ctx *LoggerContext, storage LogStorage) error {
+	entries, leaves, err := storage.LoadEntries()
+	if err != nil {
+		return err
+	}
+	records, err := storage.LoadSTHs()
+	if err != nil {
+		return err
+	}
+	tree := crypto.NewMerkleLog()
+	leafIndex := make(map[string]int)
+	for i := range entries {
+		leaf, err := crypto.PrecertLeafHash(&entries[i])
+		if err != nil || !bytes.Equal(leaf, leaves[i]) {
+			return fmt.Errorf("stored leaf %d does not match its entry", i)
+		}
+		tree.AppendLeafHash(leaf)
+		if _, ok := leafIndex[hex.EncodeToString(leaf)]; !ok {
+			leafIndex[hex.EncodeToString(leaf)] = i
+		}
+	}
+	// the history keeps every STH, the period maps keep the latest STH of each period
+	history := []definition.Gossip_object{}
+	sths := make(map[string]definition.Gossip_object)
+	sths_fake := make(map[string]definition.Gossip_object)
+	for _, record := range records {
+		period := record.Period
+		sth_info, err := definition.ExtractSTH(record.STH)
+		if err != nil {
+			return err
+		}
+		root, err := tree.RootHashAt(sth_info.TreeSize)
+		if err != nil {
+			return fmt.Errorf("STH of period %s covers %d entries, only %d are stored", period, sth_info.TreeSize, tree.Size())
+		}
+		if hex.EncodeToString(root) != sth_info.RootHash {
+			return fmt.Errorf("stored entries do not match the STH of period %s", period)
+		}
+		history = append(history, record.STH)
+		sths[period] = record.STH
+		sths_fake[period] = record.STH_fake
+	}
+	ctx.Log_lock.Lock()
+	ctx.MerkleLog = tree
+	ctx.LogEntries = entries
+	ctx.LeafIndex = leafIndex
+	ctx.Storage = storage
+	ctx.Log_lock.Unlock()
+	ctx.STH_lock.Lock()
+	ctx.STH_storage = sths
+	ctx.STH_storage_fake = sths_fake
+	ctx.STH_history = history
+	ctx.STH_lock.Unlock()
+	return nil
+}
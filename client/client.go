@@ -5,15 +5,16 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 
-	"github.com/jik18001/CTngV2/CA"
 	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
 	"github.com/jik18001/CTngV2/monitor"
-	"github.com/jik18001/CTngV2/util"
 
 	"github.com/bits-and-blooms/bitset"
 )
@@ -98,68 +99,156 @@ func fetch(url string) ([]byte, error) {
 	return resBody, nil
 }
 
-func (ctx *ClientContext) VerifySRH(srh string, dCRV *bitset.BitSet, CAID string, Period string) bool {
-	// find the corresponding CRV
+// VerifySRH checks the SRH of a REV of CAID against the CRV of the CA, and that the REV directly follows the last REV applied
+// It returns the CRV after the REV, definition.ErrREVGap if REVs of the CA are missing and definition.ErrREVStale if the REV is not newer
+// The caller must hold CRV_DB_RWLock
+func (ctx *ClientContext) VerifySRH(revocation definition.Revocation, dCRV *bitset.BitSet, CAID string, Period string) (*bitset.BitSet, error) {
+	// find the corresponding CRV and the last REV applied
 	CRV_old := ctx.CRV_database[CAID]
-	if CRV_old == nil {
-		CRV_old = dCRV
+	var last *definition.Revocation
+	if rev, ok := ctx.REV_database[CAID]; ok {
+		last = &rev
+	}
+	err := definition.CheckREVChain(last, revocation)
+	if err != nil {
+		return nil, err
+	}
+	var localhash []byte
+	var CRV_new *bitset.BitSet
+	size := revocation.Size
+	if size == 0 {
+		// REV without a committed CRV size
+		if CRV_old == nil {
+			CRV_old = dCRV
+		}
+		// verify the SRH
+		hashmsg1, _ := CRV_old.MarshalBinary()
+		hashmsg2, _ := dCRV.MarshalBinary()
+		hash1, _ := crypto.GenerateSHA256(hashmsg1)
+		hash2, _ := crypto.GenerateSHA256(hashmsg2)
+		localhash, _ = crypto.GenerateSHA256([]byte(Period + string(hash1) + string(hash2)))
+		CRV_new, _ = definition.ApplyDeltaCRV(CRV_old, dCRV, size)
+	} else {
+		// the SRH commits to the CRV after the delta, to its size and to the previous REV
+		CRV_new, err = definition.ApplyDeltaCRV(CRV_old, dCRV, size)
+		if err == nil {
+			localhash, err = definition.SRH_hash(Period, CRV_new, dCRV, size, revocation.Prev_period, revocation.Prev_SRH)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fail to apply the delta CRV: %v", err)
+		}
 	}
-	// verify the SRH
-	hashmsg1, _ := CRV_old.MarshalBinary()
-	hashmsg2, _ := dCRV.MarshalBinary()
-	hash1, _ := crypto.GenerateSHA256(hashmsg1)
-	hash2, _ := crypto.GenerateSHA256(hashmsg2)
-
-	localhash, _ := crypto.GenerateSHA256([]byte(Period + string(hash1) + string(hash2)))
 	// the localhash will be te message we used to verify the Signature on the SRH
 	// verify the signature
-	rsasig, err := crypto.RSASigFromString(srh)
+	rsasig, err := crypto.RSASigFromString(revocation.SRH)
 	if err != nil {
-		fmt.Println("Fail to convert the signature from the SRH to RSA signature")
+		return nil, errors.New("fail to convert the signature from the SRH to RSA signature")
 	}
 	ca_publickey := ctx.Crypto.SignPublicMap[rsasig.ID]
 	err = crypto.RSAVerify(localhash, rsasig, &ca_publickey)
 	if err != nil {
-		fmt.Println("Fail to verify the signature on the SRH")
-		return false
+		return nil, errors.New("fail to verify the signature on the SRH")
 	}
 	//fmt.Println("SRH verification success")
-	return true
+	return CRV_new, nil
+}
+
+// applyREV verifies a REV and applies it to the CRV of its CA, the caller must hold CRV_DB_RWLock
+func (ctx *ClientContext) applyREV(rev definition.Gossip_object, verify bool) error {
+	if verify {
+		err := rev.Verify(ctx.Crypto)
+		if err != nil {
+			return err
+		}
+	}
+	revocation, DCRV, err := definition.ExtractRevocation(rev)
+	if err != nil {
+		return err
+	}
+	key := rev.Payload[0]
+	CRV_new, err := ctx.VerifySRH(revocation, DCRV, key, rev.Period)
+	if err != nil {
+		return err
+	}
+	ctx.CRV_database[key] = CRV_new
+	revocation.Delta_CRV = nil
+	ctx.REV_database[key] = revocation
+	return nil
+}
+
+// RequestMissingREVs gets the REVs of a CA the client missed from its current monitor
+// It asks for the REVs since the last REV applied, or for the checkpoint update of the CA if the monitor no longer has them
+func (ctx *ClientContext) RequestMissingREVs(CAID string, verify bool) bool {
+	ctx.CRV_DB_RWLock.RLock()
+	last, known := ctx.REV_database[CAID]
+	ctx.CRV_DB_RWLock.RUnlock()
+	base := monitor.PROTOCOL + ctx.GetCurrentMonitor()
+	// periods wrap, the monitor finds the REVs after the last one by its sequence number
+	if known && last.Sequence != 0 {
+		revs, err := FetchGossip(base + "/monitor/get-revocations?ca=" + url.QueryEscape(CAID) + "&since=" + strconv.FormatUint(last.Sequence, 10))
+		if err == nil {
+			ctx.CRV_DB_RWLock.Lock()
+			for _, rev := range revs {
+				if rev.Payload[0] != CAID {
+					err = errors.New("REV of another CA")
+				} else {
+					err = ctx.applyREV(rev, verify)
+				}
+				if err != nil {
+					break
+				}
+			}
+			ctx.CRV_DB_RWLock.Unlock()
+			if err == nil {
+				return true
+			}
+		}
+		fmt.Println("Fail to get the missing REVs from the monitor: ", err)
+	}
+	res, err := fetch(base + "/monitor/get-crv-checkpoint?ca=" + url.QueryEscape(CAID))
+	if err != nil {
+		fmt.Println("Fail to get the checkpoint update from the monitor: ", err)
+		return false
+	}
+	var update monitor.CheckpointUpdate
+	err = json.Unmarshal(res, &update)
+	if err != nil {
+		fmt.Println("checkpoint update unmarshal failed")
+		return false
+	}
+	return ctx.HandleCheckpointUpdate(update, verify)
 }
 
 func (ctx *ClientContext) HandleUpdate(update monitor.ClientUpdate, verify bool, newmonitor bool) bool {
-	ctx.CRV_DB_RWLock.Lock()
 	for _, rev := range update.REVs {
-		if verify {
-			err := rev.Verify(ctx.Crypto)
-			if err != nil {
-				fmt.Println("REV verification failed")
-				return false
+		key := rev.Payload[0]
+		ctx.CRV_DB_RWLock.Lock()
+		err := ctx.applyREV(rev, verify)
+		ctx.CRV_DB_RWLock.Unlock()
+		if errors.Is(err, definition.ErrREVGap) {
+			// the client missed some REVs of the CA, the REV may also be covered once they are applied
+			fmt.Println("Missing REVs of " + key + ", requesting them from the monitor")
+			if ctx.RequestMissingREVs(key, verify) {
+				ctx.CRV_DB_RWLock.Lock()
+				err = ctx.applyREV(rev, verify)
+				ctx.CRV_DB_RWLock.Unlock()
+				if errors.Is(err, definition.ErrREVStale) {
+					err = nil
+				}
 			}
 		}
-		SRH, DCRV := Get_SRH_and_DCRV(rev)
-		key := rev.Payload[0]
-		//verif REV_FULL
-		//verify SRH
-		if !ctx.VerifySRH(SRH, &DCRV, key, rev.Period) {
-			fmt.Println("SRH verification failed")
+		if err != nil {
+			fmt.Println("REV verification failed: ", err)
 			return false
 		}
-		//Update CRV
-		// look for CRV first
-		if _, ok := ctx.CRV_database[key]; !ok {
-			ctx.CRV_database[key] = &DCRV
-		} else {
-			ctx.CRV_database[key].Union(&DCRV)
-		}
 	}
-	ctx.CRV_DB_RWLock.Unlock()
 	ctx.STH_DB_RWLock.Lock()
 	for _, sth := range update.STHs {
 		if verify {
 			err := sth.Verify(ctx.Crypto)
 			if err != nil {
 				fmt.Println("sth verification failed")
+				ctx.STH_DB_RWLock.Unlock()
 				return false
 			}
 		}
@@ -168,6 +257,7 @@ func (ctx *ClientContext) HandleUpdate(update monitor.ClientUpdate, verify bool,
 		err := json.Unmarshal(payload1, &STH_def)
 		if err != nil {
 			fmt.Println("sth unmarshal failed")
+			ctx.STH_DB_RWLock.Unlock()
 			return false
 		}
 		newrecord := STH_def.RootHash
@@ -179,6 +269,7 @@ func (ctx *ClientContext) HandleUpdate(update monitor.ClientUpdate, verify bool,
 	}
 	ctx.STH_DB_RWLock.Unlock()
 	ctx.POM_DB_RWLock.Lock()
+	defer ctx.POM_DB_RWLock.Unlock()
 	for _, pom := range update.POM_ACCs {
 		if verify {
 			err := pom.Verify(ctx.Crypto)
@@ -203,71 +294,80 @@ func (ctx *ClientContext) HandleUpdate(update monitor.ClientUpdate, verify bool,
 		key := pom.Payload[0]
 		ctx.POM_database[key] = pom
 	}
-	ctx.POM_DB_RWLock.Unlock()
 	return true
 }
 
-func (ctx *ClientContext) VerifyCTngextension(cert *x509.Certificate) bool {
-	var CTngext CA.CTngExtension
-	CTngext = CA.ParseCTngextension(cert)
-	var total int
-	total = len(CTngext.LoggerInformation)
-	var faulty_logger int
-	faulty_logger = 0
-	Precert := util.ParseTBSCertificate(cert)
-	for _, loggerinfo := range CTngext.LoggerInformation {
-		// if logger is blacklisted already
-		if _, ok := ctx.POM_database[loggerinfo.STH.Signer]; ok {
-			fmt.Println("Logger is blacklisted")
-			faulty_logger++
-		} else {
-			err := loggerinfo.STH.Verify(ctx.Crypto)
-			if err != nil {
-				fmt.Println("Cert logger STH verification failed")
-				faulty_logger++
-			} else {
-				var treeinfo definition.STH
-				decoded, _ := hex.DecodeString(loggerinfo.STH.Payload[1])
-				err := json.Unmarshal(decoded, &treeinfo)
-				if err != nil {
-					fmt.Println("sth unmarshal failed")
-					faulty_logger++
-				} else {
-					roothash := ctx.STH_database[loggerinfo.STH.Payload[0]+"@"+loggerinfo.STH.Period]
-					if roothash != treeinfo.RootHash {
-						fmt.Println("STH from cert logger does not match with the one in the database")
-						fmt.Println("STH from cert logger : ", treeinfo.RootHash)
-						fmt.Println("STH from database : ", roothash)
-						faulty_logger++
-					} else {
-						//fmt.Println("Loggerinfo.POI: ", loggerinfo.POI)
-						roothashbyte, _ := hex.DecodeString(roothash)
-						pass, err := crypto.VerifyPOI(roothashbyte, loggerinfo.POI.Poi, *Precert)
-						if !pass || err != nil {
-							fmt.Println("Cert logger POI verification failed")
-							faulty_logger++
-						}
-					}
-
-				}
-			}
+// HandleCheckpointUpdate replaces the CRV of a CA with its certified checkpoint and applies the REVs since then
+// The CRV of the CA is left unchanged if the checkpoint or any of the REVs does not verify,
+// or if the update would take the CRV back to an older period
+func (ctx *ClientContext) HandleCheckpointUpdate(update monitor.CheckpointUpdate, verify bool) bool {
+	ckp := update.Checkpoint
+	if ckp.Type != definition.CKP_FULL {
+		fmt.Println("not a certified checkpoint")
+		return false
+	}
+	if verify {
+		err := ckp.Verify(ctx.Crypto)
+		if err != nil {
+			fmt.Println("checkpoint verification failed")
+			return false
 		}
 	}
-	if faulty_logger == total {
-		fmt.Println("All loggers are faulty")
+	checkpoint, crv, err := definition.VerifyCheckpoint(ckp, ctx.Crypto)
+	if err != nil {
+		fmt.Println("checkpoint signature verification failed: ", err)
 		return false
-	} else {
-		fmt.Println("total loggers : Faulty logger = ", total, " : ", faulty_logger)
-		fmt.Println("CTng Logger information verification passed, there exists at least one benign logger")
 	}
-
-	RID := CA.GetRIDfromCert(cert)
-	CRV_to_check := ctx.CRV_database[cert.Issuer.CommonName]
-	if CRV_to_check.Test(uint(RID)) {
-		fmt.Println("Certificate has been revoked")
-		return false
+	key := ckp.Payload[0]
+	ctx.CRV_DB_RWLock.Lock()
+	defer ctx.CRV_DB_RWLock.Unlock()
+	CRV_old, known := ctx.CRV_database[key]
+	REV_old, chained := ctx.REV_database[key]
+	restore := func() {
+		if known {
+			ctx.CRV_database[key] = CRV_old
+		} else {
+			delete(ctx.CRV_database, key)
+		}
+		if chained {
+			ctx.REV_database[key] = REV_old
+		} else {
+			delete(ctx.REV_database, key)
+		}
+	}
+	ctx.CRV_database[key] = crv
+	// the REVs after the checkpoint are chained to the REV of the checkpoint period
+	if checkpoint.SRH != "" {
+		ctx.REV_database[key] = definition.Revocation{Period: checkpoint.Period, SRH: checkpoint.SRH, Size: checkpoint.Size, Sequence: checkpoint.Sequence}
 	} else {
-		fmt.Println("Certificate has not been revoked")
-		return true
+		delete(ctx.REV_database, key)
+	}
+	for _, rev := range update.REVs {
+		if rev.Payload[0] != key {
+			fmt.Println("REV of another CA in the checkpoint update")
+			restore()
+			return false
+		}
+		err := ctx.applyREV(rev, verify)
+		if err != nil {
+			fmt.Println("REV verification failed: ", err)
+			restore()
+			return false
+		}
+	}
+	// periods wrap, the update is older if the last REV applied before comes after its last REV
+	if REV_new := ctx.REV_database[key]; chained && REV_new.SRH != REV_old.SRH {
+		if errors.Is(definition.CheckREVChain(&REV_old, REV_new), definition.ErrREVStale) {
+			fmt.Println("checkpoint update is older than the last REV applied")
+			restore()
+			return false
+		}
 	}
+	return true
+}
+
+// a logger is known if the client has its public key
+func (ctx *ClientContext) KnownLogger(loggerID string) bool {
+	_, ok := ctx.Crypto.SignPublicMap[crypto.CTngID(loggerID)]
+	return ok
 }
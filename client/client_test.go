@@ -1,14 +1,30 @@
 package client
 
 import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jik18001/CTngV2/CA"
+	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/gossiper"
 	"github.com/jik18001/CTngV2/monitor"
 	"github.com/jik18001/CTngV2/util"
 
@@ -149,6 +165,357 @@ func TestCert(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	ctx.VerifyCTngextension(cert)
+	// the logger of the certificate has a PoM against it
+	res := ctx.VerifyCTngextension(cert)
+	fmt.Println(res)
+	if res.Valid || !errors.Is(res.Err, ErrTooFewBenignLoggers) || res.Loggers[0].Outcome != LoggerBlacklisted {
+		t.Errorf("certificate of a blacklisted logger accepted: %v", res)
+	}
+	if periods := res.Periods(); len(periods) != 1 || periods[0] != "55" {
+		t.Errorf("expected the STH period 55 to be consulted, got %v", periods)
+	}
+	// the certificate was logged before leaves hashed the precert TBS, its POI no longer verifies
+	for key := range ctx.POM_database {
+		delete(ctx.POM_database, key)
+	}
+	if res := ctx.VerifyCTngextension(cert); res.Loggers[0].Outcome != LoggerPOIInvalid || res.Revocation != RevocationUnchecked {
+		t.Errorf("expected an invalid POI, got %v", res)
+	}
+	ctx.Policy = &VerificationPolicy{Min_benign_loggers: 2}
+	if ctx.policy().Min_benign_loggers != 2 {
+		t.Errorf("policy of the client ignored")
+	}
+	ctx.Policy = nil
+	if ctx.policy() != DefaultVerificationPolicy {
+		t.Errorf("expected the default policy")
+	}
+}
+
+func TestHandleUpdateGap(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_ca := CA.InitializeCAContext(testconfig+"ca_testconfig/1/CA_public_config.json", testconfig+"ca_testconfig/1/CA_private_config.json", testconfig+"ca_testconfig/1/CA_crypto_config.json")
+	ctx_ca.CRV = CA.New_CRV(64)
+	ctx_m := monitor.InitializeMonitorContext(testconfig+"monitor_testconfig/1/Monitor_public_config.json", testconfig+"monitor_testconfig/1/Monitor_private_config.json", testconfig+"monitor_testconfig/1/Monitor_crypto_config.json", "1")
+	for i, period := range []string{"1", "2", "3", "4"} {
+		ctx_ca.CRV.Revoke(i + 1)
+		CA.Publish_Revocation(ctx_ca, period)
+		ctx_m.StoreREVHistory(ctx_ca.REV_storage[period])
+	}
+	// the monitor serves the REVs it has after a sequence number, it has no checkpoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		revs, ok := ctx_m.GetREVsSince(r.URL.Query().Get("ca"), since)
+		if r.URL.Path != "/monitor/get-revocations" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(revs)
+	}))
+	defer server.Close()
+	ctx := &ClientContext{
+		Crypto:              ctx_ca.CA_crypto_config,
+		Current_Monitor_URL: strings.TrimPrefix(server.URL, monitor.PROTOCOL),
+		Monitor_lock:        &sync.Mutex{},
+		STH_database:        make(map[string]string),
+		CRV_database:        make(map[string]*bitset.BitSet),
+		REV_database:        make(map[string]definition.Revocation),
+		POM_database:        make(map[string]definition.Gossip_object),
+		STH_DB_RWLock:       &sync.RWMutex{},
+		CRV_DB_RWLock:       &sync.RWMutex{},
+		POM_DB_RWLock:       &sync.RWMutex{},
+	}
+	key := ctx_ca.CA_private_config.Signer
+	update := func(period string) bool {
+		return ctx.HandleUpdate(monitor.ClientUpdate{REVs: []definition.Gossip_object{ctx_ca.REV_storage[period]}}, false, false)
+	}
+	if !update("1") {
+		t.Fatal("first REV rejected")
+	}
+	// the update of period 2 was missed, the client gets REVs 2 to 4 from the monitor
+	if !update("3") {
+		t.Fatal("update after a gap rejected")
+	}
+	if ctx.REV_database[key].Period != "4" || !ctx.CRV_database[key].Equal(ctx_ca.CRV.CRV_current) {
+		t.Errorf("CRV after the missing REVs does not match the CA")
+	}
+	if update("2") {
+		t.Errorf("out of order REV accepted")
+	}
+}
+
+func TestVerifyCTngextensionErrors(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_ca := CA.InitializeCAContext(testconfig+"ca_testconfig/1/CA_public_config.json", testconfig+"ca_testconfig/1/CA_private_config.json", testconfig+"ca_testconfig/1/CA_crypto_config.json")
+	issuer := CA.Generate_Issuer(ctx_ca.CA_private_config.Signer)
+	precert := CA.Generate_N_Signed_PreCert(ctx_ca, 1, "www.example.com", time.Hour, false, issuer, ctx_ca.Rootcert, false, &ctx_ca.PrivateKey, 0)[0]
+	ctx := &ClientContext{Crypto: ctx_ca.CA_crypto_config}
+	// a precert has no logger information, a certificate without the extension has no RID
+	if res := ctx.VerifyCTngextension(precert); res.Valid || !errors.Is(res.Err, CA.ErrNoLoggerInformation) {
+		t.Errorf("expected %v, got %v", CA.ErrNoLoggerInformation, res.Err)
+	}
+	if res := ctx.VerifyCTngextension(ctx_ca.Rootcert); res.Valid || !errors.Is(res.Err, CA.ErrNoLoggerInformation) {
+		t.Errorf("expected %v, got %v", CA.ErrNoLoggerInformation, res.Err)
+	}
+	if res := ctx.VerifyCTngextension(&x509.Certificate{}); res.Valid || !errors.Is(res.Err, CA.ErrNoCTngExtension) {
+		t.Errorf("expected %v, got %v", CA.ErrNoCTngExtension, res.Err)
+	}
+	// a logger the client has no key for
+	ctngext := CA.ParseCTngextension(precert)
+	ctngext.LoggerInformation = []CA.LoggerInfo{{STH: definition.Gossip_object{Payload: [3]string{"localhost:6666", "", ""}}}}
+	forged := &x509.Certificate{Extensions: []pkix.Extension{{Id: CA.OIDCTngExtension, Value: CA.EncodeCTngExtension(ctngext)}}}
+	if res := ctx.VerifyCTngextension(forged); res.Valid || !errors.Is(res.Err, CA.ErrUnknownLogger) {
+		t.Errorf("expected %v, got %v", CA.ErrUnknownLogger, res.Err)
+	}
+}
+
+func TestTLSRoundTripper(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_ca := CA.InitializeCAContext(testconfig+"ca_testconfig/1/CA_public_config.json", testconfig+"ca_testconfig/1/CA_private_config.json", testconfig+"ca_testconfig/1/CA_crypto_config.json")
+	issuer := CA.Generate_Issuer(ctx_ca.CA_private_config.Signer)
+	serve := func(cert *x509.Certificate, key *rsa.PrivateKey) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+		server.StartTLS()
+		return server
+	}
+	ctx := &ClientContext{Crypto: ctx_ca.CA_crypto_config}
+	client := &http.Client{Transport: ctx.NewRoundTripper()}
+	// the precert of the server has no logger information yet
+	precerts, keys := CA.Generate_N_Signed_PreCert_with_priv(ctx_ca, 1, "127.0.0.1", time.Hour, false, issuer, ctx_ca.Rootcert, false, &ctx_ca.PrivateKey, 0)
+	server := serve(precerts[0], keys[precerts[0].Subject.CommonName])
+	defer server.Close()
+	_, err := client.Get(server.URL)
+	var certErr *CertificateError
+	if !errors.As(err, &certErr) || !errors.Is(err, CA.ErrNoLoggerInformation) {
+		t.Errorf("expected a CTng verification error, got %v", err)
+	}
+	// the certificate names another host
+	precerts, keys = CA.Generate_N_Signed_PreCert_with_priv(ctx_ca, 1, "www.example.com", time.Hour, false, issuer, ctx_ca.Rootcert, false, &ctx_ca.PrivateKey, 0)
+	server = serve(precerts[0], keys[precerts[0].Subject.CommonName])
+	defer server.Close()
+	if _, err := client.Get(server.URL); err == nil || errors.As(err, &certErr) {
+		t.Errorf("expected a host name error, got %v", err)
+	}
+	// the certificate is not signed by the CA it names
+	forger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forged := CA.Genrate_Unsigned_PreCert("127.0.0.1", time.Hour, false, issuer, CA.Generate_Issuer("forged"), ctx_ca)
+	forged = CA.Sign_certificate(forged, &x509.Certificate{Subject: issuer}, false, &forger.PublicKey, forger)
+	server = serve(forged, forger)
+	defer server.Close()
+	if _, err := client.Get(server.URL); !errors.Is(err, ErrBadIssuerSig) {
+		t.Errorf("expected %v, got %v", ErrBadIssuerSig, err)
+	}
+	if err := ctx.VerifyPeerCertificateFor("127.0.0.1")(nil, nil); err != ErrNoPeerCertificate {
+		t.Errorf("expected %v, got %v", ErrNoPeerCertificate, err)
+	}
+	// without a server name no certificate is accepted, a handshake with an IP address sends none in SNI
+	if err := ctx.VerifyPeerCertificateFor("")([][]byte{forged.Raw}, nil); err != ErrNoServerName {
+		t.Errorf("expected %v, got %v", ErrNoServerName, err)
+	}
+	if err := ctx.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{forged}}); err != ErrNoServerName {
+		t.Errorf("expected %v, got %v", ErrNoServerName, err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_ca := CA.InitializeCAContext(testconfig+"ca_testconfig/1/CA_public_config.json", testconfig+"ca_testconfig/1/CA_private_config.json", testconfig+"ca_testconfig/1/CA_crypto_config.json")
+	issuer := CA.Generate_Issuer(ctx_ca.CA_private_config.Signer)
+	precerts, keys := CA.Generate_N_Signed_PreCert_with_priv(ctx_ca, 1, "127.0.0.1", time.Hour, false, issuer, ctx_ca.Rootcert, false, &ctx_ca.PrivateKey, 0)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{precerts[0].Raw}, PrivateKey: keys[precerts[0].Subject.CommonName]}}}
+	upstream.StartTLS()
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "https://")
+	ctx := &ClientContext{Crypto: ctx_ca.CA_crypto_config, Config: &ClientConfig{MMD: 60}}
+	p := NewProxyContext(ctx, Proxy_block)
+	dir := t.TempDir()
+	if err := p.LoadCA(filepath.Join(dir, ProxyCAFile), filepath.Join(dir, ProxyCAKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+	// the CA is kept across restarts of the proxy
+	restarted := NewProxyContext(ctx, Proxy_block)
+	if err := restarted.LoadCA(filepath.Join(dir, ProxyCAFile), filepath.Join(dir, ProxyCAKeyFile)); err != nil || !restarted.CA_cert.Equal(p.CA_cert) {
+		t.Errorf("proxy CA not loaded from disk: %v", err)
+	}
+	// the certificates shown to the clients are bounded
+	for i := 0; i <= ProxyMaxLeaves; i++ {
+		restarted.leaf("host" + strconv.Itoa(i))
+	}
+	if len(restarted.leaves) != ProxyMaxLeaves {
+		t.Errorf("%d certificates kept", len(restarted.leaves))
+	}
+	if _, ok := restarted.leaves["host0"]; ok {
+		t.Errorf("oldest certificate kept")
+	}
+	proxy := httptest.NewServer(p.Handler())
+	defer proxy.Close()
+	connect := func() (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, resp
+	}
+	// the certificate of the upstream server has no logger information
+	conn, resp := connect()
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(resp.Header.Get(ProxyVerificationHeader), CA.ErrNoLoggerInformation.Error()) {
+		t.Errorf("expected the tunnel to be blocked, got %v %q", resp.Status, resp.Header.Get(ProxyVerificationHeader))
+	}
+	// in annotate mode the tunnel is opened with the reason, the client talks TLS to the upstream server through it
+	p.Mode = Proxy_annotate
+	conn, resp = connect()
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get(ProxyVerificationHeader), CA.ErrNoLoggerInformation.Error()) {
+		t.Fatalf("expected an annotated tunnel, got %v %q", resp.Status, resp.Header.Get(ProxyVerificationHeader))
+	}
+	// the client trusts the local CA of the proxy, which relays over the connection it verified
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA_cert)
+	tlsconn := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	fmt.Fprintf(tlsconn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsconn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "upstream" {
+		t.Errorf("unexpected answer through the tunnel %q", body)
+	}
+	if _, ok := p.cache[verdict_key(target, "127.0.0.1")]; !ok {
+		t.Errorf("verdict not kept for the address and the server name")
+	}
+	// the client cannot ask for another name than the one verified
+	conn, _ = connect()
+	defer conn.Close()
+	if err := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "www.example.com"}).Handshake(); err == nil {
+		t.Errorf("tunnel opened for another server name")
+	}
+	// other methods are refused, an unreachable server is a gateway error
+	if resp, err := http.Get(proxy.URL); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d, got %v", http.StatusMethodNotAllowed, err)
+	}
+	upstream.Close()
+	p.cache = make(map[string]proxyVerdict)
+	conn, resp = connect()
+	conn.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected %d, got %v", http.StatusBadGateway, resp.Status)
+	}
+}
+
+func TestUpdateFromMonitors(t *testing.T) {
+	ctx := &ClientContext{
+		Status:          "NEW",
+		Config_filepath: "client/Client_config.json",
+		Crypto_filepath: "client/Client_crypto_config.json",
+		Config:          &ClientConfig{},
+	}
+	ctx.InitializeClientContext()
+	update := ctx.LoadUpdate("monitor_testdata/1/Period_55/ClientUpdate.json")
+	serve := func(update monitor.ClientUpdate) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(update)
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, monitor.PROTOCOL)
+	}
+	withheld := update
+	withheld.REVs = nil
+	forged := update
+	forged.STHs = []definition.Gossip_object{update.STHs[0]}
+	forged.STHs[0].Payload[1] = "00"
+	honest := serve(update)
+	ctx.Config.Monitor_URLs = []string{"127.0.0.1:1", serve(forged), honest, serve(withheld), serve(update)}
+	ctx.Config.Monitor_quorum = 2
+	if err := ctx.UpdateFromMonitors(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctx.STH_database["localhost:9000@55"]; !ok || ctx.CRV_database["localhost:9100"] == nil {
+		t.Errorf("update of the quorum not applied")
+	}
+	if current := ctx.GetCurrentMonitor(); current != honest {
+		t.Errorf("expected to fail over to %s, got %s", honest, current)
+	}
+	// the monitor serving a forged STH is recorded, the unreachable one and the one lagging behind on the REV are not
+	for i, faulty := range []bool{false, true, false, false, false} {
+		if ctx.IsFaultyMonitor(ctx.Config.Monitor_URLs[i]) != faulty {
+			t.Errorf("monitor %d: expected faulty %v", i, faulty)
+		}
+	}
+	if updates := ctx.FetchUpdates(); len(updates) != 3 {
+		t.Errorf("expected 3 monitors left to ask, got %d", len(updates))
+	}
+	ctx.Config.Monitor_quorum = 4
+	if err := ctx.UpdateFromMonitors(); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("expected %v, got %v", ErrNoQuorum, err)
+	}
+	// faults expire
+	for i := range ctx.Monitor_faults[ctx.Config.Monitor_URLs[1]] {
+		ctx.Monitor_faults[ctx.Config.Monitor_URLs[1]][i].Timestamp = time.Now().Add(-time.Duration(MonitorFaultExpiry*ctx.Config.MMD) * time.Second).Format(time.RFC3339)
+	}
+	if ctx.IsFaultyMonitor(ctx.Config.Monitor_URLs[1]) {
+		t.Errorf("expired fault still excludes the monitor")
+	}
+}
 
+func TestCrossCheckEquivocation(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_ca := CA.InitializeCAContext(testconfig+"ca_testconfig/1/CA_public_config.json", testconfig+"ca_testconfig/1/CA_private_config.json", testconfig+"ca_testconfig/1/CA_crypto_config.json")
+	ctx_ca.CRV = CA.New_CRV(64)
+	gossipers := []*gossiper.GossiperContext{}
+	for _, id := range []string{"1", "2"} {
+		dir := testconfig + "gossiper_testconfig/" + id + "/"
+		gossipers = append(gossipers, gossiper.InitializeGossiperContext(dir+"Gossiper_public_config.json", dir+"Gossiper_private_config.json", dir+"Gossiper_crypto_config.json", id))
+	}
+	certify := func(g definition.Gossip_object) definition.Gossip_object {
+		frags := []definition.Gossip_object{}
+		for _, ctx_g := range gossipers {
+			frags = append(frags, ctx_g.Generate_Gossip_Object_FRAG(g))
+		}
+		full := gossipers[0].Generate_Gossip_Object_FULL(frags, frags[0].GetTargetType())
+		full.Period = g.Period
+		return full
+	}
+	ctx_ca.CRV.Revoke(5)
+	CA.Publish_Revocation(ctx_ca, "1")
+	// the CA signs two REVs for the same period, each certified through a different monitor
+	rev, fake := certify(ctx_ca.REV_storage["1"]), certify(ctx_ca.REV_storage_fake["1"])
+	ctx_ca.CRV.Revoke(2)
+	CA.Publish_Revocation(ctx_ca, "2")
+	next := certify(ctx_ca.REV_storage["2"])
+	ctx := &ClientContext{
+		Crypto:         ctx_ca.CA_crypto_config,
+		Config:         &ClientConfig{MMD: 60, Monitor_quorum: 2},
+		POM_database:   make(map[string]definition.Gossip_object),
+		POM_DB_RWLock:  &sync.RWMutex{},
+		Monitor_faults: make(map[string][]MonitorFault),
+		Monitor_lock:   &sync.Mutex{},
+	}
+	merged, err := ctx.CrossCheckUpdates([]MonitorUpdate{
+		{Monitor_URL: "monitor1", Update: monitor.ClientUpdate{Period: "2", REVs: []definition.Gossip_object{rev, next}}},
+		{Monitor_URL: "monitor2", Update: monitor.ClientUpdate{Period: "2", REVs: []definition.Gossip_object{fake}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ctx_ca.CA_private_config.Signer
+	if pom, ok := ctx.POM_database[key]; !ok || pom.Type != definition.CON_INIT {
+		t.Errorf("no conflict PoM against the CA")
+	}
+	if ctx.IsFaultyMonitor("monitor1") || ctx.IsFaultyMonitor("monitor2") {
+		t.Errorf("monitor blamed for the equivocation of the CA")
+	}
+	// the conflicting REVs are left out, the REV only one monitor serves is merged
+	if len(merged.REVs) != 1 || merged.REVs[0].Payload[2] != next.Payload[2] || merged.MonitorID != "monitor1" {
+		t.Errorf("expected the other REV of the CA from monitor1, got %d REVs from %s", len(merged.REVs), merged.MonitorID)
+	}
 }
@@ -0,0 +1,377 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jik18001/CTngV2/util"
+)
+
+// HTTPS forward proxy for clients that cannot use the TLS hooks
+// The proxy terminates the TLS of the client with a certificate of its local CA, which the clients must trust,
+// and relays the tunnel over its own TLS connection to the upstream server. The certificate of that connection
+// is verified with the databases of the ClientContext during its handshake, so the bytes relayed are always
+// those of the server that was verified
+
+const (
+	Proxy_block    = 0 // refuse tunnels to servers whose certificate fails verification
+	Proxy_annotate = 1 // open them, and report the failure in the CONNECT response
+)
+
+const (
+	ProxyVerificationHeader = "X-CTng-Verification"
+	ProxyDialTimeout        = 10 * time.Second
+	ProxyLeafLifetime       = 24 * time.Hour
+	ProxyMaxLeaves          = 1000 // certificates kept for the hosts the clients connect to
+	ProxyCAFile             = "ctng-proxy-ca.pem"
+	ProxyCAKeyFile          = "ctng-proxy-ca.key"
+)
+
+var (
+	ErrNotConnect          = errors.New("the proxy only accepts CONNECT requests")
+	ErrUpstreamUnreachable = errors.New("upstream server unreachable")
+	ErrSNIMismatch         = errors.New("server name of the client does not match the CONNECT host")
+	ErrBadProxyCA          = errors.New("the proxy CA files do not hold a certificate and its key")
+)
+
+// a verdict holds for the certificate it was made on
+type proxyVerdict struct {
+	cert    []byte
+	err     error
+	expires time.Time
+}
+
+type ProxyContext struct {
+	Client    *ClientContext
+	Mode      int
+	Addr      string        // listening address, only local clients can reach the default one
+	Cache_TTL time.Duration // how long a verdict on an upstream certificate is kept, 0 verifies every tunnel
+	CA_cert   *x509.Certificate
+	CA_key    *ecdsa.PrivateKey
+	cache     map[string]proxyVerdict
+	leaves    map[string]*tls.Certificate
+	cachelock *sync.Mutex
+}
+
+// the local CA is loaded with LoadCA before the proxy is started
+func NewProxyContext(ctx *ClientContext, mode int) *ProxyContext {
+	return &ProxyContext{
+		Client:    ctx,
+		Mode:      mode,
+		Addr:      "127.0.0.1:" + ctx.Config.Port,
+		Cache_TTL: time.Duration(ctx.Config.MMD) * time.Second,
+		cache:     make(map[string]proxyVerdict),
+		leaves:    make(map[string]*tls.Certificate),
+		cachelock: &sync.Mutex{},
+	}
+}
+
+// NewProxyCA generates the local CA the proxy issues the certificates it shows to its clients with
+func NewProxyCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "CTng proxy CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// LoadCA loads the local CA from certfile and keyfile, it is created and saved there on the first run
+// so the clients keep trusting the same CA across restarts
+func (p *ProxyContext) LoadCA(certfile string, keyfile string) error {
+	certPEM, err1 := os.ReadFile(certfile)
+	keyPEM, err2 := os.ReadFile(keyfile)
+	if errors.Is(err1, os.ErrNotExist) && errors.Is(err2, os.ErrNotExist) {
+		cert, key, err := NewProxyCA()
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return err
+		}
+		if err := os.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+			return err
+		}
+		p.set_CA(cert, key)
+		return nil
+	}
+	if err1 != nil {
+		return err1
+	}
+	if err2 != nil {
+		return err2
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return ErrBadProxyCA
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return ErrBadProxyCA
+	}
+	p.set_CA(cert, key)
+	return nil
+}
+
+// the certificates issued by another CA are dropped
+func (p *ProxyContext) set_CA(cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	p.cachelock.Lock()
+	defer p.cachelock.Unlock()
+	p.CA_cert = cert
+	p.CA_key = key
+	p.leaves = make(map[string]*tls.Certificate)
+}
+
+// CA_PEM returns the certificate of the local CA for the clients to trust
+func (p *ProxyContext) CA_PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.CA_cert.Raw})
+}
+
+// the certificate the proxy shows to its clients for host, issued by the local CA
+func (p *ProxyContext) leaf(host string) (*tls.Certificate, error) {
+	p.cachelock.Lock()
+	defer p.cachelock.Unlock()
+	if leaf, ok := p.leaves[host]; ok && time.Now().Before(leaf.Leaf.NotAfter) {
+		return leaf, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(ProxyLeafLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.CA_cert, &key.PublicKey, p.CA_key)
+	if err != nil {
+		return nil, err
+	}
+	cert, _ := x509.ParseCertificate(der)
+	leaf := &tls.Certificate{Certificate: [][]byte{der, p.CA_cert.Raw}, PrivateKey: key, Leaf: cert}
+	if len(p.leaves) >= ProxyMaxLeaves {
+		p.evict_leaves()
+	}
+	p.leaves[host] = leaf
+	return leaf, nil
+}
+
+// drop the expired certificates, or the oldest one if none expired, the caller holds cachelock
+// The serial numbers of the certificates are the times they were issued at
+func (p *ProxyContext) evict_leaves() {
+	oldest := ""
+	for host, leaf := range p.leaves {
+		if time.Now().After(leaf.Leaf.NotAfter) {
+			delete(p.leaves, host)
+		} else if oldest == "" || leaf.Leaf.SerialNumber.Cmp(p.leaves[oldest].Leaf.SerialNumber) < 0 {
+			oldest = host
+		}
+	}
+	if len(p.leaves) >= ProxyMaxLeaves {
+		delete(p.leaves, oldest)
+	}
+}
+
+// verdicts are kept per address and server name, a server may present another certificate for another name
+func verdict_key(addr string, serverName string) string {
+	return addr + "/" + serverName
+}
+
+// verify checks the certificate of an upstream handshake for serverName, a cached verdict is reused for the same certificate
+func (p *ProxyContext) verify(addr string, serverName string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrNoPeerCertificate
+	}
+	raw := cs.PeerCertificates[0].Raw
+	key := verdict_key(addr, serverName)
+	p.cachelock.Lock()
+	verdict, ok := p.cache[key]
+	p.cachelock.Unlock()
+	if ok && time.Now().Before(verdict.expires) && bytes.Equal(verdict.cert, raw) {
+		return verdict.err
+	}
+	cs.ServerName = serverName
+	err := p.Client.VerifyConnection(cs)
+	if p.Cache_TTL > 0 {
+		p.cachelock.Lock()
+		p.cache[key] = proxyVerdict{cert: raw, err: err, expires: time.Now().Add(p.Cache_TTL)}
+		p.cachelock.Unlock()
+	}
+	return err
+}
+
+// DialUpstream opens the TLS connection to host:port the tunnel is relayed over, its certificate is verified in the handshake
+// It returns the verification error, in annotate mode along with the connection
+func (p *ProxyContext) DialUpstream(addr string) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUpstreamUnreachable, err)
+	}
+	var verr error
+	config := &tls.Config{
+		ServerName: host,
+		// the chain is checked against the CA keys of the client in verify
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			verr = p.verify(addr, host, cs)
+			if p.Mode == Proxy_block {
+				return verr
+			}
+			return nil
+		},
+	}
+	dialer := &net.Dialer{Timeout: ProxyDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		if verr != nil && p.Mode == Proxy_block {
+			return nil, verr
+		}
+		// an unreachable server is not a verdict on its certificate
+		return nil, fmt.Errorf("%w: %v", ErrUpstreamUnreachable, err)
+	}
+	return conn, verr
+}
+
+// value of the verification header, without line breaks
+func proxy_annotation(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+}
+
+func (p *ProxyContext) handle_connect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, ErrNotConnect.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	upstream, verr := p.DialUpstream(addr)
+	if errors.Is(verr, ErrUpstreamUnreachable) {
+		http.Error(w, verr.Error(), http.StatusBadGateway)
+		return
+	}
+	if verr != nil {
+		fmt.Println(util.RED, "CTng verification of", addr, "failed:", verr, util.RESET)
+		if p.Mode == Proxy_block {
+			w.Header().Set(ProxyVerificationHeader, proxy_annotation(verr))
+			http.Error(w, "blocked by CTng: "+verr.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 200 Connection Established\r\n%s: %s\r\n\r\n", ProxyVerificationHeader, proxy_annotation(verr))
+	// the upstream connection was verified for host, the client must not ask for another name
+	client := tls.Server(&bufferedConn{Conn: conn, reader: buf.Reader}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" && !strings.EqualFold(hello.ServerName, host) {
+				return nil, fmt.Errorf("%w: %q", ErrSNIMismatch, hello.ServerName)
+			}
+			return p.leaf(host)
+		},
+	})
+	go relay(upstream, client)
+}
+
+// a hijacked connection, the client may have sent bytes after its CONNECT request
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// copy both ways until one side closes
+func relay(upstream net.Conn, conn net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	upstream.Close()
+	conn.Close()
+	<-done
+}
+
+func (p *ProxyContext) Handler() http.Handler {
+	return http.HandlerFunc(p.handle_connect)
+}
+
+func StartProxy(p *ProxyContext) {
+	fmt.Println(util.BLUE, "CTng proxy listening on", p.Addr, util.RESET)
+	server := &http.Server{Addr: p.Addr, Handler: p.Handler()}
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Println(util.RED, err, util.RESET)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jik18001/CTngV2/client"
+)
+
+// HTTPS forward proxy enforcing CTng with the databases of a client
+// go run main.go <Client_config.json> <Client_crypto_config.json> [block|annotate] [listen address]
+// The proxy listens on the loopback interface unless another listen address is given
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: go run main.go <Client_config.json> <Client_crypto_config.json> [block|annotate] [listen address]")
+		os.Exit(1)
+	}
+	ctx := &client.ClientContext{
+		Config_filepath: os.Args[1],
+		Crypto_filepath: os.Args[2],
+		Config:          &client.ClientConfig{},
+	}
+	ctx.InitializeClientContext()
+	client.LoadPoMdatabase(ctx)
+	mode := client.Proxy_block
+	if len(os.Args) > 3 {
+		switch os.Args[3] {
+		case "block":
+		case "annotate":
+			mode = client.Proxy_annotate
+		default:
+			fmt.Println("Unknown mode", os.Args[3])
+			os.Exit(1)
+		}
+	}
+	p := client.NewProxyContext(ctx, mode)
+	if len(os.Args) > 4 {
+		p.Addr = os.Args[4]
+	}
+	// the clients of the proxy must trust its local CA
+	if err := p.LoadCA(client.ProxyCAFile, client.ProxyCAKeyFile); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Certificate of the proxy CA in", client.ProxyCAFile)
+	// keep the databases of the client up to date while the proxy runs
+	go client.StartUpdater(ctx)
+	client.StartProxy(p)
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jik18001/CTngV2/crypto"
+)
+
+// CTng certificates are issued by CAs outside the system roots, the handshake hooks below replace
+// the X.509 chain check with the CA keys of the client crypto config, then run VerifyCTngextension
+
+var (
+	ErrNoPeerCertificate = errors.New("peer presented no certificate")
+	ErrUnknownIssuer     = errors.New("certificate issuer is not a known CA")
+	ErrBadIssuerSig      = errors.New("certificate is not signed by its issuer")
+	ErrCertExpired       = errors.New("certificate is expired or not yet valid")
+	ErrNoServerName      = errors.New("no server name to check the certificate against")
+)
+
+// CertificateError is returned from a handshake rejected by CTng verification
+type CertificateError struct {
+	Result *VerificationResult
+}
+
+func (e *CertificateError) Error() string {
+	return "CTng certificate verification failed: " + e.Result.String()
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Result.Err
+}
+
+// the leaf must be signed by the CA named as its issuer and be valid now
+func (ctx *ClientContext) checkIssuer(cert *x509.Certificate) error {
+	pub, ok := ctx.Crypto.SignPublicMap[crypto.CTngID(cert.Issuer.CommonName)]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownIssuer, cert.Issuer.CommonName)
+	}
+	issuer := &x509.Certificate{PublicKey: &pub}
+	if err := issuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadIssuerSig, err)
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return ErrCertExpired
+	}
+	return nil
+}
+
+// VerifyCertificate checks the issuer, the server name, the logger evidence and the CRV status of a leaf
+// A leaf is never accepted without a server name, any certificate of a known CA would match
+func (ctx *ClientContext) VerifyCertificate(cert *x509.Certificate, serverName string) error {
+	if serverName == "" {
+		return ErrNoServerName
+	}
+	if err := ctx.checkIssuer(cert); err != nil {
+		return err
+	}
+	if err := cert.VerifyHostname(serverName); err != nil {
+		return err
+	}
+	result := ctx.VerifyCTngextension(cert)
+	if !result.Valid {
+		return &CertificateError{Result: result}
+	}
+	return nil
+}
+
+// VerifyPeerCertificateFor returns a tls.Config.VerifyPeerCertificate hook bound to serverName,
+// the hook itself does not see the server name of the handshake
+func (ctx *ClientContext) VerifyPeerCertificateFor(serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrNoPeerCertificate
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		return ctx.VerifyCertificate(cert, serverName)
+	}
+}
+
+// VerifyConnection can be set as tls.Config.VerifyConnection, it also runs on resumed sessions
+// A client handshake only reports the server name it sent in SNI, which is empty for IP addresses,
+// so it fails for them, TLSConfig checks the ServerName of the config instead
+func (ctx *ClientContext) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrNoPeerCertificate
+	}
+	return ctx.VerifyCertificate(cs.PeerCertificates[0], cs.ServerName)
+}
+
+// TLSConfig returns a copy of base, or a new config, that enforces CTng on the server certificate
+// The certificate must name base.ServerName, or the server name sent in SNI if it is empty
+func (ctx *ClientContext) TLSConfig(base *tls.Config) *tls.Config {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	serverName := config.ServerName
+	// the chain is checked against the CA keys of the client in VerifyCertificate
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if serverName != "" {
+			cs.ServerName = serverName
+		}
+		return ctx.VerifyConnection(cs)
+	}
+	return config
+}
+
+// NewRoundTripper returns an http.RoundTripper that rejects servers without a valid CTng certificate
+//
+//	client := &http.Client{Transport: ctx.NewRoundTripper()}
+func (ctx *ClientContext) NewRoundTripper() http.RoundTripper {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	// connections through a proxy are made with TLSClientConfig
+	tr.TLSClientConfig = ctx.TLSConfig(nil)
+	tr.DialTLSContext = func(c context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &tls.Dialer{Config: ctx.TLSConfig(&tls.Config{ServerName: host})}
+		return dialer.DialContext(c, network, addr)
+	}
+	return tr
+}
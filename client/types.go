@@ -16,26 +16,36 @@ import (
 type ClientConfig struct {
 	Monitor_URLs []string
 	//This is the URL of the monitor where the client will get the information from
-	Client_URL           string
-	Port                 string
-	MMD                  int
-	MRD                  int
-	STH_Storage_filepath string
-	CRV_Storage_filepath string
-	PoM_Store_filepath   string
+	Client_URL              string
+	Port                    string
+	MMD                     int
+	MRD                     int
+	STH_Storage_filepath    string
+	CRV_Storage_filepath    string
+	PoM_Store_filepath      string
+	Min_benign_loggers      int // 0 keeps the default policy
+	Monitor_quorum          int // monitors that must agree on an update, 0 for a majority of Monitor_URLs
+	Monitor_faults_filepath string
 }
 
 type ClientContext struct {
 	Config              *ClientConfig
 	Crypto              *crypto.CryptoConfig
-	Current_Monitor_URL string
+	Current_Monitor_URL string              // protected by Monitor_lock, the updater changes it while requests are verified
+	Policy              *VerificationPolicy // nil uses DefaultVerificationPolicy
 	// the databases are shared resources and should be protected with mutex
-	STH_database  map[string]string         // key = entity_ID + @ + Period, content = RootHash
-	CRV_database  map[string]*bitset.BitSet // key = entity_ID, content = CRV
+	STH_database  map[string]string                // key = entity_ID + @ + Period, content = RootHash
+	CRV_database  map[string]*bitset.BitSet        // key = entity_ID, content = CRV
+	REV_database  map[string]definition.Revocation // key = entity_ID, content = last REV applied to the CRV, without its delta
 	POM_database  map[string]definition.Gossip_object
 	STH_DB_RWLock *sync.RWMutex
-	CRV_DB_RWLock *sync.RWMutex
+	CRV_DB_RWLock *sync.RWMutex // also protects REV_database
 	POM_DB_RWLock *sync.RWMutex
+	// monitors caught lying, they are no longer asked for updates
+	Monitor_faults map[string][]MonitorFault
+	Monitor_lock   *sync.Mutex // also protects Current_Monitor_URL
+	// period of the last update taken from the monitors
+	Last_update_period string
 	// Don't need lock for monitor integerity DB because it is only checked once per period
 	Config_filepath string
 	Crypto_filepath string
@@ -58,6 +68,15 @@ func SavePomDatabase(ctx *ClientContext) {
 	util.WriteData(ctx.Config.PoM_Store_filepath, ctx.POM_database)
 }
 
+func SaveMonitorFaults(ctx *ClientContext) {
+	if ctx.Config.Monitor_faults_filepath == "" {
+		return
+	}
+	ctx.Monitor_lock.Lock()
+	defer ctx.Monitor_lock.Unlock()
+	util.WriteData(ctx.Config.Monitor_faults_filepath, ctx.Monitor_faults)
+}
+
 func LoadSTHDatabase(ctx *ClientContext) {
 	databyte, err := util.ReadByte(ctx.Config.STH_Storage_filepath)
 	if err != nil {
@@ -88,6 +107,17 @@ func LoadCRVDatabase(ctx *ClientContext) {
 	}
 }
 
+func LoadMonitorFaults(ctx *ClientContext) {
+	databyte, err := util.ReadByte(ctx.Config.Monitor_faults_filepath)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(databyte, &ctx.Monitor_faults)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func LoadPoMdatabase(ctx *ClientContext) {
 	databyte, err := util.ReadByte(ctx.Config.PoM_Store_filepath)
 	if err != nil {
@@ -116,14 +146,18 @@ func (ctx *ClientContext) InitializeClientContext() {
 	util.LoadConfiguration(ctx.Config, ctx.Config_filepath)
 	CryptoConfig, err := crypto.ReadVerifyOnlyCryptoConfig(ctx.Crypto_filepath)
 	ctx.Crypto = CryptoConfig
+	ctx.Policy = &VerificationPolicy{Min_benign_loggers: ctx.Config.Min_benign_loggers}
 	// initialize the Locks for the databases
 	ctx.STH_DB_RWLock = &sync.RWMutex{}
 	ctx.CRV_DB_RWLock = &sync.RWMutex{}
 	ctx.POM_DB_RWLock = &sync.RWMutex{}
+	ctx.Monitor_lock = &sync.Mutex{}
 	// initialize the databases
 	ctx.STH_database = make(map[string]string)
 	ctx.CRV_database = make(map[string]*bitset.BitSet)
+	ctx.REV_database = make(map[string]definition.Revocation)
 	ctx.POM_database = make(map[string]definition.Gossip_object)
+	ctx.Monitor_faults = make(map[string][]MonitorFault)
 	// load the databases
 	if err != nil {
 		log.Fatal(err)
@@ -131,5 +165,6 @@ func (ctx *ClientContext) InitializeClientContext() {
 	if ctx.Status != "NEW" {
 		LoadSTHDatabase(ctx)
 		LoadCRVDatabase(ctx)
+		LoadMonitorFaults(ctx)
 	}
 }
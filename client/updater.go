@@ -0,0 +1,263 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/gossiper"
+	"github.com/jik18001/CTngV2/monitor"
+	"github.com/jik18001/CTngV2/util"
+)
+
+// The client takes its update of each period from every monitor it knows
+// Every object must carry a valid threshold signature, a monitor that serves an invalid object is recorded as faulty
+// and not asked again until the fault expires. Two valid versions of the same object are an equivocation of the
+// entity that signed them, not of the monitors serving them: the client records a conflict PoM against the entity.
+// Objects only some monitors serve are merged in, the other monitors may just be lagging
+
+var ErrNoQuorum = errors.New("not enough monitors agree on the update")
+
+// a monitor fault is forgotten after this many MMDs
+const MonitorFaultExpiry = 10
+
+type MonitorFault struct {
+	Monitor_URL string
+	Period      string
+	Reason      string
+	Timestamp   string
+}
+
+// the update of a period served by one monitor
+type MonitorUpdate struct {
+	Monitor_URL string
+	Update      monitor.ClientUpdate
+}
+
+// number of monitors that must agree on an update, a majority of the monitors of the config by default
+func (ctx *ClientContext) quorum() int {
+	if ctx.Config.Monitor_quorum > 0 {
+		return ctx.Config.Monitor_quorum
+	}
+	return len(ctx.Config.Monitor_URLs)/2 + 1
+}
+
+func (ctx *ClientContext) RecordMonitorFault(fault MonitorFault) {
+	fmt.Println(util.RED, "Monitor", fault.Monitor_URL, "is faulty in period", fault.Period+":", fault.Reason, util.RESET)
+	if fault.Timestamp == "" {
+		fault.Timestamp = util.GetCurrentTimestamp()
+	}
+	ctx.Monitor_lock.Lock()
+	defer ctx.Monitor_lock.Unlock()
+	ctx.Monitor_faults[fault.Monitor_URL] = append(ctx.Monitor_faults[fault.Monitor_URL], fault)
+}
+
+func (ctx *ClientContext) GetCurrentMonitor() string {
+	ctx.Monitor_lock.Lock()
+	defer ctx.Monitor_lock.Unlock()
+	return ctx.Current_Monitor_URL
+}
+
+func (ctx *ClientContext) SetCurrentMonitor(url string) {
+	ctx.Monitor_lock.Lock()
+	defer ctx.Monitor_lock.Unlock()
+	ctx.Current_Monitor_URL = url
+}
+
+// a monitor is faulty while one of its faults has not expired
+func (ctx *ClientContext) IsFaultyMonitor(url string) bool {
+	expiry := time.Duration(MonitorFaultExpiry*ctx.Config.MMD) * time.Second
+	ctx.Monitor_lock.Lock()
+	defer ctx.Monitor_lock.Unlock()
+	for _, fault := range ctx.Monitor_faults[url] {
+		t, err := time.Parse(time.RFC3339, fault.Timestamp)
+		if err == nil && time.Since(t) < expiry {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordEquivocation stores a conflict PoM against the entity that signed two versions of the same object
+func (ctx *ClientContext) RecordEquivocation(g1 definition.Gossip_object, g2 definition.Gossip_object) {
+	fmt.Println(util.RED, "Entity", g1.Payload[0], "signed two versions of", update_key(g1), util.RESET)
+	ctx.POM_DB_RWLock.Lock()
+	defer ctx.POM_DB_RWLock.Unlock()
+	if _, ok := ctx.POM_database[g1.Payload[0]]; !ok {
+		ctx.POM_database[g1.Payload[0]] = gossiper.Generate_CON_INIT(g1, g2)
+	}
+}
+
+// FetchUpdates gets the latest update of every monitor not known to be faulty, unreachable monitors are skipped
+func (ctx *ClientContext) FetchUpdates() []MonitorUpdate {
+	updates := []MonitorUpdate{}
+	for _, url := range ctx.Config.Monitor_URLs {
+		if ctx.IsFaultyMonitor(url) {
+			continue
+		}
+		update, err := FetchClientUpdate(monitor.PROTOCOL + url + "/monitor/get-update")
+		if err != nil {
+			fmt.Println("Monitor", url, "is unreachable:", err)
+			continue
+		}
+		updates = append(updates, MonitorUpdate{Monitor_URL: url, Update: update})
+	}
+	return updates
+}
+
+func update_objects(update monitor.ClientUpdate) []definition.Gossip_object {
+	objects := []definition.Gossip_object{}
+	objects = append(objects, update.STHs...)
+	objects = append(objects, update.REVs...)
+	objects = append(objects, update.POM_CONs...)
+	return append(objects, update.POM_ACCs...)
+}
+
+// an object of an update is named by its type, the entity it is about and its period
+func update_key(g definition.Gossip_object) string {
+	return g.Type + "|" + g.Payload[0] + "|" + g.Period
+}
+
+// two monitors serve the same version of an object if they serve the same content
+func update_version(g definition.Gossip_object) string {
+	return g.Payload[0] + "|" + g.Payload[1] + "|" + g.Payload[2]
+}
+
+// the period most of the updates are for, monitors lagging behind or ahead are not compared
+func round_period(updates []MonitorUpdate) string {
+	count := make(map[string]int)
+	period := ""
+	for _, u := range updates {
+		count[u.Update.Period]++
+		p, _ := strconv.Atoi(u.Update.Period)
+		best, _ := strconv.Atoi(period)
+		if count[u.Update.Period] > count[period] || (count[u.Update.Period] == count[period] && p > best) {
+			period = u.Update.Period
+		}
+	}
+	return period
+}
+
+// CrossCheckUpdates merges the valid objects of the updates of the monitors into one update
+// It records the monitors serving invalid objects and the entities signing conflicting objects,
+// and returns ErrNoQuorum if fewer monitors than the quorum serve a valid update for the same period
+func (ctx *ClientContext) CrossCheckUpdates(updates []MonitorUpdate) (monitor.ClientUpdate, error) {
+	// an object without a valid threshold signature can only come from the monitor
+	valid := []MonitorUpdate{}
+	for _, u := range updates {
+		var err error
+		for _, g := range update_objects(u.Update) {
+			if err = g.Verify(ctx.Crypto); err != nil {
+				ctx.RecordMonitorFault(MonitorFault{Monitor_URL: u.Monitor_URL, Period: u.Update.Period, Reason: "invalid " + update_key(g) + ": " + err.Error()})
+				break
+			}
+		}
+		if err == nil {
+			valid = append(valid, u)
+		}
+	}
+	period := round_period(valid)
+	current := []MonitorUpdate{}
+	for _, u := range valid {
+		if u.Update.Period == period {
+			current = append(current, u)
+		}
+	}
+	if len(current) < ctx.quorum() {
+		return monitor.ClientUpdate{}, fmt.Errorf("%w: %d of %d required", ErrNoQuorum, len(current), ctx.quorum())
+	}
+	// versions of each object, and the number of objects each monitor serves
+	keys := []string{}
+	versions := make(map[string]map[string]definition.Gossip_object)
+	served := make(map[string]int)
+	for _, u := range current {
+		for _, g := range update_objects(u.Update) {
+			key := update_key(g)
+			if _, ok := versions[key]; !ok {
+				keys = append(keys, key)
+				versions[key] = make(map[string]definition.Gossip_object)
+			}
+			versions[key][update_version(g)] = g
+			served[u.Monitor_URL]++
+		}
+	}
+	merged := monitor.ClientUpdate{Period: period}
+	for _, key := range keys {
+		objects := []definition.Gossip_object{}
+		for _, g := range versions[key] {
+			objects = append(objects, g)
+		}
+		switch objects[0].Type {
+		case definition.STH_FULL, definition.REV_FULL:
+			if len(objects) > 1 {
+				// both versions carry a valid threshold signature, the entity signed both
+				ctx.RecordEquivocation(objects[0], objects[1])
+				continue
+			}
+			if objects[0].Type == definition.STH_FULL {
+				merged.STHs = append(merged.STHs, objects[0])
+			} else {
+				merged.REVs = append(merged.REVs, objects[0])
+			}
+		case definition.ACC_FULL:
+			// PoMs are not signed by the entity they are about, each version is evidence
+			merged.POM_ACCs = append(merged.POM_ACCs, objects...)
+		default:
+			merged.POM_CONs = append(merged.POM_CONs, objects...)
+		}
+	}
+	// missing REVs are asked from the monitor that serves the most objects
+	best := current[0].Monitor_URL
+	for _, u := range current {
+		if served[u.Monitor_URL] > served[best] {
+			best = u.Monitor_URL
+		}
+	}
+	ctx.SetCurrentMonitor(best)
+	merged.MonitorID = best
+	return merged, nil
+}
+
+// UpdateFromMonitors fetches the update of the period from the monitors, cross-checks them and applies the result
+func (ctx *ClientContext) UpdateFromMonitors() error {
+	merged, err := ctx.CrossCheckUpdates(ctx.FetchUpdates())
+	if err != nil {
+		return err
+	}
+	if merged.Period == ctx.Last_update_period {
+		// the monitors have not saved the update of the next period yet
+		return nil
+	}
+	if !ctx.HandleUpdate(merged, true, false) {
+		return fmt.Errorf("update of period %s rejected", merged.Period)
+	}
+	ctx.Last_update_period = merged.Period
+	return nil
+}
+
+func PeriodicTasks(ctx *ClientContext) {
+	// queue the next update first, so it runs one MMD later whatever this one takes
+	f := func() {
+		PeriodicTasks(ctx)
+	}
+	time.AfterFunc(time.Duration(ctx.Config.MMD)*time.Second, f)
+	err := ctx.UpdateFromMonitors()
+	if err != nil {
+		fmt.Println(util.RED, "Client update failed:", err, util.RESET)
+		return
+	}
+	SaveSTHDatabase(ctx)
+	SaveCRVDatabase(ctx)
+	SavePomDatabase(ctx)
+	SaveMonitorFaults(ctx)
+}
+
+// StartUpdater updates the client from its monitors once per MMD, the monitors save their updates 20 seconds before the end of the MMD
+func StartUpdater(ctx *ClientContext) {
+	time_wait := util.Getwaitingtime(ctx.Config.MMD)
+	fmt.Println("Waiting for ", time_wait, " seconds")
+	time.Sleep(time.Duration(time_wait) * time.Second)
+	PeriodicTasks(ctx)
+}
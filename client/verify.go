@@ -0,0 +1,218 @@
+package client
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jik18001/CTngV2/CA"
+	"github.com/jik18001/CTngV2/crypto"
+	"github.com/jik18001/CTngV2/definition"
+)
+
+// outcome of the check of one logger named in the CTng extension of a certificate
+type LoggerOutcome int
+
+const (
+	LoggerBenign       LoggerOutcome = iota
+	LoggerBlacklisted                // the client holds a PoM against the logger
+	LoggerSTHInvalid                 // the threshold signature of the STH does not verify
+	LoggerSTHMalformed               // the tree information in the STH cannot be read
+	LoggerSTHMismatch                // the root hash differs from the STH the monitor gave the client
+	LoggerPOIInvalid                 // the certificate is not in the tree of the STH
+)
+
+func (o LoggerOutcome) String() string {
+	switch o {
+	case LoggerBenign:
+		return "benign"
+	case LoggerBlacklisted:
+		return "blacklisted"
+	case LoggerSTHInvalid:
+		return "STH signature invalid"
+	case LoggerSTHMalformed:
+		return "STH malformed"
+	case LoggerSTHMismatch:
+		return "STH mismatch"
+	case LoggerPOIInvalid:
+		return "POI invalid"
+	}
+	return fmt.Sprintf("LoggerOutcome(%d)", int(o))
+}
+
+// revocation status of a certificate in the CRV of its CA
+type RevocationStatus int
+
+const (
+	RevocationUnchecked  RevocationStatus = iota // the logger information failed first
+	RevocationNotCovered                         // the client has no CRV of the CA, or it is shorter than the RID
+	RevocationGood
+	RevocationRevoked
+)
+
+func (s RevocationStatus) String() string {
+	switch s {
+	case RevocationUnchecked:
+		return "unchecked"
+	case RevocationNotCovered:
+		return "not covered"
+	case RevocationGood:
+		return "not revoked"
+	case RevocationRevoked:
+		return "revoked"
+	}
+	return fmt.Sprintf("RevocationStatus(%d)", int(s))
+}
+
+var (
+	ErrTooFewBenignLoggers = errors.New("too few benign loggers")
+	ErrRIDNotCovered       = errors.New("certificate RID is not covered by the CRV of its CA")
+	ErrCertRevoked         = errors.New("certificate has been revoked")
+)
+
+type LoggerResult struct {
+	LoggerID string
+	Period   string // period of the STH in the certificate
+	Outcome  LoggerOutcome
+}
+
+// VerificationResult tells why a certificate was accepted or rejected
+// Err is nil if and only if Valid, it wraps the CA extension errors or one of the errors above
+type VerificationResult struct {
+	Valid      bool
+	Err        error
+	CAID       string
+	RID        int
+	Loggers    []LoggerResult
+	Benign     int
+	Revocation RevocationStatus
+	CRV_period string // period of the last REV applied to the CRV consulted, empty if the client has no REV of the CA
+}
+
+// Periods returns the periods consulted: those of the logger STHs, then that of the CRV
+func (r *VerificationResult) Periods() []string {
+	periods := []string{}
+	seen := make(map[string]bool)
+	for _, logger := range r.Loggers {
+		if !seen[logger.Period] {
+			seen[logger.Period] = true
+			periods = append(periods, logger.Period)
+		}
+	}
+	if r.CRV_period != "" && !seen[r.CRV_period] {
+		periods = append(periods, r.CRV_period)
+	}
+	return periods
+}
+
+func (r *VerificationResult) String() string {
+	str := fmt.Sprintf("valid: %v, RID: %d, benign loggers: %d/%d, revocation: %v", r.Valid, r.RID, r.Benign, len(r.Loggers), r.Revocation)
+	for _, logger := range r.Loggers {
+		if logger.Outcome != LoggerBenign {
+			str += fmt.Sprintf(", %s@%s: %v", logger.LoggerID, logger.Period, logger.Outcome)
+		}
+	}
+	if r.Err != nil {
+		str += ", error: " + r.Err.Error()
+	}
+	return str
+}
+
+func (r *VerificationResult) fail(err error) *VerificationResult {
+	r.Valid = false
+	r.Err = err
+	return r
+}
+
+// VerificationPolicy decides how many loggers of a certificate must be benign
+type VerificationPolicy struct {
+	Min_benign_loggers int
+}
+
+var DefaultVerificationPolicy = VerificationPolicy{Min_benign_loggers: 1}
+
+func (ctx *ClientContext) policy() VerificationPolicy {
+	if ctx.Policy == nil || ctx.Policy.Min_benign_loggers < 1 {
+		return DefaultVerificationPolicy
+	}
+	return *ctx.Policy
+}
+
+// check one logger of the certificate against the databases of the client
+func (ctx *ClientContext) verifyLogger(loggerinfo CA.LoggerInfo, cert *x509.Certificate) LoggerOutcome {
+	ctx.POM_DB_RWLock.RLock()
+	_, blacklisted := ctx.POM_database[loggerinfo.STH.Signer]
+	ctx.POM_DB_RWLock.RUnlock()
+	if blacklisted {
+		return LoggerBlacklisted
+	}
+	if err := loggerinfo.STH.Verify(ctx.Crypto); err != nil {
+		return LoggerSTHInvalid
+	}
+	var treeinfo definition.STH
+	decoded, _ := hex.DecodeString(loggerinfo.STH.Payload[1])
+	if err := json.Unmarshal(decoded, &treeinfo); err != nil {
+		return LoggerSTHMalformed
+	}
+	ctx.STH_DB_RWLock.RLock()
+	roothash, ok := ctx.STH_database[loggerinfo.STH.Payload[0]+"@"+loggerinfo.STH.Period]
+	ctx.STH_DB_RWLock.RUnlock()
+	if !ok || roothash != treeinfo.RootHash {
+		return LoggerSTHMismatch
+	}
+	roothashbyte, _ := hex.DecodeString(roothash)
+	pass, err := crypto.VerifyPOI(roothashbyte, loggerinfo.POI.Poi, *cert)
+	if !pass || err != nil {
+		return LoggerPOIInvalid
+	}
+	return LoggerBenign
+}
+
+// VerifyCTngextension checks the logger information of a certificate under the policy of the client,
+// then looks the RID up in the CRV of the CA
+func (ctx *ClientContext) VerifyCTngextension(cert *x509.Certificate) *VerificationResult {
+	result := &VerificationResult{CAID: cert.Issuer.CommonName, Loggers: []LoggerResult{}}
+	CTngext, err := CA.ExtractCTngExtension(cert)
+	if err != nil {
+		return result.fail(err)
+	}
+	result.RID = CTngext.SequenceNumber.RID
+	err = CA.ValidateLoggerInformation(CTngext, ctx.KnownLogger)
+	if err != nil {
+		return result.fail(err)
+	}
+	for _, loggerinfo := range CTngext.LoggerInformation {
+		outcome := ctx.verifyLogger(loggerinfo, cert)
+		if outcome == LoggerBenign {
+			result.Benign++
+		}
+		result.Loggers = append(result.Loggers, LoggerResult{
+			LoggerID: loggerinfo.STH.Payload[0],
+			Period:   loggerinfo.STH.Period,
+			Outcome:  outcome,
+		})
+	}
+	policy := ctx.policy()
+	if result.Benign < policy.Min_benign_loggers {
+		return result.fail(fmt.Errorf("%w: %d of %d, %d required", ErrTooFewBenignLoggers, result.Benign, len(result.Loggers), policy.Min_benign_loggers))
+	}
+
+	ctx.CRV_DB_RWLock.RLock()
+	defer ctx.CRV_DB_RWLock.RUnlock()
+	result.CRV_period = ctx.REV_database[result.CAID].Period
+	CRV_to_check := ctx.CRV_database[result.CAID]
+	if CRV_to_check == nil || uint(result.RID) >= CRV_to_check.Len() {
+		// a CRV that does not cover the RID cannot show the certificate is not revoked
+		result.Revocation = RevocationNotCovered
+		return result.fail(ErrRIDNotCovered)
+	}
+	if CRV_to_check.Test(uint(result.RID)) {
+		result.Revocation = RevocationRevoked
+		return result.fail(ErrCertRevoked)
+	}
+	result.Revocation = RevocationGood
+	result.Valid = true
+	return result
+}
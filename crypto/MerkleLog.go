@@ -0,0 +1,253 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+
+	merkletree "github.com/txaty/go-merkletree"
+)
+
+// MerkleLog is an append-only Merkle tree shaped and hashed as in RFC 6962
+// (leaf = sha256(0x00||Serialize()), node = sha256(0x01||left||right)), so a node can not be passed off as a leaf.
+// Inclusion proofs use the merkletree.Proof layout and are checked with VerifyPOI.
+type MerkleLog struct {
+	// levels[L][i] is the root of the complete subtree covering leaves [i*2^L, (i+1)*2^L)
+	levels [][][]byte
+}
+
+func NewMerkleLog() *MerkleLog {
+	return &MerkleLog{levels: [][][]byte{{}}}
+}
+
+// domain separation prefixes of RFC 6962
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// HashLeaf returns the hash of the leaf holding data
+func HashLeaf(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hashChildren(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// largest power of two strictly smaller than n (n > 1)
+func splitPoint(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+// Append adds a block to the log and returns its leaf index
+func (l *MerkleLog) Append(block merkletree.DataBlock) (int, error) {
+	data, err := block.Serialize()
+	if err != nil {
+		return 0, err
+	}
+	l.AppendLeafHash(HashLeaf(data))
+	return l.Size() - 1, nil
+}
+
+// AppendLeafHash adds an already hashed leaf to the log
+func (l *MerkleLog) AppendLeafHash(leaf []byte) {
+	node := make([]byte, len(leaf))
+	copy(node, leaf)
+	l.levels[0] = append(l.levels[0], node)
+	// complete every subtree closed by the new leaf, like a binary counter carry
+	for level := 0; len(l.levels[level])%2 == 0; level++ {
+		if len(l.levels) == level+1 {
+			l.levels = append(l.levels, [][]byte{})
+		}
+		n := len(l.levels[level])
+		l.levels[level+1] = append(l.levels[level+1], hashChildren(l.levels[level][n-2], l.levels[level][n-1]))
+	}
+}
+
+func (l *MerkleLog) Size() int {
+	return len(l.levels[0])
+}
+
+// LeafHash returns the hash of the leaf at index
+func (l *MerkleLog) LeafHash(index int) ([]byte, error) {
+	if index < 0 || index >= l.Size() {
+		return nil, errors.New("leaf index out of range")
+	}
+	return l.levels[0][index], nil
+}
+
+// Copy returns an independent copy of the log
+func (l *MerkleLog) Copy() *MerkleLog {
+	levels := make([][][]byte, len(l.levels))
+	for i := range l.levels {
+		levels[i] = append([][]byte{}, l.levels[i]...)
+	}
+	return &MerkleLog{levels: levels}
+}
+
+// subtreeHash computes MTH(D[start:start+n])
+func (l *MerkleLog) subtreeHash(start int, n int) []byte {
+	if n&(n-1) == 0 && start%n == 0 {
+		level := bits.TrailingZeros(uint(n))
+		return l.levels[level][start/n]
+	}
+	k := splitPoint(n)
+	return hashChildren(l.subtreeHash(start, k), l.subtreeHash(start+k, n-k))
+}
+
+func (l *MerkleLog) RootHash() []byte {
+	root, _ := l.RootHashAt(l.Size())
+	return root
+}
+
+// RootHashAt returns the root of the tree made of the first size entries
+func (l *MerkleLog) RootHashAt(size int) ([]byte, error) {
+	if size < 0 || size > l.Size() {
+		return nil, errors.New("tree size out of range")
+	}
+	if size == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:], nil
+	}
+	return l.subtreeHash(0, size), nil
+}
+
+// InclusionProof returns the audit path of the leaf at index in the tree of the first size entries
+func (l *MerkleLog) InclusionProof(index int, size int) (*merkletree.Proof, error) {
+	if size < 1 || size > l.Size() {
+		return nil, errors.New("tree size out of range")
+	}
+	if index < 0 || index >= size {
+		return nil, errors.New("leaf index out of range")
+	}
+	proof := &merkletree.Proof{Siblings: [][]byte{}}
+	l.auditPath(index, 0, size, proof)
+	return proof, nil
+}
+
+// auditPath implements PATH(m, D[start:start+n]) from RFC 6962, siblings are ordered from the leaf up
+func (l *MerkleLog) auditPath(m int, start int, n int, proof *merkletree.Proof) {
+	if n == 1 {
+		return
+	}
+	k := splitPoint(n)
+	if m < k {
+		l.auditPath(m, start, k, proof)
+		// our node is the left child
+		proof.Path |= 1 << len(proof.Siblings)
+		proof.Siblings = append(proof.Siblings, l.subtreeHash(start+k, n-k))
+	} else {
+		l.auditPath(m-k, start+k, n-k, proof)
+		proof.Siblings = append(proof.Siblings, l.subtreeHash(start, k))
+	}
+}
+
+// VerifyInclusion checks that leaf is in the tree of the given root, siblings are ordered from the leaf up
+// and bit i of proof.Path is set when the node at height i is a left child
+func VerifyInclusion(root []byte, leaf []byte, proof *merkletree.Proof) bool {
+	if proof == nil || len(proof.Siblings) > 64 {
+		return false
+	}
+	node := leaf
+	for i, sibling := range proof.Siblings {
+		if proof.Path&(1<<i) != 0 {
+			node = hashChildren(node, sibling)
+		} else {
+			node = hashChildren(sibling, node)
+		}
+	}
+	return bytes.Equal(node, root)
+}
+
+// ConsistencyProof returns the RFC 6962 proof that the tree of the first entries is a prefix of the tree of the second entries
+func (l *MerkleLog) ConsistencyProof(first int, second int) ([][]byte, error) {
+	if first < 0 || first > second || second > l.Size() {
+		return nil, errors.New("tree sizes out of range")
+	}
+	proof := [][]byte{}
+	if first == 0 || first == second {
+		return proof, nil
+	}
+	return l.subProof(first, 0, second, true, proof), nil
+}
+
+// subProof implements SUBPROOF(m, D[start:start+n], b) from RFC 6962
+func (l *MerkleLog) subProof(m int, start int, n int, b bool, proof [][]byte) [][]byte {
+	if m == n {
+		if b {
+			return proof
+		}
+		return append(proof, l.subtreeHash(start, n))
+	}
+	k := splitPoint(n)
+	if m <= k {
+		proof = l.subProof(m, start, k, b, proof)
+		return append(proof, l.subtreeHash(start+k, n-k))
+	}
+	proof = l.subProof(m-k, start+k, n-k, false, proof)
+	return append(proof, l.subtreeHash(start, k))
+}
+
+// VerifyConsistency checks a consistency proof between two roots, following RFC 9162 section 2.1.4.2
+func VerifyConsistency(first int, second int, firstRoot []byte, secondRoot []byte, proof [][]byte) error {
+	if first < 0 || first > second {
+		return errors.New("invalid tree sizes")
+	}
+	if first == second {
+		if len(proof) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return errors.New("roots of the same tree size differ")
+		}
+		return nil
+	}
+	if first == 0 {
+		if len(proof) != 0 {
+			return errors.New("non-empty proof for an empty tree")
+		}
+		return nil
+	}
+	if len(proof) == 0 {
+		return errors.New("empty consistency proof")
+	}
+	// if the first tree is complete, its root is the first node of the path
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	fn := first - 1
+	sn := second - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr := proof[0]
+	sr := proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errors.New("consistency proof too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = hashChildren(c, fr)
+			sr = hashChildren(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = hashChildren(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return errors.New("consistency proof does not match the roots")
+	}
+	return nil
+}
@@ -2,6 +2,10 @@ package crypto
 
 import (
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
 	"strconv"
 
 	merkletree "github.com/txaty/go-merkletree"
@@ -11,18 +15,120 @@ type Certblock struct {
 	Content x509.Certificate
 }
 
+// OID of the CTng extension, shared with the CA package
+var OIDCTngExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 67847871}
+
+// The leaf is the precert TBS with the CTng extension normalised,
+// so the final certificate hashes to the same leaf as the precert the logger logged
 func (c *Certblock) Serialize() ([]byte, error) {
-	//This is an oversimplification of the serialization process for just demonstration purposes
-	// In reality, the serialization process is much more complicated
-	// in CTng extension, we need to extract the TBS certificate and serialize it
-	// However the CA will sign the whole certificate with the CTng extension, which means the TBS certificate field the CA signed is not the same as the TBS certificate field the logger logged
-	return c.Content.RawSubject, nil
+	return PrecertLeafData(&c.Content)
 }
 
-/*
-func (c *Certblock) Serialize() ([]byte, error) {
-	return c.Content.Raw, nil
-}*/
+// PrecertLeafData returns the canonical leaf encoding of a precert or of the final certificate
+func PrecertLeafData(cert *x509.Certificate) ([]byte, error) {
+	if len(cert.RawTBSCertificate) == 0 {
+		return nil, errors.New("certificate has no TBS encoding")
+	}
+	var tbs asn1.RawValue
+	rest, err := asn1.Unmarshal(cert.RawTBSCertificate, &tbs)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("malformed TBS certificate")
+	}
+	fields := []asn1.RawValue{}
+	for inner := tbs.Bytes; len(inner) > 0; {
+		var field asn1.RawValue
+		inner, err = asn1.Unmarshal(inner, &field)
+		if err != nil {
+			return nil, errors.New("malformed TBS certificate field")
+		}
+		// extensions are the [3] EXPLICIT field
+		if field.Class == asn1.ClassContextSpecific && field.Tag == 3 {
+			field, err = normalizeExtensions(field)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, field)
+	}
+	var content []byte
+	for _, field := range fields {
+		content = append(content, field.FullBytes...)
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: content})
+}
+
+// PrecertLeafHash returns the Merkle leaf of a precert
+func PrecertLeafHash(cert *x509.Certificate) ([]byte, error) {
+	data, err := PrecertLeafData(cert)
+	if err != nil {
+		return nil, err
+	}
+	return HashLeaf(data), nil
+}
+
+func normalizeExtensions(field asn1.RawValue) (asn1.RawValue, error) {
+	var exts []pkix.Extension
+	if _, err := asn1.Unmarshal(field.Bytes, &exts); err != nil {
+		return field, errors.New("malformed certificate extensions")
+	}
+	for i, ext := range exts {
+		if ext.Id.Equal(OIDCTngExtension) {
+			value, err := normalizeCTngExtension(ext.Value)
+			if err != nil {
+				return field, err
+			}
+			exts[i].Value = value
+		}
+	}
+	inner, err := asn1.Marshal(exts)
+	if err != nil {
+		return field, err
+	}
+	full, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: inner})
+	if err != nil {
+		return field, err
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: inner, FullBytes: full}, nil
+}
+
+// DER form of the CTng extension with its fields left encoded, see CA/extension.go for the ASN.1 module
+type ctngExtensionFields struct {
+	Version           int
+	SequenceNumber    asn1.RawValue
+	LoggerInformation asn1.RawValue
+}
+
+// drop the logger information, which the CA only adds after the precert is logged
+// The extension is DER, or JSON in an OCTET STRING for certificates issued before the DER form
+func normalizeCTngExtension(value []byte) ([]byte, error) {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(value, &raw); err != nil {
+		return nil, errors.New("malformed CTng extension")
+	}
+	if raw.Class == asn1.ClassUniversal && raw.Tag == asn1.TagSequence {
+		var fields ctngExtensionFields
+		rest, err := asn1.Unmarshal(value, &fields)
+		if err != nil || len(rest) != 0 {
+			return nil, errors.New("malformed CTng extension")
+		}
+		fields.LoggerInformation = asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true}
+		return asn1.Marshal(fields)
+	}
+	var octets []byte
+	if _, err := asn1.Unmarshal(value, &octets); err != nil {
+		return nil, errors.New("malformed CTng extension")
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(octets, &fields); err != nil {
+		return nil, errors.New("malformed CTng extension")
+	}
+	delete(fields, "LoggerInformation")
+	normalized, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(normalized)
+}
 
 type POI_for_transmission struct {
 	Poi          *merkletree.Proof `json:"poi,omitempty"`
@@ -35,9 +141,15 @@ func Generatedummycertlist(size int) (certs []x509.Certificate) {
 	certs = make([]x509.Certificate, 0)
 	for i := 0; i < size; i++ {
 		subjectKeyIdBytes := []byte(strconv.Itoa(i))
+		// a stand-in TBS, the leaf is computed over it
+		tbs, _ := asn1.Marshal(struct {
+			Version      int
+			SubjectKeyId []byte
+		}{i, subjectKeyIdBytes})
 		certs = append(certs, x509.Certificate{
-			Version:      i,
-			SubjectKeyId: subjectKeyIdBytes,
+			Version:           i,
+			SubjectKeyId:      subjectKeyIdBytes,
+			RawTBSCertificate: tbs,
 		})
 	}
 	return
@@ -52,8 +164,19 @@ func GenerateDataBlocks(certs []x509.Certificate) (dataBlocks []merkletree.DataB
 	return
 }
 
+// the tree is built as a MerkleLog, so its root and proofs match the logger's
 func GenerateMerkleTree(blocks []merkletree.DataBlock) (tree *merkletree.MerkleTree, error error) {
-	tree, error = merkletree.New(nil, blocks)
+	log := NewMerkleLog()
+	for _, block := range blocks {
+		if _, error = log.Append(block); error != nil {
+			return nil, error
+		}
+	}
+	tree = &merkletree.MerkleTree{Root: log.RootHash(), NumLeaves: log.Size()}
+	for i := 0; i < log.Size(); i++ {
+		proof, _ := log.InclusionProof(i, log.Size())
+		tree.Proofs = append(tree.Proofs, proof)
+	}
 	return
 }
 
@@ -67,6 +190,12 @@ func GeneratePOI(tree *merkletree.MerkleTree) (proofs []*merkletree.Proof) {
 }
 
 func VerifyPOI(rootHash []byte, poi *merkletree.Proof, cert x509.Certificate) (ok bool, err error) {
-	ok, err = merkletree.Verify(&Certblock{Content: cert}, poi, rootHash, nil)
-	return
+	if poi == nil {
+		return false, errors.New("proof is nil")
+	}
+	leaf, err := PrecertLeafHash(&cert)
+	if err != nil {
+		return false, err
+	}
+	return VerifyInclusion(rootHash, leaf, poi), nil
 }
@@ -1,6 +1,8 @@
 package crypto
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"math/rand" // for list shuffling
@@ -305,3 +307,101 @@ func TestMerkleTree(t *testing.T) {
 		fmt.Println(ok)
 	}
 }
+
+func TestMerkleLog(t *testing.T) {
+	certs := Generatedummycertlist(9)
+	log := NewMerkleLog()
+	for i := range certs {
+		log.Append(&Certblock{Content: certs[i]})
+		size := log.Size()
+		for j := 0; j < size; j++ {
+			proof, err := log.InclusionProof(j, size)
+			confirmNil(t, err)
+			root, _ := log.RootHashAt(size)
+			ok, err := VerifyPOI(root, proof, certs[j])
+			if !ok || err != nil {
+				t.Errorf("inclusion proof of leaf %d in tree of size %d failed", j, size)
+			}
+			// an earlier root must not verify once the tree has grown
+			if size > 1 {
+				oldroot, _ := log.RootHashAt(size - 1)
+				if ok, _ := VerifyPOI(oldroot, proof, certs[j]); ok {
+					t.Errorf("proof of leaf %d verified against an old root", j)
+				}
+			}
+		}
+	}
+	// the root of 8 leaves matches the one computed as in section 2.1 of RFC 6962
+	leaves := [][]byte{}
+	for _, cert := range certs[:8] {
+		data, err := PrecertLeafData(&cert)
+		confirmNil(t, err)
+		leaves = append(leaves, rfc6962_hash(append([]byte{0}, data...)))
+	}
+	root, _ := log.RootHashAt(8)
+	if hex.EncodeToString(root) != hex.EncodeToString(rfc6962_root(leaves)) {
+		t.Errorf("root of 8 leaves does not match the RFC 6962 root")
+	}
+	// test vector of the reference implementation of RFC 6962
+	vector := NewMerkleLog()
+	for _, data := range []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"} {
+		raw, _ := hex.DecodeString(data)
+		vector.AppendLeafHash(HashLeaf(raw))
+	}
+	if hex.EncodeToString(vector.RootHash()) != "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328" {
+		t.Errorf("root of the RFC 6962 test vector is %x", vector.RootHash())
+	}
+	// the two children of a node, presented as a leaf, do not hash to the node
+	left, _ := log.LeafHash(0)
+	right, _ := log.LeafHash(1)
+	root2, _ := log.RootHashAt(2)
+	if hex.EncodeToString(HashLeaf(append(append([]byte{}, left...), right...))) == hex.EncodeToString(root2) {
+		t.Errorf("interior node hashes like a leaf")
+	}
+	if _, err := PrecertLeafData(&x509.Certificate{RawSubject: []byte("subject")}); err == nil {
+		t.Errorf("leaf computed for a certificate without TBS")
+	}
+}
+
+func rfc6962_hash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// MTH of RFC 6962 over already hashed leaves
+func rfc6962_root(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	node := append([]byte{1}, rfc6962_root(leaves[:k])...)
+	return rfc6962_hash(append(node, rfc6962_root(leaves[k:])...))
+}
+
+func TestMerkleLogConsistency(t *testing.T) {
+	log := NewMerkleLog()
+	roots := [][]byte{}
+	for i := 0; i < 20; i++ {
+		roots = append(roots, log.RootHash())
+		log.AppendLeafHash([]byte{byte(i)})
+	}
+	roots = append(roots, log.RootHash())
+	for first := 0; first <= 20; first++ {
+		for second := first; second <= 20; second++ {
+			proof, err := log.ConsistencyProof(first, second)
+			confirmNil(t, err)
+			if err := VerifyConsistency(first, second, roots[first], roots[second], proof); err != nil {
+				t.Errorf("consistency %d -> %d: %s", first, second, err.Error())
+			}
+			// a forked first tree must be rejected
+			if first > 0 && first < second {
+				if VerifyConsistency(first, second, roots[first-1], roots[second], proof) == nil {
+					t.Errorf("forked root accepted for %d -> %d", first, second)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package definition
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/jik18001/CTngV2/crypto"
+)
+
+// size of the CRV of a CA that does not configure one
+const DefaultCRVSize = 1000000
+
+// CanonicalCRV returns a copy of the CRV encoded at exactly size bits
+// It fails if a bit at or beyond size is set, which means the CRV was truncated
+func CanonicalCRV(crv *bitset.BitSet, size uint) (*bitset.BitSet, error) {
+	if size == 0 {
+		return nil, errors.New("CRV size must be positive")
+	}
+	if pos, found := crv.NextSet(size); found {
+		return nil, fmt.Errorf("bit %d is beyond the CRV size %d", pos, size)
+	}
+	trimmed := crv.Clone()
+	if trimmed.Len() > size {
+		trimmed.Shrink(size - 1)
+	}
+	canonical := bitset.New(size)
+	canonical.InPlaceUnion(trimmed)
+	return canonical, nil
+}
+
+// a REV does not follow the last REV a verifier applied for its CA, the REVs in between are missing
+var ErrREVGap = errors.New("REV does not follow the last REV of the CA, some deltas are missing")
+
+// a REV for a period the verifier already went past
+var ErrREVStale = errors.New("REV is not newer than the last REV of the CA")
+
+// SRH_hash is the message a CA signs in an SRH that commits to the size of its CRV:
+// H(Period || H(CRV) || H(delta CRV) || size || prev period || prev SRH), both CRVs encoded at size bits
+// the link to the previous REV is left out for the first REV of a CA
+func SRH_hash(period string, crv *bitset.BitSet, delta *bitset.BitSet, size uint, prev_period string, prev_srh string) ([]byte, error) {
+	crv, err := CanonicalCRV(crv, size)
+	if err != nil {
+		return nil, err
+	}
+	delta, err = CanonicalCRV(delta, size)
+	if err != nil {
+		return nil, err
+	}
+	crv_bytes, _ := crv.MarshalBinary()
+	delta_bytes, _ := delta.MarshalBinary()
+	crv_hash, _ := crypto.GenerateSHA256(crv_bytes)
+	delta_hash, _ := crypto.GenerateSHA256(delta_bytes)
+	msg := period + string(crv_hash) + string(delta_hash) + strconv.FormatUint(uint64(size), 10)
+	if prev_srh != "" {
+		msg += prev_period + prev_srh
+	}
+	return crypto.GenerateSHA256([]byte(msg))
+}
+
+// SRH_chain is the value the next REV of a CA carries in Prev_SRH
+func SRH_chain(srh string) string {
+	hash, _ := crypto.GenerateSHA256([]byte(srh))
+	return hex.EncodeToString(hash)
+}
+
+// CheckREVChain checks that rev directly follows last, the last REV a verifier applied for the CA
+// last is nil if the verifier has no REV of the CA, it can then only start at the first REV of the CA
+// Periods wrap every hour, so the REVs are ordered by their links and their sequence numbers, never by period
+// REVs without a committed CRV size predate the chain and are not checked
+func CheckREVChain(last *Revocation, rev Revocation) error {
+	if rev.Size == 0 {
+		return nil
+	}
+	if last == nil {
+		if rev.Prev_SRH != "" {
+			return ErrREVGap
+		}
+		return nil
+	}
+	// the REV already applied, or the one it follows
+	if rev.SRH == last.SRH || (last.Prev_SRH != "" && last.Prev_SRH == SRH_chain(rev.SRH)) {
+		return ErrREVStale
+	}
+	numbered := rev.Sequence != 0 && last.Sequence != 0
+	if numbered && rev.Sequence <= last.Sequence {
+		return ErrREVStale
+	}
+	if rev.Prev_period != last.Period || rev.Prev_SRH != SRH_chain(last.SRH) {
+		return ErrREVGap
+	}
+	if numbered && rev.Sequence != last.Sequence+1 {
+		return fmt.Errorf("REV %d follows REV %d of the CA", rev.Sequence, last.Sequence)
+	}
+	return nil
+}
+
+// ApplyDeltaCRV returns the CRV after the delta, old may be nil if no CRV is known yet
+// A size of 0 is a REV that does not commit to a size, its delta is just merged into the CRV
+// Deltas of a smaller CRV still apply, but a known revocation beyond size means the CRV was truncated
+func ApplyDeltaCRV(old *bitset.BitSet, delta *bitset.BitSet, size uint) (*bitset.BitSet, error) {
+	updated := delta.Clone()
+	if old != nil {
+		updated.InPlaceUnion(old)
+	}
+	if size == 0 {
+		return updated, nil
+	}
+	return CanonicalCRV(updated, size)
+}
+
+// Checkpoint_hash is the message a CA signs in a checkpoint: H("CKP" || Period || H(CRV) || size || SRH), the CRV encoded at size bits
+// H(CRV) is the same CRV hash the SRH of that period commits to
+func Checkpoint_hash(period string, crv *bitset.BitSet, size uint, srh string) ([]byte, error) {
+	crv, err := CanonicalCRV(crv, size)
+	if err != nil {
+		return nil, err
+	}
+	crv_bytes, _ := crv.MarshalBinary()
+	crv_hash, _ := crypto.GenerateSHA256(crv_bytes)
+	return crypto.GenerateSHA256([]byte("CKP" + period + string(crv_hash) + strconv.FormatUint(uint64(size), 10) + srh))
+}
@@ -1,5 +1,9 @@
 package definition
 
+import (
+	merkletree "github.com/txaty/go-merkletree"
+)
+
 type Gossip_object struct {
 	Application string    `json:"application"`
 	Period      string    `json:"period"`
@@ -30,6 +34,25 @@ type Revocation struct {
 	Period    string
 	Delta_CRV []byte
 	SRH       string
+	Size      uint `json:",omitempty"` // size of the CRV committed in the SRH, 0 for REVs that predate it
+	// link to the previous REV of the CA, empty for its first REV
+	// Prev_SRH is SRH_chain of the SRH of the REV of Prev_period, both are committed in the SRH
+	Prev_period string `json:",omitempty"`
+	Prev_SRH    string `json:",omitempty"`
+	// position of the REV in the chain of the CA, 1 for its first REV
+	// periods wrap every hour, Sequence does not, 0 for REVs that predate it
+	Sequence uint64 `json:",omitempty"`
+}
+
+// full CRV of a CA as of Period, published every few periods so a verifier can start without every delta
+// Signature is the RSA signature of the CA on Checkpoint_hash
+type Checkpoint struct {
+	Period    string
+	CRV       []byte // compressed, encoded at Size bits
+	Size      uint
+	SRH       string `json:",omitempty"` // SRH of the REV of Period, so the REVs after the checkpoint can be chained to it
+	Sequence  uint64 `json:",omitempty"` // sequence number of that REV
+	Signature string
 }
 
 type STH struct {
@@ -40,6 +63,43 @@ type STH struct {
 	TreeSize  int
 }
 
+// consistency proof between two tree sizes of a logger
+type STH_Consistency struct {
+	First  int
+	Second int
+	Proof  [][]byte
+}
+
+// a page of the STHs published by a logger, oldest first
+type STH_History struct {
+	Total int
+	Start int
+	STHs  []Gossip_object
+}
+
+// receipt signed by a logger when it accepts a precert, it promises the leaf will be in the STH of Period
+type Precert_Receipt struct {
+	Signer    string
+	Timestamp string
+	Period    string
+	LeafHash  string
+	Signature string
+}
+
+// one logged precert, as served by get-entries
+type Log_Entry struct {
+	Index    int
+	LeafHash string
+	Precert  []byte // DER of the precert
+}
+
+// inclusion proof of a leaf in the tree of Tree_size entries, as served by get-proof-by-hash
+type Inclusion_Proof struct {
+	Leaf_index int
+	Tree_size  int
+	Poi        *merkletree.Proof
+}
+
 // The only valid application type
 const CTNG_APPLICATION = "CTng"
 
@@ -49,12 +109,15 @@ const (
 	REV_INIT = "http://ctng.uconn.edu/102"
 	ACC_INIT = "http://ctng.uconn.edu/103"
 	CON_INIT = "http://ctng.uconn.edu/104"
+	CKP_INIT = "http://ctng.uconn.edu/105"
 	STH_FRAG = "http://ctng.uconn.edu/201"
 	REV_FRAG = "http://ctng.uconn.edu/202"
 	ACC_FRAG = "http://ctng.uconn.edu/203"
+	CKP_FRAG = "http://ctng.uconn.edu/205"
 	STH_FULL = "http://ctng.uconn.edu/301"
 	REV_FULL = "http://ctng.uconn.edu/302"
 	ACC_FULL = "http://ctng.uconn.edu/303"
+	CKP_FULL = "http://ctng.uconn.edu/305"
 )
 
 type Gossip_Storage map[Gossip_ID]Gossip_object
@@ -85,12 +148,16 @@ func (g Gossip_object) GetTargetType() string {
 		return REV_FRAG
 	case ACC_INIT:
 		return ACC_FRAG
+	case CKP_INIT:
+		return CKP_FRAG
 	case STH_FRAG:
 		return STH_FULL
 	case REV_FRAG:
 		return REV_FULL
 	case ACC_FRAG:
 		return ACC_FULL
+	case CKP_FRAG:
+		return CKP_FULL
 	default:
 		return ""
 	}
@@ -119,6 +186,11 @@ func (p PoM_Counter) GetID() string {
 // 1: empty
 // 2: empty
 
+// CKP_INIT Payload
+// 0: CAURL
+// 1: "CRV_CHECKPOINT"
+// 2: Checkpoint Struct
+
 // CON_INIT Payload
 // 0: loggerURL/CAURL
 // 1: Conflicting STH/REV 01
@@ -135,18 +207,24 @@ func TypeString(t string) string {
 		return "ACC_INIT"
 	case CON_INIT:
 		return "CON_INIT"
+	case CKP_INIT:
+		return "CKP_INIT"
 	case STH_FRAG:
 		return "STH_FRAG"
 	case REV_FRAG:
 		return "REV_FRAG"
 	case ACC_FRAG:
 		return "ACC_FRAG"
+	case CKP_FRAG:
+		return "CKP_FRAG"
 	case STH_FULL:
 		return "STH_FULL"
 	case REV_FULL:
 		return "REV_FULL"
 	case ACC_FULL:
 		return "ACC_FULL"
+	case CKP_FULL:
+		return "CKP_FULL"
 	default:
 		return "UNKNOWN"
 	}
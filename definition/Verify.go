@@ -8,6 +8,8 @@ import (
 
 	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/util"
+
+	"github.com/bits-and-blooms/bitset"
 	//"strings"
 	//"time"
 )
@@ -17,6 +19,10 @@ const (
 	No_Sig_Match = "Signatures don't match"
 	Mislabel     = "Fields mislabeled"
 	Invalid_Type = "Invalid Type"
+	// threshold signatures
+	Duplicate_Signer   = "Fragment signer counted twice"
+	Not_Enough_Signers = "Not enough signers"
+	Signers_Mismatch   = "Signers do not match the threshold signature"
 )
 
 func Verify_CON(g Gossip_object, c *crypto.CryptoConfig) error {
@@ -55,8 +61,14 @@ func Verify_PayloadFrag(g Gossip_object, c *crypto.CryptoConfig) error {
 // verifies threshold signatures match payload
 func Verify_PayloadThreshold(g Gossip_object, c *crypto.CryptoConfig) error {
 	if g.Signature[0] != "" && g.Payload[0] != "" {
-		sig, _ := crypto.ThresholdSigFromString(g.Signature[0])
-		err := c.ThresholdVerify(g.Payload[0]+g.Payload[1]+g.Payload[2], sig)
+		sig, err := crypto.ThresholdSigFromString(g.Signature[0])
+		if err != nil {
+			return errors.New(No_Sig_Match)
+		}
+		if err := Verify_Signers(g, sig, c.Threshold); err != nil {
+			return err
+		}
+		err = c.ThresholdVerify(g.Payload[0]+g.Payload[1]+g.Payload[2], sig)
 		if err != nil {
 			return errors.New(No_Sig_Match)
 		}
@@ -66,6 +78,33 @@ func Verify_PayloadThreshold(g Gossip_object, c *crypto.CryptoConfig) error {
 	}
 }
 
+// A threshold signature must be aggregated from at least threshold distinct fragments,
+// and the Signers of the object, if listed, must be the IDs it was aggregated from
+func Verify_Signers(g Gossip_object, sig crypto.ThresholdSig, threshold int) error {
+	ids := make(map[string]bool)
+	for _, id := range sig.IDs {
+		if ids[string(id)] {
+			return errors.New(Duplicate_Signer + ": " + string(id))
+		}
+		ids[string(id)] = true
+	}
+	if len(ids) < threshold {
+		return errors.New(Not_Enough_Signers)
+	}
+	if len(g.Signers) == 0 {
+		return nil
+	}
+	if len(g.Signers) != len(ids) {
+		return errors.New(Signers_Mismatch)
+	}
+	for _, signer := range g.Signers {
+		if !ids[signer] {
+			return errors.New(Signers_Mismatch + ": " + signer)
+		}
+	}
+	return nil
+}
+
 // Verifies RSAsig matches payload, wait.... i think this just works out of the box with what we have
 func Verify_RSAPayload(g Gossip_object, c *crypto.CryptoConfig) error {
 	if g.Signature[0] != "" && g.Payload[0] != "" {
@@ -95,36 +134,63 @@ func (g Gossip_object) Verify(c *crypto.CryptoConfig) error {
 		return Verify_RSAPayload(g, c)
 	case CON_INIT:
 		return Verify_CON(g, c)
+	case CKP_INIT:
+		return Verify_RSAPayload(g, c)
 	case STH_FRAG:
 		return Verify_PayloadFrag(g, c)
 	case REV_FRAG:
 		return Verify_PayloadFrag(g, c)
 	case ACC_FRAG:
 		return Verify_PayloadFrag(g, c)
+	case CKP_FRAG:
+		return Verify_PayloadFrag(g, c)
 	case STH_FULL:
 		return Verify_PayloadThreshold(g, c)
 	case REV_FULL:
 		return Verify_PayloadThreshold(g, c)
 	case ACC_FULL:
 		return Verify_PayloadThreshold(g, c)
+	case CKP_FULL:
+		return Verify_PayloadThreshold(g, c)
 	default:
 		fmt.Println(util.RED, "the type is: ", g.Type, util.RESET)
 		return errors.New(Invalid_Type)
 	}
 }
 
-func ExtractRootHash(gossipSTH Gossip_object) ([]byte, error) {
-	payload1 := gossipSTH.Payload[1]
+// the message signed by the logger in a precert receipt
+func (r Precert_Receipt) Payload() string {
+	return r.Signer + r.Timestamp + r.Period + r.LeafHash
+}
 
-	sthBytes, err := hex.DecodeString(payload1)
+func (r Precert_Receipt) Verify(c *crypto.CryptoConfig) error {
+	sig, err := crypto.RSASigFromString(r.Signature)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode STH payload: %v", err)
+		return errors.New(No_Sig_Match)
+	}
+	if sig.ID.String() != r.Signer {
+		return errors.New(Mislabel)
 	}
+	return c.Verify([]byte(r.Payload()), sig)
+}
 
+func ExtractSTH(gossipSTH Gossip_object) (STH, error) {
 	var STH1 STH
+	sthBytes, err := hex.DecodeString(gossipSTH.Payload[1])
+	if err != nil {
+		return STH1, fmt.Errorf("failed to decode STH payload: %v", err)
+	}
 	err = json.Unmarshal(sthBytes, &STH1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal STH: %v", err)
+		return STH1, fmt.Errorf("failed to unmarshal STH: %v", err)
+	}
+	return STH1, nil
+}
+
+func ExtractRootHash(gossipSTH Gossip_object) ([]byte, error) {
+	STH1, err := ExtractSTH(gossipSTH)
+	if err != nil {
+		return nil, err
 	}
 
 	roothash, err := hex.DecodeString(STH1.RootHash)
@@ -134,3 +200,70 @@ func ExtractRootHash(gossipSTH Gossip_object) ([]byte, error) {
 
 	return roothash, nil
 }
+
+// ExtractRevocation returns the revocation carried by a REV object and its delta CRV
+func ExtractRevocation(gossipREV Gossip_object) (Revocation, *bitset.BitSet, error) {
+	var revocation Revocation
+	err := json.Unmarshal([]byte(gossipREV.Payload[2]), &revocation)
+	if err != nil {
+		return revocation, nil, fmt.Errorf("failed to unmarshal revocation: %v", err)
+	}
+	decompressed, err := util.DecompressData(revocation.Delta_CRV)
+	if err != nil {
+		return revocation, nil, fmt.Errorf("failed to decompress delta CRV: %v", err)
+	}
+	var delta bitset.BitSet
+	err = delta.UnmarshalBinary(decompressed)
+	if err != nil {
+		return revocation, nil, fmt.Errorf("failed to unmarshal delta CRV: %v", err)
+	}
+	return revocation, &delta, nil
+}
+
+// ExtractCheckpoint returns the checkpoint carried by a CKP object and its CRV, encoded at the checkpoint size
+func ExtractCheckpoint(gossipCKP Gossip_object) (Checkpoint, *bitset.BitSet, error) {
+	var checkpoint Checkpoint
+	err := json.Unmarshal([]byte(gossipCKP.Payload[2]), &checkpoint)
+	if err != nil {
+		return checkpoint, nil, fmt.Errorf("failed to unmarshal checkpoint: %v", err)
+	}
+	decompressed, err := util.DecompressData(checkpoint.CRV)
+	if err != nil {
+		return checkpoint, nil, fmt.Errorf("failed to decompress checkpoint CRV: %v", err)
+	}
+	var crv bitset.BitSet
+	err = crv.UnmarshalBinary(decompressed)
+	if err != nil {
+		return checkpoint, nil, fmt.Errorf("failed to unmarshal checkpoint CRV: %v", err)
+	}
+	canonical, err := CanonicalCRV(&crv, checkpoint.Size)
+	if err != nil {
+		return checkpoint, nil, err
+	}
+	return checkpoint, canonical, nil
+}
+
+// VerifyCheckpoint checks the signature of the CA named in Payload[0] on the checkpoint and returns it with its CRV
+// The signature on the gossip object itself is checked by Verify
+func VerifyCheckpoint(gossipCKP Gossip_object, c *crypto.CryptoConfig) (Checkpoint, *bitset.BitSet, error) {
+	checkpoint, crv, err := ExtractCheckpoint(gossipCKP)
+	if err != nil {
+		return checkpoint, nil, err
+	}
+	sig, err := crypto.RSASigFromString(checkpoint.Signature)
+	if err != nil {
+		return checkpoint, nil, errors.New(No_Sig_Match)
+	}
+	if sig.ID.String() != gossipCKP.Payload[0] {
+		return checkpoint, nil, errors.New(Mislabel)
+	}
+	hash, err := Checkpoint_hash(checkpoint.Period, crv, checkpoint.Size, checkpoint.SRH)
+	if err != nil {
+		return checkpoint, nil, err
+	}
+	err = c.Verify(hash, sig)
+	if err != nil {
+		return checkpoint, nil, err
+	}
+	return checkpoint, crv, nil
+}
@@ -15,24 +15,30 @@ func InitializeGossipObjectStorage() *Gossip_object_storage {
 		REV_INIT:         make(map[definition.Gossip_ID]definition.Gossip_object),
 		ACC_INIT:         make(map[definition.Gossip_ID]definition.Gossip_object),
 		CON_INIT:         make(map[definition.Gossip_ID]definition.Gossip_object),
+		CKP_INIT:         make(map[definition.Gossip_ID]definition.Gossip_object),
 		STH_FRAG:         make(map[definition.Gossip_ID][]definition.Gossip_object),
 		REV_FRAG:         make(map[definition.Gossip_ID][]definition.Gossip_object),
 		ACC_FRAG:         make(map[definition.Gossip_ID][]definition.Gossip_object),
+		CKP_FRAG:         make(map[definition.Gossip_ID][]definition.Gossip_object),
 		STH_FULL:         make(map[definition.Gossip_ID]definition.Gossip_object),
 		REV_FULL:         make(map[definition.Gossip_ID]definition.Gossip_object),
 		ACC_FULL:         make(map[definition.Gossip_ID]definition.Gossip_object),
-		REV_PAYLOAD:      make(map[definition.Gossip_ID]definition.Gossip_object),
+		CKP_FULL:         make(map[definition.Gossip_ID]definition.Gossip_object),
+		OBJ_PAYLOAD:      make(map[string]definition.Gossip_object),
 		STH_INIT_LOCK:    sync.RWMutex{},
 		REV_INIT_LOCK:    sync.RWMutex{},
 		ACC_INIT_LOCK:    sync.RWMutex{},
 		CON_INIT_LOCK:    sync.RWMutex{},
+		CKP_INIT_LOCK:    sync.RWMutex{},
 		STH_FRAG_LOCK:    sync.RWMutex{},
 		REV_FRAG_LOCK:    sync.RWMutex{},
 		ACC_FRAG_LOCK:    sync.RWMutex{},
+		CKP_FRAG_LOCK:    sync.RWMutex{},
 		STH_FULL_LOCK:    sync.RWMutex{},
 		REV_FULL_LOCK:    sync.RWMutex{},
 		ACC_FULL_LOCK:    sync.RWMutex{},
-		REV_PAYLOAD_LOCK: sync.RWMutex{},
+		CKP_FULL_LOCK:    sync.RWMutex{},
+		OBJ_PAYLOAD_LOCK: sync.RWMutex{},
 	}
 }
 
@@ -74,6 +80,17 @@ func InitializeGossiperContext(public_config_path string, private_config_path st
 		Counter2_lock:           sync.Mutex{},
 		Optimization_threshold:  10,
 		Optimization_mode:       true,
+		Max_period_skew:         1,
+		Ingress_failures:        make(map[string]int),
+		Sender_scores:           make(map[string]*Sender_score),
+		Ingress_lock:            sync.Mutex{},
+		Anti_entropy_interval:   10,
+		Journal_filepath:        "Gossip_log/" + storageID + "_journal.jsonl",
+		Journal_lock:            sync.Mutex{},
+		Pending_frags:           make(map[string]map[string]Pending_frag),
+		Pending_count:           make(map[string]int),
+		Max_pending:             100,
+		Pending_lock:            sync.Mutex{},
 	}
 	return ctx
 }
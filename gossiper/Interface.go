@@ -1,7 +1,7 @@
 package gossiper
 
 import (
-	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strconv"
@@ -40,43 +40,106 @@ func countFragments(fragmentMap map[definition.Gossip_ID][]definition.Gossip_obj
 	return count
 }
 
+// Large payloads are announced, requested and delivered by the hash of the signed payload,
+// which the INIT, FRAG and FULL objects of an ID share whatever their type
+func PayloadHash(g definition.Gossip_object) []byte {
+	hash_byte, _ := crypto.GenerateSHA256([]byte(g.Payload[0] + g.Payload[1] + g.Payload[2]))
+	return hash_byte
+}
+
+// SavePayload keeps a verified object as the source of its payload
 func (ctx *GossiperContext) SavePayload(g definition.Gossip_object) {
 	err := g.Verify(ctx.Gossiper_crypto_config)
 	if err != nil {
 		fmt.Println(util.RED, "Invalid object "+definition.TypeString(g.Type)+" signed by "+g.Signer+".", util.RESET)
 		return
 	}
-	ctx.Gossip_object_storage.REV_PAYLOAD_LOCK.Lock()
-	ctx.Gossip_object_storage.REV_PAYLOAD[g.GetID()] = g
-	ctx.Gossip_object_storage.REV_PAYLOAD_LOCK.Unlock()
+	ctx.store_payload(g)
 }
 
-func (ctx *GossiperContext) SearchPayload(gid definition.Gossip_ID, ohash []byte) bool {
-	gid.Type = definition.REV_INIT
-
-	// Start of the critical section
-	ctx.Gossip_object_storage.REV_PAYLOAD_LOCK.RLock()
-	obj, ok := ctx.Gossip_object_storage.REV_PAYLOAD[gid]
-	ctx.Gossip_object_storage.REV_PAYLOAD_LOCK.RUnlock()
-	// End of the critical section
-	if !ok {
-		return false
+// objects without their payload are not a source, the first object of a payload is kept
+func (ctx *GossiperContext) store_payload(g definition.Gossip_object) {
+	if Is_stripped(g) || g.Payload[0] == "" {
+		return
+	}
+	key := hex.EncodeToString(PayloadHash(g))
+	ctx.Gossip_object_storage.OBJ_PAYLOAD_LOCK.Lock()
+	defer ctx.Gossip_object_storage.OBJ_PAYLOAD_LOCK.Unlock()
+	if _, ok := ctx.Gossip_object_storage.OBJ_PAYLOAD[key]; !ok {
+		ctx.Gossip_object_storage.OBJ_PAYLOAD[key] = g
 	}
+}
 
-	hash1 := ComputeobjHash(obj)
-	return bytes.Equal(hash1, ohash)
+func (ctx *GossiperContext) SearchPayload(ohash []byte) bool {
+	ctx.Gossip_object_storage.OBJ_PAYLOAD_LOCK.RLock()
+	_, ok := ctx.Gossip_object_storage.OBJ_PAYLOAD[hex.EncodeToString(ohash)]
+	ctx.Gossip_object_storage.OBJ_PAYLOAD_LOCK.RUnlock()
+	return ok
 }
 
-func (ctx *GossiperContext) GetREVrequested(gid definition.Gossip_ID) definition.Gossip_object {
-	gid.Type = definition.REV_INIT
-	ctx.Gossip_object_storage.REV_PAYLOAD_LOCK.RLock()
-	defer ctx.Gossip_object_storage.REV_PAYLOAD_LOCK.RUnlock()
-	if _, ok := ctx.Gossip_object_storage.REV_PAYLOAD[gid]; ok {
-		return ctx.Gossip_object_storage.REV_PAYLOAD[gid]
+// GetRequested returns the object saved for a payload hash, or an empty object
+func (ctx *GossiperContext) GetRequested(ohash []byte) definition.Gossip_object {
+	ctx.Gossip_object_storage.OBJ_PAYLOAD_LOCK.RLock()
+	defer ctx.Gossip_object_storage.OBJ_PAYLOAD_LOCK.RUnlock()
+	if obj, ok := ctx.Gossip_object_storage.OBJ_PAYLOAD[hex.EncodeToString(ohash)]; ok {
+		return obj
 	}
 	return definition.Gossip_object{}
 }
 
+// Hold_fragment keeps a stripped fragment until its payload arrives
+// A sender holds one fragment per signer of a payload, so fragments sent by others are never pushed out by it
+// It returns true for the first fragment of a signer, the payload is requested from that signer
+func (ctx *GossiperContext) Hold_fragment(sender string, g definition.Gossip_object) bool {
+	key := hex.EncodeToString(Payload_ref(g))
+	ctx.Pending_lock.Lock()
+	defer ctx.Pending_lock.Unlock()
+	pending, ok := ctx.Pending_frags[key]
+	if !ok {
+		pending = make(map[string]Pending_frag)
+		ctx.Pending_frags[key] = pending
+	}
+	slot := sender + "|" + g.Signer
+	if _, ok := pending[slot]; !ok {
+		if ctx.Pending_count[sender] >= ctx.Max_pending {
+			return false
+		}
+		ctx.Pending_count[sender]++
+	}
+	first := true
+	for _, p := range pending {
+		if p.Object.Signer == g.Signer {
+			first = false
+		}
+	}
+	pending[slot] = Pending_frag{Sender: sender, Object: g}
+	return first
+}
+
+// Release_fragments handles the fragments that were waiting for the payload of g
+func (ctx *GossiperContext) Release_fragments(g definition.Gossip_object) {
+	if Is_stripped(g) || is_frag(g.Type) {
+		return
+	}
+	key := hex.EncodeToString(PayloadHash(g))
+	ctx.Pending_lock.Lock()
+	pending := ctx.Pending_frags[key]
+	delete(ctx.Pending_frags, key)
+	for _, p := range pending {
+		ctx.Pending_count[p.Sender]--
+	}
+	ctx.Pending_lock.Unlock()
+	for _, p := range pending {
+		frag, err := ctx.Validate_gossip_object(p.Object, "")
+		ctx.Score_sender(p.Sender, err)
+		if err != nil {
+			fmt.Println(util.RED, "Rejected object "+definition.TypeString(frag.Type)+" from "+p.Sender+": "+err.Error(), util.RESET)
+			continue
+		}
+		Handle_Gossip_object(ctx, frag)
+	}
+}
+
 func (ctx *GossiperContext) Save() {
 	Period, _ := strconv.Atoi(util.GetCurrentPeriod())
 	g_log_entry := Gossiper_log_entry{
@@ -185,11 +248,21 @@ func (ctx *GossiperContext) Store_gossip_object(gossip_object definition.Gossip_
 			ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.Lock()
 			ctx.Gossip_blacklist.BLACKLIST_PERM[gossip_object.Payload[0]] = true
 			ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.Unlock()
+			ctx.Journal_blacklist(gossip_object.Payload[0])
 		}
 		if ctx.IsInitConvergent() {
 			ctx.Converge_time_init = util.GetCurrentSecond()
 			fmt.Println(util.BLUE, "INIT Converge time: ", ctx.Converge_time_init, util.RESET)
 		}
+	case definition.CKP_INIT:
+		ctx.Gossip_object_storage.CKP_INIT_LOCK.Lock()
+		// if it is a duplicate, ignore it
+		if ctx.DupCheckInLock(gossip_object) {
+			ctx.Gossip_object_storage.CKP_INIT_LOCK.Unlock()
+			return false
+		}
+		ctx.Gossip_object_storage.CKP_INIT[gossip_object.GetID()] = gossip_object
+		ctx.Gossip_object_storage.CKP_INIT_LOCK.Unlock()
 	case definition.STH_FRAG:
 		ctx.Gossip_object_storage.STH_FRAG_LOCK.Lock()
 		ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()], gossip_object)
@@ -202,16 +275,44 @@ func (ctx *GossiperContext) Store_gossip_object(gossip_object definition.Gossip_
 		ctx.Gossip_object_storage.ACC_FRAG_LOCK.Lock()
 		ctx.Gossip_object_storage.ACC_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.ACC_FRAG[gossip_object.GetID()], gossip_object)
 		ctx.Gossip_object_storage.ACC_FRAG_LOCK.Unlock()
+	case definition.CKP_FRAG:
+		ctx.Gossip_object_storage.CKP_FRAG_LOCK.Lock()
+		ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()], gossip_object)
+		ctx.Gossip_object_storage.CKP_FRAG_LOCK.Unlock()
 	case definition.STH_FULL:
 		ctx.Gossip_object_storage.STH_FULL_LOCK.Lock()
+		// the first full object of an ID is kept, the others are aggregated from other fragments
+		if _, ok := ctx.Gossip_object_storage.STH_FULL[gossip_object.GetID()]; ok {
+			ctx.Gossip_object_storage.STH_FULL_LOCK.Unlock()
+			return false
+		}
 		ctx.Gossip_object_storage.STH_FULL[gossip_object.GetID()] = gossip_object
 		ctx.Gossip_object_storage.STH_FULL_LOCK.Unlock()
 	case definition.REV_FULL:
 		ctx.Gossip_object_storage.REV_FULL_LOCK.Lock()
+		// the first full object of an ID is kept, the others are aggregated from other fragments
+		if _, ok := ctx.Gossip_object_storage.REV_FULL[gossip_object.GetID()]; ok {
+			ctx.Gossip_object_storage.REV_FULL_LOCK.Unlock()
+			return false
+		}
 		ctx.Gossip_object_storage.REV_FULL[gossip_object.GetID()] = gossip_object
 		ctx.Gossip_object_storage.REV_FULL_LOCK.Unlock()
+	case definition.CKP_FULL:
+		ctx.Gossip_object_storage.CKP_FULL_LOCK.Lock()
+		// the first full object of an ID is kept, the others are aggregated from other fragments
+		if _, ok := ctx.Gossip_object_storage.CKP_FULL[gossip_object.GetID()]; ok {
+			ctx.Gossip_object_storage.CKP_FULL_LOCK.Unlock()
+			return false
+		}
+		ctx.Gossip_object_storage.CKP_FULL[gossip_object.GetID()] = gossip_object
+		ctx.Gossip_object_storage.CKP_FULL_LOCK.Unlock()
 	case definition.ACC_FULL:
 		ctx.Gossip_object_storage.ACC_FULL_LOCK.Lock()
+		// the first full object of an ID is kept, the others are aggregated from other fragments
+		if _, ok := ctx.Gossip_object_storage.ACC_FULL[gossip_object.GetID()]; ok {
+			ctx.Gossip_object_storage.ACC_FULL_LOCK.Unlock()
+			return false
+		}
 		ctx.Gossip_object_storage.ACC_FULL[gossip_object.GetID()] = gossip_object
 		ctx.Gossip_object_storage.ACC_FULL_LOCK.Unlock()
 		// if not in temp blacklist, add it
@@ -219,17 +320,31 @@ func (ctx *GossiperContext) Store_gossip_object(gossip_object definition.Gossip_
 			ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.Lock()
 			ctx.Gossip_blacklist.BLACKLIST_PERM[gossip_object.Payload[0]] = true
 			ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.Unlock()
+			ctx.Journal_blacklist(gossip_object.Payload[0])
 		}
 	}
 	return true
 }
 
+// a gossiper counts once towards the threshold of an object
+func has_signer(frags []definition.Gossip_object, signer string) bool {
+	for _, f := range frags {
+		if f.Signer == signer {
+			return true
+		}
+	}
+	return false
+}
+
 func (ctx *GossiperContext) Read_and_Store_If_Needed(gossip_object definition.Gossip_object) int {
 	switch gossip_object.Type {
 	case definition.STH_FRAG:
 		ctx.Gossip_object_storage.STH_FRAG_LOCK.Lock()
 		defer ctx.Gossip_object_storage.STH_FRAG_LOCK.Unlock()
 		before := len(ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()])
+		if has_signer(ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()], gossip_object.Signer) {
+			return ctx.Gossiper_crypto_config.Threshold
+		}
 		if len(ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()]) < ctx.Gossiper_crypto_config.Threshold {
 			ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()], gossip_object)
 		}
@@ -238,6 +353,9 @@ func (ctx *GossiperContext) Read_and_Store_If_Needed(gossip_object definition.Go
 		ctx.Gossip_object_storage.REV_FRAG_LOCK.Lock()
 		defer ctx.Gossip_object_storage.REV_FRAG_LOCK.Unlock()
 		before := len(ctx.Gossip_object_storage.REV_FRAG[gossip_object.GetID()])
+		if has_signer(ctx.Gossip_object_storage.REV_FRAG[gossip_object.GetID()], gossip_object.Signer) {
+			return ctx.Gossiper_crypto_config.Threshold
+		}
 		if len(ctx.Gossip_object_storage.REV_FRAG[gossip_object.GetID()]) < ctx.Gossiper_crypto_config.Threshold {
 			ctx.Gossip_object_storage.REV_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.REV_FRAG[gossip_object.GetID()], gossip_object)
 		}
@@ -246,10 +364,24 @@ func (ctx *GossiperContext) Read_and_Store_If_Needed(gossip_object definition.Go
 		ctx.Gossip_object_storage.ACC_FRAG_LOCK.Lock()
 		defer ctx.Gossip_object_storage.ACC_FRAG_LOCK.Unlock()
 		before := len(ctx.Gossip_object_storage.ACC_FRAG[gossip_object.GetID()])
+		if has_signer(ctx.Gossip_object_storage.ACC_FRAG[gossip_object.GetID()], gossip_object.Signer) {
+			return ctx.Gossiper_crypto_config.Threshold
+		}
 		if len(ctx.Gossip_object_storage.ACC_FRAG[gossip_object.GetID()]) < ctx.Gossiper_crypto_config.Threshold {
 			ctx.Gossip_object_storage.ACC_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.ACC_FRAG[gossip_object.GetID()], gossip_object)
 		}
 		return before
+	case definition.CKP_FRAG:
+		ctx.Gossip_object_storage.CKP_FRAG_LOCK.Lock()
+		defer ctx.Gossip_object_storage.CKP_FRAG_LOCK.Unlock()
+		before := len(ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()])
+		if has_signer(ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()], gossip_object.Signer) {
+			return ctx.Gossiper_crypto_config.Threshold
+		}
+		if len(ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()]) < ctx.Gossiper_crypto_config.Threshold {
+			ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()] = append(ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()], gossip_object)
+		}
+		return before
 	}
 	return 0
 
@@ -276,6 +408,11 @@ func (ctx *GossiperContext) DupCheckInLock(gossip_object definition.Gossip_objec
 			return false
 		}
 		return ctx.Gossip_object_storage.CON_INIT[gossip_object.GetID()].Signature == gossip_object.Signature
+	case definition.CKP_INIT:
+		if _, ok := ctx.Gossip_object_storage.CKP_INIT[gossip_object.GetID()]; !ok {
+			return false
+		}
+		return ctx.Gossip_object_storage.CKP_INIT[gossip_object.GetID()].Signature == gossip_object.Signature
 	case definition.STH_FRAG:
 		if len(ctx.Gossip_object_storage.STH_FRAG[gossip_object.GetID()]) == 0 {
 			return false
@@ -304,6 +441,15 @@ func (ctx *GossiperContext) DupCheckInLock(gossip_object definition.Gossip_objec
 				return true
 			}
 		}
+	case definition.CKP_FRAG:
+		if len(ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()]) == 0 {
+			return false
+		}
+		for _, v := range ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()] {
+			if v.Signature == gossip_object.Signature {
+				return true
+			}
+		}
 	case definition.STH_FULL:
 		if _, ok := ctx.Gossip_object_storage.STH_FULL[gossip_object.GetID()]; !ok {
 			return false
@@ -319,6 +465,11 @@ func (ctx *GossiperContext) DupCheckInLock(gossip_object definition.Gossip_objec
 			return false
 		}
 		return ctx.Gossip_object_storage.ACC_FULL[gossip_object.GetID()].Signature == gossip_object.Signature
+	case definition.CKP_FULL:
+		if _, ok := ctx.Gossip_object_storage.CKP_FULL[gossip_object.GetID()]; !ok {
+			return false
+		}
+		return ctx.Gossip_object_storage.CKP_FULL[gossip_object.GetID()].Signature == gossip_object.Signature
 	}
 	return false
 }
@@ -352,6 +503,13 @@ func (ctx *GossiperContext) IsDuplicate_G(gossip_object definition.Gossip_object
 			return false
 		}
 		return ctx.Gossip_object_storage.CON_INIT[gossip_object.GetID()].Signature == gossip_object.Signature
+	case definition.CKP_INIT:
+		ctx.Gossip_object_storage.CKP_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_INIT_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.CKP_INIT[gossip_object.GetID()]; !ok {
+			return false
+		}
+		return ctx.Gossip_object_storage.CKP_INIT[gossip_object.GetID()].Signature == gossip_object.Signature
 	case definition.STH_FRAG:
 		ctx.Gossip_object_storage.STH_FRAG_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FRAG_LOCK.RUnlock()
@@ -386,6 +544,17 @@ func (ctx *GossiperContext) IsDuplicate_G(gossip_object definition.Gossip_object
 				return true
 			}
 		}
+	case definition.CKP_FRAG:
+		ctx.Gossip_object_storage.CKP_FRAG_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_FRAG_LOCK.RUnlock()
+		if len(ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()]) == 0 {
+			return false
+		}
+		for _, v := range ctx.Gossip_object_storage.CKP_FRAG[gossip_object.GetID()] {
+			if v.Signature == gossip_object.Signature {
+				return true
+			}
+		}
 	case definition.STH_FULL:
 		ctx.Gossip_object_storage.STH_FULL_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FULL_LOCK.RUnlock()
@@ -407,6 +576,13 @@ func (ctx *GossiperContext) IsDuplicate_G(gossip_object definition.Gossip_object
 			return false
 		}
 		return ctx.Gossip_object_storage.ACC_FULL[gossip_object.GetID()].Signature == gossip_object.Signature
+	case definition.CKP_FULL:
+		ctx.Gossip_object_storage.CKP_FULL_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_FULL_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.CKP_FULL[gossip_object.GetID()]; !ok {
+			return false
+		}
+		return ctx.Gossip_object_storage.CKP_FULL[gossip_object.GetID()].Signature == gossip_object.Signature
 	}
 	return false
 }
@@ -415,7 +591,11 @@ func (ctx *GossiperContext) Store(obj any) bool {
 	switch obj.(type) {
 	case definition.Gossip_object:
 		gossip_object := obj.(definition.Gossip_object)
-		return ctx.Store_gossip_object(gossip_object)
+		stored := ctx.Store_gossip_object(gossip_object)
+		if stored {
+			ctx.Journal_object(gossip_object)
+		}
+		return stored
 	}
 	return false
 }
@@ -448,6 +628,10 @@ func (ctx *GossiperContext) GetObjectList(GID definition.Gossip_ID, TargetType s
 		ctx.Gossip_object_storage.ACC_FRAG_LOCK.RLock()
 		defer ctx.Gossip_object_storage.ACC_FRAG_LOCK.RUnlock()
 		newlist = ctx.Gossip_object_storage.ACC_FRAG[GID]
+	case definition.CKP_FRAG:
+		ctx.Gossip_object_storage.CKP_FRAG_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_FRAG_LOCK.RUnlock()
+		newlist = ctx.Gossip_object_storage.CKP_FRAG[GID]
 	}
 	return newlist
 }
@@ -486,6 +670,14 @@ func (ctx *GossiperContext) GetGossipObjectCount(GID definition.Gossip_ID, Targe
 		} else {
 			return 1
 		}
+	case definition.CKP_INIT:
+		ctx.Gossip_object_storage.CKP_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_INIT_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.CKP_INIT[GID]; !ok {
+			return 0
+		} else {
+			return 1
+		}
 	case definition.STH_FRAG:
 		ctx.Gossip_object_storage.STH_FRAG_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FRAG_LOCK.RUnlock()
@@ -498,6 +690,10 @@ func (ctx *GossiperContext) GetGossipObjectCount(GID definition.Gossip_ID, Targe
 		ctx.Gossip_object_storage.ACC_FRAG_LOCK.RLock()
 		defer ctx.Gossip_object_storage.ACC_FRAG_LOCK.RUnlock()
 		return len(ctx.Gossip_object_storage.ACC_FRAG[GID])
+	case definition.CKP_FRAG:
+		ctx.Gossip_object_storage.CKP_FRAG_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_FRAG_LOCK.RUnlock()
+		return len(ctx.Gossip_object_storage.CKP_FRAG[GID])
 	case definition.STH_FULL:
 		ctx.Gossip_object_storage.STH_FULL_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FULL_LOCK.RUnlock()
@@ -522,6 +718,14 @@ func (ctx *GossiperContext) GetGossipObjectCount(GID definition.Gossip_ID, Targe
 		} else {
 			return 1
 		}
+	case definition.CKP_FULL:
+		ctx.Gossip_object_storage.CKP_FULL_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_FULL_LOCK.RUnlock()
+		if _, ok := ctx.Gossip_object_storage.CKP_FULL[GID]; !ok {
+			return 0
+		} else {
+			return 1
+		}
 	}
 	return 0
 }
@@ -544,6 +748,10 @@ func (ctx *GossiperContext) GetObject(GID definition.Gossip_ID, targettype strin
 		ctx.Gossip_object_storage.CON_INIT_LOCK.RLock()
 		defer ctx.Gossip_object_storage.CON_INIT_LOCK.RUnlock()
 		return ctx.Gossip_object_storage.CON_INIT[GID]
+	case definition.CKP_INIT:
+		ctx.Gossip_object_storage.CKP_INIT_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_INIT_LOCK.RUnlock()
+		return ctx.Gossip_object_storage.CKP_INIT[GID]
 	case definition.STH_FULL:
 		ctx.Gossip_object_storage.STH_FULL_LOCK.RLock()
 		defer ctx.Gossip_object_storage.STH_FULL_LOCK.RUnlock()
@@ -556,6 +764,10 @@ func (ctx *GossiperContext) GetObject(GID definition.Gossip_ID, targettype strin
 		ctx.Gossip_object_storage.ACC_FULL_LOCK.RLock()
 		defer ctx.Gossip_object_storage.ACC_FULL_LOCK.RUnlock()
 		return ctx.Gossip_object_storage.ACC_FULL[GID]
+	case definition.CKP_FULL:
+		ctx.Gossip_object_storage.CKP_FULL_LOCK.RLock()
+		defer ctx.Gossip_object_storage.CKP_FULL_LOCK.RUnlock()
+		return ctx.Gossip_object_storage.CKP_FULL[GID]
 	}
 	return definition.Gossip_object{}
 }
@@ -622,11 +834,19 @@ func (ctx *GossiperContext) IsMalicious(obj definition.Gossip_object) bool {
 		if obj.Signer == obj_2.Signer && obj.Signature != obj_2.Signature {
 			return true
 		}
+	case definition.CKP_INIT:
+		obj_2 := ctx.GetObject(obj.GetID(), definition.CKP_INIT)
+		if obj.Signer == obj_2.Signer && obj.Signature != obj_2.Signature {
+			return true
+		}
 	}
 	return false
 }
 
 func (ctx *GossiperContext) WipeStorage() {
+	// objects stored after the wipe are journaled after the compaction, not dropped by it
+	ctx.Journal_lock.Lock()
+	defer ctx.Journal_lock.Unlock()
 	// clear all storage
 	CON_INIT := ctx.Gossip_object_storage.CON_INIT
 	*ctx.Gossip_object_storage = *InitializeGossipObjectStorage()
@@ -635,7 +855,16 @@ func (ctx *GossiperContext) WipeStorage() {
 	Blacklistperm := ctx.Gossip_blacklist.BLACKLIST_PERM
 	*ctx.Gossip_blacklist = *InitializeGossipBlacklist()
 	ctx.Gossip_blacklist.BLACKLIST_PERM = Blacklistperm
+	// fragments still waiting for a payload are from the last period
+	ctx.Pending_lock.Lock()
+	ctx.Pending_frags = make(map[string]map[string]Pending_frag)
+	ctx.Pending_count = make(map[string]int)
+	ctx.Pending_lock.Unlock()
 	// clear all PoM counter and gossiper log
+	// the journal only keeps what survives the wipe
+	if err := ctx.compact_journal(); err != nil {
+		fmt.Println(util.RED+"Error compacting gossiper journal: "+err.Error(), util.RESET)
+	}
 }
 
 func (ctx *GossiperContext) CleanUpGossiperStorage() {
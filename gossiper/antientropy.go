@@ -0,0 +1,277 @@
+package gossiper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/util"
+)
+
+// Anti-entropy between connected gossipers
+// Pushes that fail are not retried, so every Anti_entropy_interval seconds a gossiper sends a digest of the objects it holds
+// to each connected gossiper, which answers with its own digest, then each side pulls the objects it is missing from the other
+// An entry of the digest is a Gossip_Notification: the ID of an object and its hash
+
+type Gossip_digest struct {
+	Sender  string                           `json:"sender"`
+	Entries map[string][]Gossip_Notification `json:"entries"` // by type
+}
+
+var ErrUnknownGossiper = errors.New("digest from an unknown gossiper")
+
+func digest_entry(sender string, g definition.Gossip_object) Gossip_Notification {
+	return Gossip_Notification{
+		Sender:     sender,
+		Period:     g.Period,
+		Type:       g.Type,
+		Entity_URL: g.Payload[0],
+		Objhash:    ComputeobjHash(g),
+	}
+}
+
+func add_entries(entries map[string][]Gossip_Notification, sender string, objs map[definition.Gossip_ID]definition.Gossip_object, lock *sync.RWMutex) {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, g := range objs {
+		entries[g.Type] = append(entries[g.Type], digest_entry(sender, g))
+	}
+}
+
+func add_frag_entries(entries map[string][]Gossip_Notification, sender string, frags map[definition.Gossip_ID][]definition.Gossip_object, lock *sync.RWMutex) {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, list := range frags {
+		for _, g := range list {
+			entries[g.Type] = append(entries[g.Type], digest_entry(sender, g))
+		}
+	}
+}
+
+// Digest summarizes the objects in storage
+func (c *GossiperContext) Digest() Gossip_digest {
+	s := c.Gossip_object_storage
+	self := c.Gossiper_crypto_config.SelfID.String()
+	entries := make(map[string][]Gossip_Notification)
+	add_entries(entries, self, s.STH_INIT, &s.STH_INIT_LOCK)
+	add_entries(entries, self, s.REV_INIT, &s.REV_INIT_LOCK)
+	add_entries(entries, self, s.ACC_INIT, &s.ACC_INIT_LOCK)
+	add_entries(entries, self, s.CON_INIT, &s.CON_INIT_LOCK)
+	add_entries(entries, self, s.CKP_INIT, &s.CKP_INIT_LOCK)
+	add_frag_entries(entries, self, s.STH_FRAG, &s.STH_FRAG_LOCK)
+	add_frag_entries(entries, self, s.REV_FRAG, &s.REV_FRAG_LOCK)
+	add_frag_entries(entries, self, s.ACC_FRAG, &s.ACC_FRAG_LOCK)
+	add_frag_entries(entries, self, s.CKP_FRAG, &s.CKP_FRAG_LOCK)
+	add_entries(entries, self, s.STH_FULL, &s.STH_FULL_LOCK)
+	add_entries(entries, self, s.REV_FULL, &s.REV_FULL_LOCK)
+	add_entries(entries, self, s.ACC_FULL, &s.ACC_FULL_LOCK)
+	add_entries(entries, self, s.CKP_FULL, &s.CKP_FULL_LOCK)
+	return Gossip_digest{Sender: self, Entries: entries}
+}
+
+func is_init(t string) bool {
+	return t == definition.STH_INIT || t == definition.REV_INIT || t == definition.ACC_INIT || t == definition.CON_INIT || t == definition.CKP_INIT
+}
+
+func is_frag(t string) bool {
+	return t == definition.STH_FRAG || t == definition.REV_FRAG || t == definition.ACC_FRAG || t == definition.CKP_FRAG
+}
+
+// the ID of the object an entry names
+func entry_id(n Gossip_Notification) string {
+	return n.Type + "|" + n.Period + "|" + n.Entity_URL
+}
+
+// entries are told apart by their hash too, a peer holding another version of an object
+// passes it on so the conflict is found as for any other object
+func entry_key(n Gossip_Notification) string {
+	return entry_id(n) + "|" + hex.EncodeToString(n.Objhash)
+}
+
+// Missing lists the entries of a peer digest that are not in the local digest
+// Fragments of an object that is already full here are not needed
+func (c *GossiperContext) Missing(local Gossip_digest, peer Gossip_digest) []Gossip_Notification {
+	held := make(map[string]bool)
+	held_ids := make(map[string]bool)
+	for _, list := range local.Entries {
+		for _, n := range list {
+			held[entry_key(n)] = true
+			held_ids[entry_id(n)] = true
+		}
+	}
+	missing := []Gossip_Notification{}
+	for _, list := range peer.Entries {
+		for _, n := range list {
+			if held[entry_key(n)] {
+				continue
+			}
+			if is_frag(n.Type) {
+				full := definition.Gossip_object{Type: n.Type}.GetTargetType()
+				if held_ids[full+"|"+n.Period+"|"+n.Entity_URL] {
+					continue
+				}
+			}
+			missing = append(missing, n)
+		}
+	}
+	return missing
+}
+
+// Lookup returns the stored object named by an entry, if its hash matches
+func (c *GossiperContext) Lookup(n Gossip_Notification) (definition.Gossip_object, bool) {
+	gid := definition.Gossip_ID{Period: n.Period, Type: n.Type, Entity_URL: n.Entity_URL}
+	candidates := []definition.Gossip_object{}
+	if is_frag(n.Type) {
+		candidates = c.GetObjectList(gid, n.Type)
+	} else if g, ok := c.GetItem(gid, n.Type).(definition.Gossip_object); ok {
+		candidates = append(candidates, g)
+	}
+	for _, g := range candidates {
+		if bytes.Equal(ComputeobjHash(g), n.Objhash) {
+			return g, true
+		}
+	}
+	return definition.Gossip_object{}, false
+}
+
+func (c *GossiperContext) count_received(n int64) {
+	c.Counter1_lock.Lock()
+	c.Total_traffic_received += int(n)
+	c.Counter1_lock.Unlock()
+}
+
+func (c *GossiperContext) count_sent(n int) {
+	c.Counter2_lock.Lock()
+	c.Total_traffic_sent += n
+	c.Counter2_lock.Unlock()
+}
+
+// Pull asks url for the missing objects and handles them like gossip received from it
+func (c *GossiperContext) Pull(url string, missing []Gossip_Notification) (int, error) {
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	msg, _ := json.Marshal(missing)
+	c.count_sent(len(msg))
+	resp, err := c.Client.Post("http://"+url+"/gossip/pull", "application/json", bytes.NewBuffer(msg))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	c.count_received(resp.ContentLength)
+	var objs []definition.Gossip_object
+	if err := json.NewDecoder(resp.Body).Decode(&objs); err != nil {
+		return 0, err
+	}
+	accepted := 0
+	for _, g := range objs {
+		g, err := c.Validate_gossip_object(g, "")
+		c.Score_sender(url, err)
+		if err != nil {
+			fmt.Println(util.RED, "Rejected pulled object "+definition.TypeString(g.Type)+" from "+url+": "+err.Error(), util.RESET)
+			continue
+		}
+		Handle_Gossip_object(c, g)
+		accepted++
+	}
+	return accepted, nil
+}
+
+// Sync_with_gossiper exchanges digests with url and pulls what it has and we do not
+func (c *GossiperContext) Sync_with_gossiper(url string) (int, error) {
+	local := c.Digest()
+	msg, _ := json.Marshal(local)
+	c.count_sent(len(msg))
+	resp, err := c.Client.Post("http://"+url+"/gossip/digest", "application/json", bytes.NewBuffer(msg))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New("digest refused by " + url + ": " + resp.Status)
+	}
+	c.count_received(resp.ContentLength)
+	var peer Gossip_digest
+	if err := json.NewDecoder(resp.Body).Decode(&peer); err != nil {
+		return 0, err
+	}
+	return c.Pull(url, c.Missing(local, peer))
+}
+
+// answers a digest with the local one, then pulls from the sender what it has and we do not
+func Gossip_digest_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	var peer Gossip_digest
+	err := json.NewDecoder(r.Body).Decode(&peer)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.count_received(r.ContentLength)
+	if !c.known_gossiper(peer.Sender) {
+		http.Error(w, ErrUnknownGossiper.Error(), http.StatusForbidden)
+		return
+	}
+	local := c.Digest()
+	msg, _ := json.Marshal(local)
+	c.count_sent(len(msg))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msg)
+	if missing := c.Missing(local, peer); len(missing) > 0 {
+		go func() {
+			if _, err := c.Pull(peer.Sender, missing); err != nil {
+				fmt.Println(util.RED+"Pull from "+peer.Sender+" failed: "+err.Error(), util.RESET)
+			}
+		}()
+	}
+}
+
+// answers with the requested objects that are held here
+func Gossip_pull_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
+	var requested []Gossip_Notification
+	err := json.NewDecoder(r.Body).Decode(&requested)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.count_received(r.ContentLength)
+	objs := []definition.Gossip_object{}
+	for _, n := range requested {
+		if g, ok := c.Lookup(n); ok {
+			objs = append(objs, g)
+		}
+	}
+	msg, _ := json.Marshal(objs)
+	c.count_sent(len(msg))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msg)
+}
+
+func AntiEntropyTasks(c *GossiperContext) {
+	if c.Anti_entropy_interval <= 0 {
+		return
+	}
+	f := func() {
+		AntiEntropyTasks(c)
+	}
+	time.AfterFunc(time.Duration(c.Anti_entropy_interval)*time.Second, f)
+	for _, url := range c.Gossiper_private_config.Connected_Gossipers {
+		go func(url string) {
+			pulled, err := c.Sync_with_gossiper(url)
+			if err != nil {
+				fmt.Println(util.RED+"Anti-entropy with "+url+" failed: "+err.Error(), util.RESET)
+				return
+			}
+			if pulled > 0 {
+				fmt.Println(util.BLUE, "Pulled", pulled, "objects from", url, util.RESET)
+			}
+		}(url)
+	}
+}
@@ -1,7 +1,9 @@
 package gossiper
 
 import (
+	"encoding/hex"
 	"fmt"
+	"strings"
 
 	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
@@ -23,24 +25,41 @@ func (ctx *GossiperContext) Generate_Gossip_Object_FRAG(g definition.Gossip_obje
 		g.Type = definition.REV_FRAG
 	case definition.ACC_INIT:
 		g.Type = definition.ACC_FRAG
+	case definition.CKP_INIT:
+		g.Type = definition.CKP_FRAG
 	}
 	return g
 }
 
+// a stripped object keeps the entity of its payload and refers to the rest by its hash
+const Payload_ref_prefix = "ctng-payload-ref:"
+
+func Is_stripped(g definition.Gossip_object) bool {
+	return g.Payload[1] == "" && strings.HasPrefix(g.Payload[2], Payload_ref_prefix)
+}
+
 func (ctx *GossiperContext) Remove_Payload(g definition.Gossip_object) definition.Gossip_object {
+	if Is_stripped(g) {
+		return g
+	}
+	ref := Payload_ref_prefix + hex.EncodeToString(PayloadHash(g))
 	g.Payload[1] = ""
-	g.Payload[2] = ""
+	g.Payload[2] = ref
 	return g
 }
 
+// payload hash a stripped object refers to
+func Payload_ref(g definition.Gossip_object) []byte {
+	hash, _ := hex.DecodeString(strings.TrimPrefix(g.Payload[2], Payload_ref_prefix))
+	return hash
+}
+
+// ReconstructPayload restores the payload of a stripped object, the payload is empty if it is not known here
 func (ctx *GossiperContext) ReconstructPayload(g definition.Gossip_object) definition.Gossip_object {
-	gid := g.GetID()
-	gid.Type = definition.REV_INIT
-	ctx.Gossip_object_storage.REV_PAYLOAD_LOCK.RLock()
-	var tbfpayload [3]string
-	tbfpayload = ctx.Gossip_object_storage.REV_PAYLOAD[gid].Payload
-	ctx.Gossip_object_storage.REV_PAYLOAD_LOCK.RUnlock()
-	g.Payload = tbfpayload
+	if !Is_stripped(g) {
+		return g
+	}
+	g.Payload = ctx.GetRequested(Payload_ref(g)).Payload
 	return g
 }
 
@@ -80,6 +99,12 @@ func (ctx *GossiperContext) Generate_Gossip_Object_FULL(g_list []definition.Goss
 }
 
 func (ctx *GossiperContext) Generate_CON_INIT(obj1 definition.Gossip_object, obj2 definition.Gossip_object) definition.Gossip_object {
+	return Generate_CON_INIT(obj1, obj2)
+}
+
+// the two objects are signed by the same entity, together they prove the conflict
+// monitors use it for the conflicts they find themselves
+func Generate_CON_INIT(obj1 definition.Gossip_object, obj2 definition.Gossip_object) definition.Gossip_object {
 	D2_POM := definition.Gossip_object{
 		Application: definition.CTNG_APPLICATION,
 		Type:        definition.CON_INIT,
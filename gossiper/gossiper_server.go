@@ -32,11 +32,19 @@ func handleRequests(c *GossiperContext) {
 	gorillaRouter.HandleFunc("/gossip/rev_init", bindContext(c, Gossip_object_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/acc_init", bindContext(c, Gossip_object_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/con_init", bindContext(c, Gossip_object_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/ckp_init", bindContext(c, Gossip_object_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/sth_frag", bindContext(c, Gossip_object_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/rev_frag", bindContext(c, Gossip_object_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/acc_frag", bindContext(c, Gossip_object_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/ckp_frag", bindContext(c, Gossip_object_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/sth_full", bindContext(c, Gossip_object_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/rev_full", bindContext(c, Gossip_object_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/acc_full", bindContext(c, Gossip_object_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/ckp_full", bindContext(c, Gossip_object_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/new_payload_request", bindContext(c, Gossip_request_handler)).Methods("POST")
 	gorillaRouter.HandleFunc("/gossip/new_payload_notification", bindContext(c, Gossip_notification_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/digest", bindContext(c, Gossip_digest_handler)).Methods("POST")
+	gorillaRouter.HandleFunc("/gossip/pull", bindContext(c, Gossip_pull_handler)).Methods("POST")
 	// Start the HTTP server.
 	http.Handle("/", gorillaRouter)
 	fmt.Println(util.BLUE+"Listening on port:", c.Gossiper_private_config.Port, util.RESET)
@@ -59,40 +67,35 @@ func Gossip_notification_handler(c *GossiperContext, w http.ResponseWriter, r *h
 	c.Counter1_lock.Lock()
 	c.Total_traffic_received += int(bytecount)
 	c.Counter1_lock.Unlock()
-	newID := definition.Gossip_ID{
-		Period:     notification.Period,
-		Type:       notification.Type,
-		Entity_URL: notification.Entity_URL,
-	}
-	//fmt.Println(util.BLUE+"Received notification from "+notification.Sender+".", util.RESET)
-	//fmt.Println("notification received: ", notification)
-	//fmt.Println("GossipID Parsed: ", newID)
 	//fmt.Println(util.BLUE+"Received notification from "+notification.Sender+".", util.RESET)
-	if c.SearchPayload(newID, notification.Objhash) == false {
-		url := notification.Sender
-		dstendpoint := "/gossip/new_payload_request"
-		notification.Sender = c.Gossiper_crypto_config.SelfID.String()
-		msg, _ := json.Marshal(notification)
-		c.Counter2_lock.Lock()
-		c.Total_traffic_sent += len(msg)
-		c.Counter2_lock.Unlock()
-		resp, err := c.Client.Post("http://"+url+dstendpoint, "application/json", bytes.NewBuffer(msg))
-		if err != nil {
-			if strings.Contains(err.Error(), "Client.Timeout") ||
-				strings.Contains(err.Error(), "connection refused") {
-				fmt.Println(util.RED+"Connection failed to "+url+"."+" Error message: ", err, util.RESET)
-			} else {
-				fmt.Println(util.RED+err.Error(), "sending to "+url+".", util.RESET)
-			}
-			return
-		}
-		defer func() {
-			if resp != nil && resp.Body != nil {
-				resp.Body.Close()
-			}
-		}()
+	if c.SearchPayload(notification.Objhash) == false {
+		c.Request_payload(notification.Sender, notification)
 	}
+}
 
+// Request_payload asks url to deliver the object of a payload hash
+func (c *GossiperContext) Request_payload(url string, notification Gossip_Notification) {
+	dstendpoint := "/gossip/new_payload_request"
+	notification.Sender = c.Gossiper_crypto_config.SelfID.String()
+	msg, _ := json.Marshal(notification)
+	c.Counter2_lock.Lock()
+	c.Total_traffic_sent += len(msg)
+	c.Counter2_lock.Unlock()
+	resp, err := c.Client.Post("http://"+url+dstendpoint, "application/json", bytes.NewBuffer(msg))
+	if err != nil {
+		if strings.Contains(err.Error(), "Client.Timeout") ||
+			strings.Contains(err.Error(), "connection refused") {
+			fmt.Println(util.RED+"Connection failed to "+url+"."+" Error message: ", err, util.RESET)
+		} else {
+			fmt.Println(util.RED+err.Error(), "sending to "+url+".", util.RESET)
+		}
+		return
+	}
+	defer func() {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+	}()
 }
 
 func Gossip_request_handler(c *GossiperContext, w http.ResponseWriter, r *http.Request) {
@@ -107,18 +110,12 @@ func Gossip_request_handler(c *GossiperContext, w http.ResponseWriter, r *http.R
 	c.Counter1_lock.Lock()
 	c.Total_traffic_received += int(bytecount)
 	c.Counter1_lock.Unlock()
-	newID := definition.Gossip_ID{
-		Period:     notification.Period,
-		Type:       notification.Type,
-		Entity_URL: notification.Entity_URL,
-	}
-	obj := c.GetREVrequested(newID)
+	obj := c.GetRequested(notification.Objhash)
 	//fmt.Println(util.BLUE+"Received request from "+notification.Sender+".", util.RESET)
-	//fmt.Println("request received: ", notification)
-	//fmt.Println("GossipID Parsed: ", newID)
 	//fmt.Println("Object Payload found: ", obj.Payload)
 	if obj.Payload[0] != "" {
-		dstendpoint := "/gossip/rev_init"
+		// the object is delivered whole, like any gossip of its type
+		dstendpoint := Gossip_endpoint(obj.Type)
 		msg, _ := json.Marshal(obj)
 		c.Counter2_lock.Lock()
 		c.Total_traffic_sent += len(msg)
@@ -157,23 +154,34 @@ func Gossip_object_handler(c *GossiperContext, w http.ResponseWriter, r *http.Re
 	c.Counter1_lock.Lock()
 	c.Total_traffic_received += int(bytecount)
 	c.Counter1_lock.Unlock()
-	if bytecount > int64(c.Optimization_threshold) && gossip_obj.Type == definition.REV_INIT {
-		c.SavePayload(gossip_obj)
-	}
-	if c.Optimization_mode == true && (gossip_obj.Type == definition.REV_FRAG) {
-		gossip_obj = c.ReconstructPayload(gossip_obj)
+	// invalid objects are dropped before they are stored or counted
+	sender := sender_host(util.GetSenderURL(r))
+	gossip_obj, err = c.Validate_gossip_object(gossip_obj, r.URL.Path)
+	if errors.Is(err, ErrUnknownPayload) {
+		// the fragment was made from a payload that has not reached us yet, it is handled once the payload arrives
+		if c.Hold_fragment(sender, gossip_obj) {
+			// ask its signer for the payload
+			go c.Request_payload(gossip_obj.Signer, Gossip_Notification{
+				Period:     gossip_obj.Period,
+				Type:       gossip_obj.Type,
+				Entity_URL: gossip_obj.Payload[0],
+				Objhash:    Payload_ref(gossip_obj),
+			})
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
 	}
-	// Verify the object is valid, if invalid we just ignore it
-	// CON do not have a signature on it yet
-	/*
-		err = gossip_obj.Verify(c.Gossiper_crypto_config)
-		if err != nil {
-			//fmt.Println("Received invalid object "+TypeString(gossip_obj.Type)+" from " + util.GetSenderURL(r) + ".")
-			fmt.Println(util.RED, "Received invalid object "+definition.TypeString(gossip_obj.Type)+" signed by "+gossip_obj.Signer+".", util.RESET)
-			http.Error(w, err.Error(), http.StatusOK)
+	c.Score_sender(sender, err)
+	if err != nil {
+		fmt.Println(util.RED, "Rejected object "+definition.TypeString(gossip_obj.Type)+" from "+sender+": "+err.Error(), util.RESET)
+		var ingressErr *IngressError
+		if errors.As(err, &ingressErr) && ingressErr.Stage == Stage_signer {
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
-	*/
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	Handle_Gossip_object(c, gossip_obj)
 }
 
@@ -191,6 +199,11 @@ func Handle_Gossip_object(c *GossiperContext, gossip_obj definition.Gossip_objec
 	if c.InBlacklistPerm(gossip_obj.Payload[0]) {
 		return
 	}
+	if c.Optimization_mode {
+		c.store_payload(gossip_obj)
+		// fragments made from this payload are handled after it
+		defer c.Release_fragments(gossip_obj)
+	}
 	switch gossip_obj.Type {
 	case definition.STH_INIT:
 		Handle_STH_INIT(c, gossip_obj)
@@ -200,9 +213,11 @@ func Handle_Gossip_object(c *GossiperContext, gossip_obj definition.Gossip_objec
 		Handle_ACC_INIT(c, gossip_obj)
 	case definition.CON_INIT:
 		Handle_CON_INIT(c, gossip_obj)
-	case definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG:
+	case definition.CKP_INIT:
+		Handle_CKP_INIT(c, gossip_obj)
+	case definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG, definition.CKP_FRAG:
 		Handle_OBJ_FRAG(c, gossip_obj)
-	case definition.STH_FULL, definition.REV_FULL, definition.ACC_FULL:
+	case definition.STH_FULL, definition.REV_FULL, definition.ACC_FULL, definition.CKP_FULL:
 		Handle_OBJ_FULL(c, gossip_obj)
 	}
 }
@@ -291,6 +306,45 @@ func Handle_REV_INIT(c *GossiperContext, gossip_obj definition.Gossip_object) {
 	return
 }
 
+// checkpoints are certified like REVs, a CA signing two checkpoints for the same period gets a conflict PoM
+func Handle_CKP_INIT(c *GossiperContext, gossip_obj definition.Gossip_object) {
+	icount, _ := c.GetItemCount(gossip_obj.GetID(), definition.CKP_FULL)
+	if icount > 0 {
+		// we already have the full object, we just ignore the init
+		return
+	}
+	icount, _ = c.GetItemCount(gossip_obj.GetID(), definition.CKP_FRAG)
+	if icount >= c.Gossiper_crypto_config.Threshold {
+		// we already have enough fragments, we just ignore the init
+		return
+	}
+	//check Malicious
+	if c.IsMalicious(gossip_obj) {
+		obj_1 := c.GetObject(gossip_obj.GetID(), gossip_obj.Type)
+		obj_2 := gossip_obj
+		CON := c.Generate_CON_INIT(obj_1, obj_2)
+		Handle_Gossip_object(c, CON)
+		return
+	}
+	proceed := c.Store(gossip_obj)
+	if !proceed {
+		return
+	}
+	c.Send_to_Gossipers(gossip_obj)
+	// also send to the monitor
+	c.Send_to_Monitor(gossip_obj)
+	// wait and sign the object
+	f := func() {
+		if c.InBlacklist(gossip_obj.Payload[0]) {
+			return
+		}
+		CKP_FRAG := c.Generate_Gossip_Object_FRAG(gossip_obj)
+		Handle_Gossip_object(c, CKP_FRAG)
+	}
+	time.AfterFunc(time.Duration(c.Gossiper_public_config.Gossip_wait_time)*time.Second, f)
+	return
+}
+
 func Handle_ACC_INIT(c *GossiperContext, gossip_obj definition.Gossip_object) {
 	icount, _ := c.GetItemCount(gossip_obj.GetID(), definition.ACC_FULL)
 	if icount > 0 {
@@ -329,15 +383,10 @@ func Handle_CON_INIT(c *GossiperContext, gossip_obj definition.Gossip_object) {
 }
 
 func Handle_OBJ_FRAG(c *GossiperContext, gossip_obj definition.Gossip_object) {
-	icount := 0
-	switch gossip_obj.Type {
-	case definition.STH_FRAG:
-		icount, _ = c.GetItemCount(gossip_obj.GetID(), definition.STH_FULL)
-	case definition.REV_FRAG:
-		icount, _ = c.GetItemCount(gossip_obj.GetID(), definition.REV_FULL)
-	case definition.ACC_FRAG:
-		icount, _ = c.GetItemCount(gossip_obj.GetID(), definition.ACC_FULL)
-	}
+	// full objects are stored under their own type
+	full_id := gossip_obj.GetID()
+	full_id.Type = gossip_obj.GetTargetType()
+	icount, _ := c.GetItemCount(full_id, full_id.Type)
 	if icount > 0 {
 		// we already have the full object, we just ignore the fragment
 		fmt.Println(util.BLUE, "Received a fragment for a full object.", util.RESET)
@@ -345,7 +394,7 @@ func Handle_OBJ_FRAG(c *GossiperContext, gossip_obj definition.Gossip_object) {
 	}
 	itemcount := 0
 	switch gossip_obj.Type {
-	case definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG:
+	case definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG, definition.CKP_FRAG:
 		itemcount = c.Read_and_Store_If_Needed(gossip_obj)
 	}
 	//fmt.Println(itemcount)
@@ -357,19 +406,20 @@ func Handle_OBJ_FRAG(c *GossiperContext, gossip_obj definition.Gossip_object) {
 		Handle_Gossip_object(c, obj)
 	}
 	if itemcount < c.Gossiper_crypto_config.Threshold {
+		c.Journal_object(gossip_obj)
 		c.Send_to_Gossipers(gossip_obj)
 	}
 	return
 }
 
 func Handle_OBJ_FULL(c *GossiperContext, gossip_obj definition.Gossip_object) {
-	if c.InBlacklist(gossip_obj.Payload[0]) && (gossip_obj.Type == definition.STH_FULL || gossip_obj.Type == definition.REV_FULL || gossip_obj.Type == definition.ACC_FULL) {
+	if c.InBlacklist(gossip_obj.Payload[0]) && (gossip_obj.Type == definition.STH_FULL || gossip_obj.Type == definition.REV_FULL || gossip_obj.Type == definition.ACC_FULL || gossip_obj.Type == definition.CKP_FULL) {
 		return
 	}
-	icount, _ := c.GetItemCount(gossip_obj.GetID(), gossip_obj.Type)
-	if icount == 0 {
-		c.Store(gossip_obj)
+	// a full object is passed on once, so gossipers that missed fragments still converge
+	if c.Store(gossip_obj) {
 		c.Send_to_Monitor(gossip_obj)
+		c.Send_to_Gossipers(gossip_obj)
 	}
 	if c.IsConvergent() {
 		c.Converge_time = util.GetCurrentSecond()
@@ -446,59 +496,48 @@ func Send_obj_to_Gossipers(c *GossiperContext, gossip_obj definition.Gossip_obje
 }
 */
 
+// endpoint of the gossipers receiving objects of type t
+func Gossip_endpoint(t string) string {
+	for endpoint, endpoint_type := range Gossip_endpoint_types {
+		if endpoint_type == t {
+			return endpoint
+		}
+	}
+	return ""
+}
+
 func Send_obj_to_Gossipers(c *GossiperContext, gossip_obj definition.Gossip_object) error {
 	msg, err := json.Marshal(gossip_obj)
 	if err != nil {
 		panic(err)
 	}
-	dstendpoint := ""
+	dstendpoint := Gossip_endpoint(gossip_obj.Type)
 	bytecount := len(msg)
-	if bytecount > c.Optimization_threshold && (gossip_obj.Type == definition.REV_INIT) {
-		//fmt.Println("Optimization threshold reached")
-		var notification Gossip_Notification
-		GID := gossip_obj.GetID()
-		notification.Sender = c.Gossiper_crypto_config.SelfID.String()
-		notification.Period = GID.Period
-		notification.Type = GID.Type
-		notification.Entity_URL = GID.Entity_URL
-		notification.Objhash = ComputeobjHash(gossip_obj)
-		msg, _ = json.Marshal(notification)
-		bytecount = len(msg)
-		c.Counter2_lock.Lock()
-		c.Total_traffic_sent += bytecount * len(c.Gossiper_private_config.Connected_Gossipers)
-		c.Counter2_lock.Unlock()
-		dstendpoint = "/gossip/new_payload_notification"
-	} else {
-		if bytecount > c.Optimization_threshold && (gossip_obj.Type == definition.REV_FRAG) {
-			gossip_obj := c.Remove_Payload(gossip_obj)
-			msg, _ = json.Marshal(gossip_obj)
-			bytecount = len(msg)
-		}
-		c.Counter2_lock.Lock()
-		c.Total_traffic_sent += bytecount * len(c.Gossiper_private_config.Connected_Gossipers)
-		c.Counter2_lock.Unlock()
-		switch gossip_obj.Type {
-		case definition.STH_INIT:
-			dstendpoint = "/gossip/sth_init"
-		case definition.REV_INIT:
-			dstendpoint = "/gossip/rev_init"
-		case definition.ACC_INIT:
-			dstendpoint = "/gossip/acc_init"
-		case definition.CON_INIT:
-			dstendpoint = "/gossip/con_init"
-		case definition.STH_FRAG:
-			dstendpoint = "/gossip/sth_frag"
-		case definition.REV_FRAG:
-			dstendpoint = "/gossip/rev_frag"
-		case definition.ACC_FRAG:
-			dstendpoint = "/gossip/acc_frag"
-		case definition.STH_FULL:
-			dstendpoint = "/gossip/sth_full"
-		case definition.REV_FULL:
-			dstendpoint = "/gossip/rev_full"
-		case definition.ACC_FULL:
-			dstendpoint = "/gossip/acc_full"
+	if c.Optimization_mode && bytecount > c.Optimization_threshold && !Is_stripped(gossip_obj) {
+		switch {
+		case is_init(gossip_obj.Type):
+			// INIT objects are announced, the gossipers that do not have the payload request the object
+			notification := Gossip_Notification{
+				Sender:     c.Gossiper_crypto_config.SelfID.String(),
+				Period:     gossip_obj.Period,
+				Type:       gossip_obj.Type,
+				Entity_URL: gossip_obj.Payload[0],
+				Objhash:    PayloadHash(gossip_obj),
+			}
+			msg, _ = json.Marshal(notification)
+			dstendpoint = "/gossip/new_payload_notification"
+		case is_frag(gossip_obj.Type):
+			// fragments follow the INIT they are made from, they are sent without its payload
+			// full objects are sent whole, so a gossiper that missed the INIT still converges from them
+			msg, _ = json.Marshal(c.Remove_Payload(gossip_obj))
 		}
+		bytecount = len(msg)
+	}
+	c.Counter2_lock.Lock()
+	c.Total_traffic_sent += bytecount * len(c.Gossiper_private_config.Connected_Gossipers)
+	c.Counter2_lock.Unlock()
+	if dstendpoint == "" {
+		return errors.New(definition.Invalid_Type)
 	}
 	for _, url := range c.Gossiper_private_config.Connected_Gossipers {
 		go func(url, dstendpoint string) {
@@ -579,9 +618,6 @@ func StartGossiperServer(c *GossiperContext) {
 	// Check if the storage file exists in this directory
 	//InitializeGossiperStorage(c)
 	// Create the http client to be used.
-	time_wait := util.Getwaitingtime(c.Gossiper_public_config.MMD)
-	fmt.Println("Waiting for ", time_wait, " seconds")
-	time.Sleep(time.Duration(time_wait) * time.Second)
 	tr := &http.Transport{
 		MaxIdleConnsPerHost: 300,
 		MaxConnsPerHost:     300,
@@ -591,7 +627,17 @@ func StartGossiperServer(c *GossiperContext) {
 	c.Client = &http.Client{
 		Transport: tr,
 	}
+	// restore what was accepted before a restart, and sign what was left unsigned
+	if err := c.Open_journal(); err != nil {
+		fmt.Println(util.RED+"Error opening gossiper journal: "+err.Error(), util.RESET)
+	} else {
+		c.Resume_fragments()
+	}
+	time_wait := util.Getwaitingtime(c.Gossiper_public_config.MMD)
+	fmt.Println("Waiting for ", time_wait, " seconds")
+	time.Sleep(time.Duration(time_wait) * time.Second)
 	// HTTP Server Loop
 	go PeriodicTasks(c)
+	go AntiEntropyTasks(c)
 	handleRequests(c)
 }
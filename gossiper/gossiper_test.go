@@ -3,11 +3,22 @@ package gossiper
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/util"
+
+	"github.com/gorilla/mux"
 )
 
 // This function tests
@@ -265,9 +276,9 @@ func TestFragHandler(t *testing.T) {
 	//REV_FRAG_1 := ctx_g1.Generate_Gossip_Object_FRAG(REV_INIT_1)
 	REV_FRAG_2 := ctx_g2.Generate_Gossip_Object_FRAG(REV_INIT_1)
 	fmt.Println(REV_FRAG_2.Verify(ctx_g2.Gossiper_crypto_config))
-	fmt.Println(ctx_g2.SearchPayload(REV_INIT_1.GetID(), ComputeobjHash(REV_INIT_1)))
+	fmt.Println(ctx_g2.SearchPayload(PayloadHash(REV_INIT_1)))
 	ctx_g2.SavePayload(REV_INIT_1)
-	hashbytes := ComputeobjHash(REV_INIT_1)
+	hashbytes := PayloadHash(REV_INIT_1)
 	newnotification := Gossip_Notification{
 		Sender:     "1",
 		Period:     "1",
@@ -275,26 +286,15 @@ func TestFragHandler(t *testing.T) {
 		Entity_URL: "1",
 		Objhash:    hashbytes,
 	}
-	newid := definition.Gossip_ID{
-		Period:     newnotification.Period,
-		Type:       newnotification.Type,
-		Entity_URL: newnotification.Entity_URL,
-	}
 	var reconnotification Gossip_Notification
 	newnotification_json, _ := json.Marshal(newnotification)
 	r := bytes.NewReader(newnotification_json)
 	json.NewDecoder(r).Decode(&reconnotification)
 	reconhash := reconnotification.Objhash
-	reconid := definition.Gossip_ID{
-		Period:     reconnotification.Period,
-		Type:       reconnotification.Type,
-		Entity_URL: reconnotification.Entity_URL,
-	}
 
-	fmt.Println(ctx_g2.SearchPayload(REV_INIT_1.GetID(), ComputeobjHash(REV_INIT_1)))
-	fmt.Println(ctx_g2.SearchPayload(newid, newnotification.Objhash))
-	fmt.Println(ctx_g2.SearchPayload(reconid, newnotification.Objhash))
-	fmt.Println(ctx_g2.SearchPayload(reconid, reconhash))
+	fmt.Println(ctx_g2.SearchPayload(PayloadHash(REV_INIT_1)))
+	fmt.Println(ctx_g2.SearchPayload(newnotification.Objhash))
+	fmt.Println(ctx_g2.SearchPayload(reconhash))
 	fmt.Println(bytes.Equal(newnotification.Objhash, reconhash))
 	fmt.Println([]byte(newnotification.Objhash))
 	fmt.Println([]byte(reconhash))
@@ -332,3 +332,437 @@ func TestFragHandler(t *testing.T) {
 		return
 	}
 }
+
+func TestIngressValidation(t *testing.T) {
+	ctx_g1 := InitializeGossiperContext("testFiles/gossiper_testconfig/1/Gossiper_public_config.json", "testFiles/gossiper_testconfig/1/Gossiper_private_config.json", "testFiles/gossiper_testconfig/1/Gossiper_crypto_config.json", "1")
+	ctx_g2 := InitializeGossiperContext("testFiles/gossiper_testconfig/2/Gossiper_public_config.json", "testFiles/gossiper_testconfig/2/Gossiper_private_config.json", "testFiles/gossiper_testconfig/2/Gossiper_crypto_config.json", "2")
+	ctx_g3 := InitializeGossiperContext("testFiles/gossiper_testconfig/3/Gossiper_public_config.json", "testFiles/gossiper_testconfig/3/Gossiper_private_config.json", "testFiles/gossiper_testconfig/3/Gossiper_crypto_config.json", "3")
+	STH_INIT_1 := definition.Gossip_object{
+		Application: definition.CTNG_APPLICATION,
+		Period:      util.GetCurrentPeriod(),
+		Type:        definition.STH_INIT,
+		Signer:      "localhost:8180",
+		Signature:   [2]string{"1"},
+		Timestamp:   "1",
+		Payload:     [3]string{"localhost:9000", "sth", ""},
+	}
+	STH_FRAG_2 := ctx_g2.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	STH_FRAG_3 := ctx_g3.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	if _, err := ctx_g1.Validate_gossip_object(STH_FRAG_2, "/gossip/sth_frag"); err != nil {
+		t.Fatal(err)
+	}
+	post := func(endpoint string, g definition.Gossip_object) int {
+		msg, _ := json.Marshal(g)
+		req := httptest.NewRequest("POST", endpoint, bytes.NewReader(msg))
+		w := httptest.NewRecorder()
+		Gossip_object_handler(ctx_g1, w, req)
+		return w.Code
+	}
+	stage := func(g definition.Gossip_object, endpoint string) string {
+		_, err := ctx_g1.Validate_gossip_object(g, endpoint)
+		var ingressErr *IngressError
+		if !errors.As(err, &ingressErr) {
+			return ""
+		}
+		return ingressErr.Stage
+	}
+	// a fragment signed over another payload
+	forged := STH_FRAG_2
+	forged.Payload[1] = "forged sth"
+	if s := stage(forged, "/gossip/sth_frag"); s != Stage_signature {
+		t.Error("forged fragment failed at", s)
+	}
+	if code := post("/gossip/sth_frag", forged); code != http.StatusBadRequest {
+		t.Error("forged fragment answered with", code)
+	}
+	if s := stage(STH_FRAG_2, "/gossip/rev_frag"); s != Stage_type {
+		t.Error("fragment on the wrong endpoint failed at", s)
+	}
+	unknown := STH_FRAG_2
+	unknown.Signer = "localhost:7000"
+	if code := post("/gossip/sth_frag", unknown); code != http.StatusForbidden {
+		t.Error("fragment of an unknown gossiper answered with", code)
+	}
+	stale := STH_INIT_1
+	p, _ := strconv.Atoi(util.GetCurrentPeriod())
+	stale.Period = strconv.Itoa((p + 30) % 60)
+	if s := stage(ctx_g2.Generate_Gossip_Object_FRAG(stale), "/gossip/sth_frag"); s != Stage_freshness {
+		t.Error("stale fragment failed at", s)
+	}
+	missing := STH_FRAG_2
+	missing.Application = ""
+	if s := stage(missing, "/gossip/sth_frag"); s != Stage_schema {
+		t.Error("fragment without application failed at", s)
+	}
+	// a stripped REV_FRAG without a known payload cannot be verified
+	rev := STH_INIT_1
+	rev.Type = definition.REV_INIT
+	rev_frag := ctx_g2.Remove_Payload(ctx_g2.Generate_Gossip_Object_FRAG(rev))
+	if s := stage(rev_frag, "/gossip/rev_frag"); s != Stage_payload {
+		t.Error("REV_FRAG without payload failed at", s)
+	}
+	if ctx_g1.GetIngressFailures(Stage_signature) != 1 || ctx_g1.GetIngressFailures(Stage_signer) != 1 {
+		t.Error("ingress failures not counted", ctx_g1.Ingress_failures)
+	}
+	score := ctx_g1.GetSenderScore("192.0.2.1")
+	if score.Rejected != 2 || score.Accepted != 0 {
+		t.Error("sender not scored", score)
+	}
+	// rejected fragments are never stored
+	if count := len(ctx_g1.GetObjectList(STH_FRAG_2.GetID(), definition.STH_FRAG)); count != 0 {
+		t.Error("rejected fragments stored", count)
+	}
+	// a gossiper counts once towards the threshold
+	if ctx_g1.Read_and_Store_If_Needed(STH_FRAG_2) != 0 {
+		t.Error("first fragment already counted")
+	}
+	if ctx_g1.Read_and_Store_If_Needed(STH_FRAG_2) != ctx_g1.Gossiper_crypto_config.Threshold {
+		t.Error("second fragment of the same gossiper counted")
+	}
+	if ctx_g1.Read_and_Store_If_Needed(STH_FRAG_3) != 1 {
+		t.Error("fragment of another gossiper not counted")
+	}
+}
+
+func TestFullHandler(t *testing.T) {
+	ctx_g1 := InitializeGossiperContext("testFiles/gossiper_testconfig/1/Gossiper_public_config.json", "testFiles/gossiper_testconfig/1/Gossiper_private_config.json", "testFiles/gossiper_testconfig/1/Gossiper_crypto_config.json", "1")
+	ctx_g2 := InitializeGossiperContext("testFiles/gossiper_testconfig/2/Gossiper_public_config.json", "testFiles/gossiper_testconfig/2/Gossiper_private_config.json", "testFiles/gossiper_testconfig/2/Gossiper_crypto_config.json", "2")
+	ctx_g3 := InitializeGossiperContext("testFiles/gossiper_testconfig/3/Gossiper_public_config.json", "testFiles/gossiper_testconfig/3/Gossiper_private_config.json", "testFiles/gossiper_testconfig/3/Gossiper_crypto_config.json", "3")
+	ctx_g1.Max_latency = 0
+	STH_INIT_1 := definition.Gossip_object{
+		Application: definition.CTNG_APPLICATION,
+		Period:      util.GetCurrentPeriod(),
+		Type:        definition.STH_INIT,
+		Signer:      "localhost:8180",
+		Signature:   [2]string{"1"},
+		Timestamp:   "1",
+		Payload:     [3]string{"localhost:9000", "sth", ""},
+	}
+	STH_FRAG_2 := ctx_g2.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	STH_FRAG_3 := ctx_g3.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	STH_FULL_1 := ctx_g2.Generate_Gossip_Object_FULL([]definition.Gossip_object{STH_FRAG_2, STH_FRAG_3}, definition.STH_FULL)
+	post := func(g definition.Gossip_object) int {
+		msg, _ := json.Marshal(g)
+		req := httptest.NewRequest("POST", "/gossip/sth_full", bytes.NewReader(msg))
+		w := httptest.NewRecorder()
+		Gossip_object_handler(ctx_g1, w, req)
+		return w.Code
+	}
+	// a full object aggregated from a single fragment, claiming two signers
+	frag, _ := crypto.SigFragmentFromString(STH_FRAG_2.Signature[0])
+	single, _ := crypto.ThresholdAggregate([]crypto.SigFragment{frag}, 1)
+	forged := STH_FULL_1
+	forged.Signature[0], _ = single.String()
+	if code := post(forged); code != http.StatusBadRequest {
+		t.Error("full object of one fragment answered with", code)
+	}
+	relabeled := STH_FULL_1
+	relabeled.Signers = []string{STH_FRAG_2.Signer, "localhost:8083"}
+	if code := post(relabeled); code != http.StatusBadRequest {
+		t.Error("full object with other signers answered with", code)
+	}
+	if count, _ := ctx_g1.GetItemCount(STH_FULL_1.GetID(), definition.STH_FULL); count != 0 {
+		t.Fatal("invalid full object stored")
+	}
+	// ctx_g1 has none of the fragments, the full object alone is enough
+	if code := post(STH_FULL_1); code != http.StatusOK {
+		t.Error("full object answered with", code)
+	}
+	if count, _ := ctx_g1.GetItemCount(STH_FULL_1.GetID(), definition.STH_FULL); count != 1 {
+		t.Error("full object not stored")
+	}
+	if ctx_g1.Store(STH_FULL_1) {
+		t.Error("second full object of the same ID stored")
+	}
+	// fragments of a converged object are not counted anymore
+	Handle_Gossip_object(ctx_g1, STH_FRAG_2)
+	if count := len(ctx_g1.GetObjectList(STH_FRAG_2.GetID(), definition.STH_FRAG)); count != 0 {
+		t.Error("fragment stored after the full object", count)
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	ctx_g1 := InitializeGossiperContext("testFiles/gossiper_testconfig/1/Gossiper_public_config.json", "testFiles/gossiper_testconfig/1/Gossiper_private_config.json", "testFiles/gossiper_testconfig/1/Gossiper_crypto_config.json", "1")
+	ctx_g2 := InitializeGossiperContext("testFiles/gossiper_testconfig/2/Gossiper_public_config.json", "testFiles/gossiper_testconfig/2/Gossiper_private_config.json", "testFiles/gossiper_testconfig/2/Gossiper_crypto_config.json", "2")
+	ctx_g3 := InitializeGossiperContext("testFiles/gossiper_testconfig/3/Gossiper_public_config.json", "testFiles/gossiper_testconfig/3/Gossiper_private_config.json", "testFiles/gossiper_testconfig/3/Gossiper_crypto_config.json", "3")
+	ctx_g1.Max_latency = 0
+	STH_INIT_1 := definition.Gossip_object{
+		Application: definition.CTNG_APPLICATION,
+		Period:      util.GetCurrentPeriod(),
+		Type:        definition.STH_INIT,
+		Signer:      "localhost:8180",
+		Signature:   [2]string{"1"},
+		Timestamp:   "1",
+		Payload:     [3]string{"localhost:9000", "sth", ""},
+	}
+	STH_FRAG_2 := ctx_g2.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	STH_FRAG_3 := ctx_g3.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	STH_FULL_1 := ctx_g2.Generate_Gossip_Object_FULL([]definition.Gossip_object{STH_FRAG_2, STH_FRAG_3}, definition.STH_FULL)
+	// ctx_g2 holds the fragments and the full object, the pushes to ctx_g1 were lost
+	ctx_g2.Store(STH_FRAG_2)
+	ctx_g2.Store(STH_FRAG_3)
+	ctx_g2.Store(STH_FULL_1)
+	router := mux.NewRouter()
+	router.HandleFunc("/gossip/digest", bindContext(ctx_g2, Gossip_digest_handler)).Methods("POST")
+	router.HandleFunc("/gossip/pull", bindContext(ctx_g2, Gossip_pull_handler)).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := strings.TrimPrefix(server.URL, "http://")
+
+	missing := ctx_g1.Missing(ctx_g1.Digest(), ctx_g2.Digest())
+	if len(missing) != 3 {
+		t.Error("expected 3 missing objects, got", len(missing))
+	}
+	pulled, err := ctx_g1.Sync_with_gossiper(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pulled != 3 {
+		t.Error("expected 3 pulled objects, got", pulled)
+	}
+	if count, _ := ctx_g1.GetItemCount(STH_FULL_1.GetID(), definition.STH_FULL); count != 1 {
+		t.Error("full object not pulled")
+	}
+	if score := ctx_g1.GetSenderScore(url); score.Accepted != 3 || score.Rejected != 0 {
+		t.Error("pulled objects not scored", score)
+	}
+	// once converged there is nothing left to pull
+	pulled, err = ctx_g1.Sync_with_gossiper(url)
+	if err != nil || pulled != 0 {
+		t.Error("second sync pulled", pulled, err)
+	}
+	// another version of a held object is still missing so the conflict is found
+	other := digest_entry(url, STH_FULL_1)
+	other.Objhash = []byte("another version")
+	peer := Gossip_digest{Entries: map[string][]Gossip_Notification{definition.STH_FULL: {other}}}
+	if missing := ctx_g1.Missing(ctx_g1.Digest(), peer); len(missing) != 1 {
+		t.Error("other version of a held object not missing", missing)
+	}
+	// digests are only taken from gossipers
+	digest := ctx_g1.Digest()
+	digest.Sender = "localhost:7000"
+	msg, _ := json.Marshal(digest)
+	resp, err := http.Post(server.URL+"/gossip/digest", "application/json", bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("digest of an unknown gossiper answered with", resp.Status)
+	}
+}
+
+func TestPayloadOptimization(t *testing.T) {
+	ctx_g1 := InitializeGossiperContext("testFiles/gossiper_testconfig/1/Gossiper_public_config.json", "testFiles/gossiper_testconfig/1/Gossiper_private_config.json", "testFiles/gossiper_testconfig/1/Gossiper_crypto_config.json", "1")
+	ctx_g2 := InitializeGossiperContext("testFiles/gossiper_testconfig/2/Gossiper_public_config.json", "testFiles/gossiper_testconfig/2/Gossiper_private_config.json", "testFiles/gossiper_testconfig/2/Gossiper_crypto_config.json", "2")
+	ctx_g3 := InitializeGossiperContext("testFiles/gossiper_testconfig/3/Gossiper_public_config.json", "testFiles/gossiper_testconfig/3/Gossiper_private_config.json", "testFiles/gossiper_testconfig/3/Gossiper_crypto_config.json", "3")
+	ctx_g1.Max_latency = 0
+	STH_INIT_1 := definition.Gossip_object{
+		Application: definition.CTNG_APPLICATION,
+		Period:      util.GetCurrentPeriod(),
+		Type:        definition.STH_INIT,
+		Signer:      "localhost:8180",
+		Signature:   [2]string{"1"},
+		Timestamp:   "1",
+		Payload:     [3]string{"localhost:9000", "a large sth", ""},
+	}
+	STH_FRAG_2 := ctx_g2.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	STH_FRAG_3 := ctx_g3.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	STH_FULL_1 := ctx_g2.Generate_Gossip_Object_FULL([]definition.Gossip_object{STH_FRAG_2, STH_FRAG_3}, definition.STH_FULL)
+
+	// a stripped STH fragment is restored from the payload of the INIT it was made from
+	stripped := ctx_g2.Remove_Payload(STH_FRAG_2)
+	if !Is_stripped(stripped) || stripped.Payload[1] != "" {
+		t.Fatal("fragment not stripped", stripped.Payload)
+	}
+	if _, err := ctx_g1.Validate_gossip_object(stripped, "/gossip/sth_frag"); !errors.Is(err, ErrUnknownPayload) {
+		t.Error("stripped fragment accepted without its payload", err)
+	}
+	ctx_g1.store_payload(STH_INIT_1)
+	restored, err := ctx_g1.Validate_gossip_object(stripped, "/gossip/sth_frag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Payload != STH_FRAG_2.Payload {
+		t.Error("payload not restored", restored.Payload)
+	}
+	// full objects are always sent whole
+	if _, err := ctx_g1.Validate_gossip_object(ctx_g1.Remove_Payload(STH_FULL_1), "/gossip/sth_full"); err == nil {
+		t.Error("stripped full object accepted")
+	}
+	// a fragment that arrives before its payload waits for it and is not held against the sender
+	ctx_g3.Gossiper_private_config.Connected_Gossipers = []string{}
+	// fragments forged by another sender for the same signers do not push it out
+	ctx_g3.Max_pending = 2
+	for _, frag := range []definition.Gossip_object{STH_FRAG_2, STH_FRAG_3} {
+		forged := ctx_g3.Remove_Payload(frag)
+		forged.Signature[0] = "forged"
+		ctx_g3.Hold_fragment("10.0.0.1", forged)
+	}
+	other := stripped
+	other.Payload[2] = Payload_ref_prefix + "00"
+	if ctx_g3.Hold_fragment("10.0.0.1", other) || ctx_g3.Pending_count["10.0.0.1"] != 2 {
+		t.Error("more fragments held for a sender than allowed", ctx_g3.Pending_count)
+	}
+	w := httptest.NewRecorder()
+	msg, _ := json.Marshal(stripped)
+	req := httptest.NewRequest("POST", "/gossip/sth_frag", bytes.NewReader(msg))
+	req.RemoteAddr = "127.0.0.1:5000"
+	Gossip_object_handler(ctx_g3, w, req)
+	if w.Code != http.StatusAccepted {
+		t.Error("fragment without its payload answered with", w.Code)
+	}
+	if score := ctx_g3.GetSenderScore("127.0.0.1"); score.Rejected != 0 {
+		t.Error("sender scored for a payload it was not asked for", score)
+	}
+	Handle_Gossip_object(ctx_g3, STH_INIT_1)
+	if count, _ := ctx_g3.GetItemCount(STH_FRAG_2.GetID(), definition.STH_FRAG); count != 1 {
+		t.Error("held fragment not handled once its payload arrived, got", count)
+	}
+	if score := ctx_g3.GetSenderScore("127.0.0.1"); score.Accepted != 1 {
+		t.Error("held fragment not scored", score)
+	}
+	if score := ctx_g3.GetSenderScore("10.0.0.1"); score.Rejected != 2 {
+		t.Error("forged fragments not scored", score)
+	}
+
+	received := make(chan string, 4)
+	bodies := make(map[string][]byte)
+	lock := sync.Mutex{}
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		bodies[r.URL.Path] = body
+		lock.Unlock()
+		received <- r.URL.Path
+	}))
+	defer recorder.Close()
+	peer := strings.TrimPrefix(recorder.URL, "http://")
+	wait := func() string {
+		select {
+		case path := <-received:
+			return path
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing received")
+		}
+		return ""
+	}
+
+	// an INIT of any type is announced by its payload hash, a fragment is sent stripped
+	ctx_g1.Gossiper_private_config.Connected_Gossipers = []string{peer}
+	ctx_g1.Send_to_Gossipers(STH_INIT_1)
+	if path := wait(); path != "/gossip/new_payload_notification" {
+		t.Error("STH_INIT sent to", path)
+	}
+	var notification Gossip_Notification
+	json.Unmarshal(bodies["/gossip/new_payload_notification"], &notification)
+	if !bytes.Equal(notification.Objhash, PayloadHash(STH_INIT_1)) || notification.Sender != "localhost:8080" {
+		t.Error("wrong notification", notification)
+	}
+	ctx_g1.Send_to_Gossipers(STH_FRAG_2)
+	if path := wait(); path != "/gossip/sth_frag" {
+		t.Error("STH_FRAG sent to", path)
+	}
+	var sent definition.Gossip_object
+	json.Unmarshal(bodies["/gossip/sth_frag"], &sent)
+	if !Is_stripped(sent) {
+		t.Error("STH_FRAG sent with its payload")
+	}
+	ctx_g1.Send_to_Gossipers(STH_FULL_1)
+	if path := wait(); path != "/gossip/sth_full" {
+		t.Error("STH_FULL sent to", path)
+	}
+
+	// a request for the hash is answered with the object, on the endpoint of its type
+	notification.Sender = peer
+	msg, _ = json.Marshal(notification)
+	w = httptest.NewRecorder()
+	Gossip_request_handler(ctx_g1, w, httptest.NewRequest("POST", "/gossip/new_payload_request", bytes.NewReader(msg)))
+	if path := wait(); path != "/gossip/sth_init" {
+		t.Error("requested object delivered to", path)
+	}
+	var delivered definition.Gossip_object
+	json.Unmarshal(bodies["/gossip/sth_init"], &delivered)
+	if delivered.Payload != STH_INIT_1.Payload {
+		t.Error("wrong object delivered", delivered.Payload)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	journal := t.TempDir() + "/1_journal.jsonl"
+	ctx_g1 := InitializeGossiperContext("testFiles/gossiper_testconfig/1/Gossiper_public_config.json", "testFiles/gossiper_testconfig/1/Gossiper_private_config.json", "testFiles/gossiper_testconfig/1/Gossiper_crypto_config.json", "1")
+	ctx_g2 := InitializeGossiperContext("testFiles/gossiper_testconfig/2/Gossiper_public_config.json", "testFiles/gossiper_testconfig/2/Gossiper_private_config.json", "testFiles/gossiper_testconfig/2/Gossiper_crypto_config.json", "2")
+	ctx_g1.Max_latency = 0
+	ctx_g1.Journal_filepath = journal
+	if err := ctx_g1.Open_journal(); err != nil {
+		t.Fatal(err)
+	}
+	// INIT objects must be signed to be stored, the test configs hold no RSA secret keys
+	logger_key, _ := crypto.NewRSAPrivateKey()
+	trust_logger := func(c *GossiperContext) {
+		c.Gossiper_crypto_config.SignPublicMap = crypto.RSAPublicMap{"localhost:9000": logger_key.PublicKey, "localhost:9001": logger_key.PublicKey}
+	}
+	trust_logger(ctx_g1)
+	sign := func(payload [3]string) definition.Gossip_object {
+		sig, _ := crypto.RSASign([]byte(payload[0]+payload[1]+payload[2]), logger_key, crypto.CTngID(payload[0]))
+		return definition.Gossip_object{
+			Application: definition.CTNG_APPLICATION,
+			Period:      util.GetCurrentPeriod(),
+			Type:        definition.STH_INIT,
+			Signer:      payload[0],
+			Signature:   [2]string{sig.String()},
+			Timestamp:   "1",
+			Payload:     payload,
+		}
+	}
+	STH_INIT_1 := sign([3]string{"localhost:9000", "sth", ""})
+	STH_INIT_2 := sign([3]string{"localhost:9001", "sth 1", ""})
+	STH_INIT_3 := sign([3]string{"localhost:9001", "sth 2", ""})
+	STH_FRAG_2 := ctx_g2.Generate_Gossip_Object_FRAG(STH_INIT_1)
+	CON_1 := ctx_g1.Generate_CON_INIT(STH_INIT_2, STH_INIT_3)
+	ctx_g1.Store(STH_INIT_1)
+	Handle_Gossip_object(ctx_g1, STH_FRAG_2)
+	ctx_g1.Store(CON_1)
+	ctx_g1.Close_journal()
+
+	// the restarted gossiper has its objects and its blacklist back
+	restarted := InitializeGossiperContext("testFiles/gossiper_testconfig/1/Gossiper_public_config.json", "testFiles/gossiper_testconfig/1/Gossiper_private_config.json", "testFiles/gossiper_testconfig/1/Gossiper_crypto_config.json", "1")
+	restarted.Max_latency = 0
+	trust_logger(restarted)
+	restarted.Journal_filepath = journal
+	if err := restarted.Open_journal(); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := restarted.GetItemCount(STH_INIT_1.GetID(), definition.STH_INIT); count != 1 {
+		t.Error("STH_INIT not replayed")
+	}
+	frag_id := STH_FRAG_2.GetID()
+	if count := len(restarted.GetObjectList(frag_id, definition.STH_FRAG)); count != 1 {
+		t.Error("expected 1 replayed fragment, got", count)
+	}
+	if !restarted.InBlacklistPerm("localhost:9001") {
+		t.Error("blacklist not replayed")
+	}
+	// it signs the INIT it had not signed before the restart, which completes the threshold
+	restarted.Resume_fragments()
+	if count, _ := restarted.GetItemCount(definition.Gossip_ID{Period: frag_id.Period, Type: definition.STH_FULL, Entity_URL: frag_id.Entity_URL}, definition.STH_FULL); count != 1 {
+		t.Error("fragment of the restarted gossiper not counted")
+	}
+
+	// after the wipe only the PoMs and the blacklist are kept
+	restarted.WipeStorage()
+	restarted.Close_journal()
+	wiped := InitializeGossiperContext("testFiles/gossiper_testconfig/1/Gossiper_public_config.json", "testFiles/gossiper_testconfig/1/Gossiper_private_config.json", "testFiles/gossiper_testconfig/1/Gossiper_crypto_config.json", "1")
+	wiped.Journal_filepath = journal
+	trust_logger(wiped)
+	restored, err := wiped.Replay_journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 {
+		t.Error("expected only the CON_INIT after the wipe, got", restored)
+	}
+	if count, _ := wiped.GetItemCount(CON_1.GetID(), definition.CON_INIT); count != 1 || !wiped.InBlacklistPerm("localhost:9001") {
+		t.Error("PoM knowledge lost in the wipe")
+	}
+}
@@ -0,0 +1,244 @@
+package gossiper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/jik18001/CTngV2/crypto"
+	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/util"
+)
+
+// Validation of the gossip objects received from other gossipers and from the owner, before they are handled
+// The stages run in order and the first failure rejects the object, so an invalid fragment never counts towards the threshold
+
+const (
+	Stage_schema    = "schema"
+	Stage_type      = "type"
+	Stage_signer    = "signer"
+	Stage_freshness = "freshness"
+	Stage_payload   = "payload"
+	Stage_signature = "signature"
+)
+
+var (
+	ErrMissingField   = errors.New("missing field")
+	ErrWrongEndpoint  = errors.New("type not accepted on this endpoint")
+	ErrUnknownSigner  = errors.New("unknown signer")
+	ErrStalePeriod    = errors.New("period too far from the current period")
+	ErrUnknownPayload = errors.New("no payload to reconstruct the fragment from")
+)
+
+type IngressError struct {
+	Stage string
+	Err   error
+}
+
+func (e *IngressError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *IngressError) Unwrap() error {
+	return e.Err
+}
+
+func reject(stage string, err error) error {
+	return &IngressError{Stage: stage, Err: err}
+}
+
+// type of the objects accepted on each gossip endpoint
+var Gossip_endpoint_types = map[string]string{
+	"/gossip/sth_init": definition.STH_INIT,
+	"/gossip/rev_init": definition.REV_INIT,
+	"/gossip/acc_init": definition.ACC_INIT,
+	"/gossip/con_init": definition.CON_INIT,
+	"/gossip/ckp_init": definition.CKP_INIT,
+	"/gossip/sth_frag": definition.STH_FRAG,
+	"/gossip/rev_frag": definition.REV_FRAG,
+	"/gossip/acc_frag": definition.ACC_FRAG,
+	"/gossip/ckp_frag": definition.CKP_FRAG,
+	"/gossip/sth_full": definition.STH_FULL,
+	"/gossip/rev_full": definition.REV_FULL,
+	"/gossip/acc_full": definition.ACC_FULL,
+	"/gossip/ckp_full": definition.CKP_FULL,
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// an INIT is signed by a monitor of Signer_URLs, or by the logger or CA it comes from, which must have a key in the crypto config
+func (c *GossiperContext) known_signer(signer string) bool {
+	if contains(c.Gossiper_public_config.Signer_URLs, signer) {
+		return true
+	}
+	_, ok := c.Gossiper_crypto_config.SignPublicMap[crypto.CTngID(signer)]
+	return ok
+}
+
+func (c *GossiperContext) known_gossiper(gossiper string) bool {
+	return contains(c.Gossiper_public_config.Gossiper_URLs, gossiper)
+}
+
+// periods are the minutes of the hour, the distance wraps around
+func period_distance(a int, b int) int {
+	d := (a - b) % 60
+	if d < 0 {
+		d = -d
+	}
+	if d > 30 {
+		d = 60 - d
+	}
+	return d
+}
+
+func check_schema(g definition.Gossip_object) error {
+	if g.Application != definition.CTNG_APPLICATION {
+		return fmt.Errorf("%w: application %q", ErrMissingField, g.Application)
+	}
+	if g.Payload[0] == "" {
+		return fmt.Errorf("%w: payload", ErrMissingField)
+	}
+	if _, err := strconv.Atoi(g.Period); err != nil {
+		return fmt.Errorf("%w: period %q", ErrMissingField, g.Period)
+	}
+	if g.Signature[0] == "" {
+		return fmt.Errorf("%w: signature", ErrMissingField)
+	}
+	switch g.Type {
+	case definition.STH_INIT, definition.REV_INIT, definition.ACC_INIT, definition.CKP_INIT,
+		definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG, definition.CKP_FRAG:
+		if g.Signer == "" {
+			return fmt.Errorf("%w: signer", ErrMissingField)
+		}
+	case definition.STH_FULL, definition.REV_FULL, definition.ACC_FULL, definition.CKP_FULL:
+		if len(g.Signers) == 0 {
+			return fmt.Errorf("%w: signers", ErrMissingField)
+		}
+	case definition.CON_INIT:
+		if g.Signature[1] == "" {
+			return fmt.Errorf("%w: second signature", ErrMissingField)
+		}
+	}
+	return nil
+}
+
+func (c *GossiperContext) check_signer(g definition.Gossip_object) error {
+	switch g.Type {
+	case definition.STH_INIT, definition.REV_INIT, definition.ACC_INIT, definition.CKP_INIT:
+		if !c.known_signer(g.Signer) {
+			return fmt.Errorf("%w: %q", ErrUnknownSigner, g.Signer)
+		}
+	case definition.CON_INIT:
+		// a conflict PoM carries two signatures of the entity it accuses
+		if !c.known_signer(g.Payload[0]) {
+			return fmt.Errorf("%w: %q", ErrUnknownSigner, g.Payload[0])
+		}
+	case definition.STH_FRAG, definition.REV_FRAG, definition.ACC_FRAG, definition.CKP_FRAG:
+		if !c.known_gossiper(g.Signer) {
+			return fmt.Errorf("%w: %q", ErrUnknownSigner, g.Signer)
+		}
+	case definition.STH_FULL, definition.REV_FULL, definition.ACC_FULL, definition.CKP_FULL:
+		seen := make(map[string]bool)
+		for _, signer := range g.Signers {
+			if !c.known_gossiper(signer) || seen[signer] {
+				return fmt.Errorf("%w: %q", ErrUnknownSigner, signer)
+			}
+			seen[signer] = true
+		}
+		if len(seen) < c.Gossiper_crypto_config.Threshold {
+			return fmt.Errorf("%w: %d signers, %d required", ErrUnknownSigner, len(seen), c.Gossiper_crypto_config.Threshold)
+		}
+	}
+	return nil
+}
+
+// Validate_gossip_object runs the ingress stages on an object received on endpoint, an empty endpoint accepts every type
+// It returns the object with its payload restored if it is a fragment sent without it
+func (c *GossiperContext) Validate_gossip_object(g definition.Gossip_object, endpoint string) (definition.Gossip_object, error) {
+	if err := check_schema(g); err != nil {
+		return g, reject(Stage_schema, err)
+	}
+	expected, ok := Gossip_endpoint_types[endpoint]
+	if endpoint != "" && (!ok || expected != g.Type) {
+		return g, reject(Stage_type, fmt.Errorf("%w: %s on %s", ErrWrongEndpoint, definition.TypeString(g.Type), endpoint))
+	}
+	if definition.TypeString(g.Type) == "" {
+		return g, reject(Stage_type, errors.New(definition.Invalid_Type))
+	}
+	if err := c.check_signer(g); err != nil {
+		return g, reject(Stage_signer, err)
+	}
+	period, _ := strconv.Atoi(g.Period)
+	current, _ := strconv.Atoi(util.GetCurrentPeriod())
+	if period_distance(period, current) > c.Max_period_skew {
+		return g, reject(Stage_freshness, fmt.Errorf("%w: %s, now %d", ErrStalePeriod, g.Period, current))
+	}
+	if Is_stripped(g) {
+		// only fragments are sent without their payload
+		if !c.Optimization_mode || !is_frag(g.Type) {
+			return g, reject(Stage_payload, fmt.Errorf("%w: %s sent without payload", ErrMissingField, definition.TypeString(g.Type)))
+		}
+		restored := c.ReconstructPayload(g)
+		if restored.Payload[0] == "" {
+			return g, reject(Stage_payload, ErrUnknownPayload)
+		}
+		g = restored
+	}
+	if err := g.Verify(c.Gossiper_crypto_config); err != nil {
+		return g, reject(Stage_signature, err)
+	}
+	return g, nil
+}
+
+// sender of a request, without the port of the connection
+func sender_host(sender string) string {
+	host, _, err := net.SplitHostPort(sender)
+	if err != nil {
+		return sender
+	}
+	return host
+}
+
+// Score_sender counts an object received from sender, and the stage it failed if err is not nil
+func (c *GossiperContext) Score_sender(sender string, err error) {
+	c.Ingress_lock.Lock()
+	defer c.Ingress_lock.Unlock()
+	score, ok := c.Sender_scores[sender]
+	if !ok {
+		score = &Sender_score{}
+		c.Sender_scores[sender] = score
+	}
+	if err == nil {
+		score.Accepted++
+		return
+	}
+	score.Rejected++
+	score.Last_failure = err.Error()
+	var ingressErr *IngressError
+	if errors.As(err, &ingressErr) {
+		c.Ingress_failures[ingressErr.Stage]++
+	}
+}
+
+func (c *GossiperContext) GetSenderScore(sender string) Sender_score {
+	c.Ingress_lock.Lock()
+	defer c.Ingress_lock.Unlock()
+	if score, ok := c.Sender_scores[sender]; ok {
+		return *score
+	}
+	return Sender_score{}
+}
+
+func (c *GossiperContext) GetIngressFailures(stage string) int {
+	c.Ingress_lock.Lock()
+	defer c.Ingress_lock.Unlock()
+	return c.Ingress_failures[stage]
+}
@@ -0,0 +1,225 @@
+package gossiper
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/util"
+)
+
+// Append-only journal of the objects a gossiper accepts and of its permanent blacklist, one JSON entry per line
+// It is replayed when the gossiper starts, so a gossiper restarted in the middle of a period keeps its fragments and PoMs
+// WipeStorage rewrites it with what survives the period: the CON_INIT objects and the blacklist
+
+const (
+	Journal_object    = "object"
+	Journal_blacklist = "blacklist"
+)
+
+type Journal_entry struct {
+	Kind       string                    `json:"kind"`
+	Object     *definition.Gossip_object `json:"object,omitempty"`
+	Entity_URL string                    `json:"entity_url,omitempty"`
+}
+
+func (ctx *GossiperContext) write_journal(entry Journal_entry) {
+	ctx.Journal_lock.Lock()
+	defer ctx.Journal_lock.Unlock()
+	// nothing is written before the journal is opened, in particular while it is replayed
+	if ctx.Journal == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err := ctx.Journal.Write(append(line, '\n')); err != nil {
+		fmt.Println(util.RED+"Error writing gossiper journal: "+err.Error(), util.RESET)
+	}
+}
+
+func (ctx *GossiperContext) Journal_object(g definition.Gossip_object) {
+	ctx.write_journal(Journal_entry{Kind: Journal_object, Object: &g})
+}
+
+func (ctx *GossiperContext) Journal_blacklist(entity string) {
+	ctx.write_journal(Journal_entry{Kind: Journal_blacklist, Entity_URL: entity})
+}
+
+// objects of other periods would have been wiped, except the CON_INIT objects
+func (ctx *GossiperContext) replay_keeps(g definition.Gossip_object) bool {
+	if g.Type == definition.CON_INIT {
+		return true
+	}
+	period, err := strconv.Atoi(g.Period)
+	if err != nil {
+		return false
+	}
+	current, _ := strconv.Atoi(util.GetCurrentPeriod())
+	return period_distance(period, current) <= ctx.Max_period_skew
+}
+
+// Replay_journal loads the journal into storage and returns the number of objects restored
+// Objects are not gossiped again, lines cut by a crash are skipped
+func (ctx *GossiperContext) Replay_journal() (int, error) {
+	file, err := os.Open(ctx.Journal_filepath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	restored := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry Journal_entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			fmt.Println(util.RED+"Skipping journal entry: "+err.Error(), util.RESET)
+			continue
+		}
+		switch entry.Kind {
+		case Journal_blacklist:
+			ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.Lock()
+			ctx.Gossip_blacklist.BLACKLIST_PERM[entry.Entity_URL] = true
+			ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.Unlock()
+		case Journal_object:
+			if entry.Object == nil || !ctx.replay_keeps(*entry.Object) {
+				continue
+			}
+			g := *entry.Object
+			if is_frag(g.Type) {
+				ctx.Read_and_Store_If_Needed(g)
+			} else {
+				ctx.Store_gossip_object(g)
+			}
+			if ctx.Optimization_mode {
+				ctx.store_payload(g)
+			}
+			restored++
+		}
+	}
+	return restored, scanner.Err()
+}
+
+// Open_journal replays the journal, then appends the objects accepted from now on to it
+func (ctx *GossiperContext) Open_journal() error {
+	if err := os.MkdirAll(filepath.Dir(ctx.Journal_filepath), 0755); err != nil {
+		return err
+	}
+	restored, err := ctx.Replay_journal()
+	if err != nil {
+		return err
+	}
+	if restored > 0 {
+		fmt.Println(util.BLUE, "Restored", restored, "objects from", ctx.Journal_filepath, util.RESET)
+	}
+	file, err := os.OpenFile(ctx.Journal_filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	ctx.Journal_lock.Lock()
+	ctx.Journal = file
+	ctx.Journal_lock.Unlock()
+	return nil
+}
+
+func (ctx *GossiperContext) Close_journal() {
+	ctx.Journal_lock.Lock()
+	defer ctx.Journal_lock.Unlock()
+	if ctx.Journal != nil {
+		ctx.Journal.Close()
+		ctx.Journal = nil
+	}
+}
+
+// Compact_journal replaces the journal with the blacklist and the CON_INIT objects in storage
+func (ctx *GossiperContext) Compact_journal() error {
+	ctx.Journal_lock.Lock()
+	defer ctx.Journal_lock.Unlock()
+	return ctx.compact_journal()
+}
+
+// the caller holds Journal_lock
+func (ctx *GossiperContext) compact_journal() error {
+	if ctx.Journal == nil {
+		return nil
+	}
+	entries := []Journal_entry{}
+	ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.RLock()
+	for entity := range ctx.Gossip_blacklist.BLACKLIST_PERM {
+		entries = append(entries, Journal_entry{Kind: Journal_blacklist, Entity_URL: entity})
+	}
+	ctx.Gossip_blacklist.BLACKLIST_PERM_LOCK.RUnlock()
+	ctx.Gossip_object_storage.CON_INIT_LOCK.RLock()
+	for _, g := range ctx.Gossip_object_storage.CON_INIT {
+		g := g
+		entries = append(entries, Journal_entry{Kind: Journal_object, Object: &g})
+	}
+	ctx.Gossip_object_storage.CON_INIT_LOCK.RUnlock()
+	tmp := ctx.Journal_filepath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		file.Write(append(line, '\n'))
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tmp, ctx.Journal_filepath); err != nil {
+		return err
+	}
+	ctx.Journal.Close()
+	ctx.Journal, err = os.OpenFile(ctx.Journal_filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return err
+}
+
+// Resume_fragments signs the INIT objects restored from the journal that this gossiper has not signed yet
+func (ctx *GossiperContext) Resume_fragments() {
+	self := ctx.Gossiper_crypto_config.SelfID.String()
+	inits := []definition.Gossip_object{}
+	s := ctx.Gossip_object_storage
+	for _, pair := range []struct {
+		objs map[definition.Gossip_ID]definition.Gossip_object
+		lock *sync.RWMutex
+	}{
+		{s.STH_INIT, &s.STH_INIT_LOCK},
+		{s.REV_INIT, &s.REV_INIT_LOCK},
+		{s.ACC_INIT, &s.ACC_INIT_LOCK},
+		{s.CKP_INIT, &s.CKP_INIT_LOCK},
+	} {
+		pair.lock.RLock()
+		for _, g := range pair.objs {
+			inits = append(inits, g)
+		}
+		pair.lock.RUnlock()
+	}
+	for _, g := range inits {
+		if ctx.InBlacklist(g.Payload[0]) {
+			continue
+		}
+		full_id := g.GetID()
+		full_id.Type = definition.Gossip_object{Type: g.GetTargetType()}.GetTargetType()
+		if count, _ := ctx.GetItemCount(full_id, full_id.Type); count > 0 {
+			continue
+		}
+		frag_id := g.GetID()
+		frag_id.Type = g.GetTargetType()
+		if has_signer(ctx.GetObjectList(frag_id, frag_id.Type), self) {
+			continue
+		}
+		Handle_Gossip_object(ctx, ctx.Generate_Gossip_Object_FRAG(g))
+	}
+}
@@ -3,6 +3,7 @@ package gossiper
 import (
 	"math/rand"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -29,25 +30,31 @@ type Gossip_object_storage struct {
 	REV_INIT         map[definition.Gossip_ID]definition.Gossip_object
 	ACC_INIT         map[definition.Gossip_ID]definition.Gossip_object
 	CON_INIT         map[definition.Gossip_ID]definition.Gossip_object
+	CKP_INIT         map[definition.Gossip_ID]definition.Gossip_object
 	STH_FRAG         map[definition.Gossip_ID][]definition.Gossip_object
 	REV_FRAG         map[definition.Gossip_ID][]definition.Gossip_object
 	ACC_FRAG         map[definition.Gossip_ID][]definition.Gossip_object
+	CKP_FRAG         map[definition.Gossip_ID][]definition.Gossip_object
 	STH_FULL         map[definition.Gossip_ID]definition.Gossip_object
 	REV_FULL         map[definition.Gossip_ID]definition.Gossip_object
 	ACC_FULL         map[definition.Gossip_ID]definition.Gossip_object
-	REV_PAYLOAD      map[definition.Gossip_ID]definition.Gossip_object
+	CKP_FULL         map[definition.Gossip_ID]definition.Gossip_object
+	OBJ_PAYLOAD      map[string]definition.Gossip_object // by payload hash
 	STH_INIT_LOCK    sync.RWMutex
 	REV_INIT_LOCK    sync.RWMutex
 	ACC_INIT_LOCK    sync.RWMutex
 	CON_INIT_LOCK    sync.RWMutex
+	CKP_INIT_LOCK    sync.RWMutex
 	STH_FRAG_LOCK    sync.RWMutex
 	REV_FRAG_LOCK    sync.RWMutex
 	ACC_FRAG_LOCK    sync.RWMutex
+	CKP_FRAG_LOCK    sync.RWMutex
 	STH_FULL_LOCK    sync.RWMutex
 	REV_FULL_LOCK    sync.RWMutex
 	ACC_FULL_LOCK    sync.RWMutex
 	CON_FULL_LOCK    sync.RWMutex
-	REV_PAYLOAD_LOCK sync.RWMutex
+	CKP_FULL_LOCK    sync.RWMutex
+	OBJ_PAYLOAD_LOCK sync.RWMutex
 }
 
 type Gossip_blacklist struct {
@@ -83,6 +90,35 @@ type GossiperContext struct {
 	Counter1_lock          sync.Mutex
 	Counter2_lock          sync.Mutex
 	Timerlist              []float64
+	// Ingress validation
+	Max_period_skew  int
+	Ingress_failures map[string]int
+	Sender_scores    map[string]*Sender_score
+	Ingress_lock     sync.Mutex
+	// seconds between digest exchanges with the connected gossipers, 0 disables them
+	Anti_entropy_interval int
+	// Journal of accepted objects, replayed at startup
+	Journal_filepath string
+	Journal          *os.File
+	Journal_lock     sync.Mutex
+	// stripped fragments waiting for their payload, by payload hash then by sender and signer
+	Pending_frags map[string]map[string]Pending_frag
+	Pending_count map[string]int // fragments held for each sender
+	Max_pending   int            // fragments held at most for a sender
+	Pending_lock  sync.Mutex
+}
+
+// a stripped fragment and the gossiper it came from
+type Pending_frag struct {
+	Sender string
+	Object definition.Gossip_object
+}
+
+// objects accepted from and rejected for a sender at ingress
+type Sender_score struct {
+	Accepted     int
+	Rejected     int
+	Last_failure string
 }
 
 type Gossiper_log_entry struct {
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 
 	"github.com/jik18001/CTngV2/definition"
 	"github.com/jik18001/CTngV2/util"
@@ -40,17 +42,111 @@ func PrepareClientUpdate(context *MonitorContext, filepath string) (*ClientUpdat
 	return &clientupdate, nil
 }
 
+// serve the client update of the storage period named by ?period=, or the latest update saved
 func requestupdate(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
-	var periodnum string
-	err := json.NewDecoder(r.Body).Decode(&periodnum)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	periodnum := r.URL.Query().Get("period")
+	if periodnum == "" {
+		c.Update_lock.RLock()
+		periodnum = c.Latest_update_period
+		c.Update_lock.RUnlock()
+	}
+	if periodnum == "" {
+		http.Error(w, "no client update yet", http.StatusNotFound)
+		return
 	}
 	//get the file path
 	filepath := c.StorageDirectory + "/Period_" + periodnum + "/ClientUpdate.json"
-	ctupdate, _ := PrepareClientUpdate(c, filepath)
-	fmt.Println(ctupdate.Period)
-	msg, _ := json.Marshal(ctupdate)
-	json.NewEncoder(w).Encode(msg)
+	ctupdate, err := PrepareClientUpdate(c, filepath)
+	if err != nil {
+		http.Error(w, "no client update for period "+periodnum, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(ctupdate)
 	fmt.Println("Update request Processed")
 }
+
+// the latest certified CRV checkpoint of a CA and the REV_FULLs certified since, oldest first
+// a client can rebuild the CRV of the CA from it without every delta since the CA started
+type CheckpointUpdate struct {
+	Checkpoint definition.Gossip_object
+	REVs       []definition.Gossip_object
+	MonitorID  string
+}
+
+func (c *MonitorContext) GetCheckpointUpdate(CAURL string) (CheckpointUpdate, bool) {
+	c.CKP_lock.RLock()
+	defer c.CKP_lock.RUnlock()
+	checkpoint, ok := c.Storage_CKP_FULL[CAURL]
+	if !ok {
+		return CheckpointUpdate{}, false
+	}
+	revs := c.revHistorySince(CAURL, 0)
+	return CheckpointUpdate{
+		Checkpoint: checkpoint,
+		REVs:       revs,
+		MonitorID:  c.Monitor_crypto_config.SelfID.String(),
+	}, true
+}
+
+// serve the latest checkpoint of the CA named by ?ca= and the deltas since then
+func requestCheckpoint(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
+	CAURL := r.URL.Query().Get("ca")
+	if CAURL == "" {
+		http.Error(w, "missing ca", http.StatusBadRequest)
+		return
+	}
+	update, ok := c.GetCheckpointUpdate(CAURL)
+	if !ok {
+		http.Error(w, "no checkpoint for this CA", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(update)
+}
+
+// the REV_FULLs of a CA with a sequence number after since, oldest first, the caller must hold CKP_lock
+func (c *MonitorContext) revHistorySince(CAURL string, since uint64) []definition.Gossip_object {
+	sequences := []uint64{}
+	for sequence := range c.Storage_REV_history[CAURL] {
+		if sequence > since {
+			sequences = append(sequences, sequence)
+		}
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	revs := []definition.Gossip_object{}
+	for _, sequence := range sequences {
+		revs = append(revs, c.Storage_REV_history[CAURL][sequence])
+	}
+	return revs
+}
+
+// GetREVsSince returns the REV_FULLs of a CA after the REV with sequence number since, for a client that missed them
+// It fails if the REVs right after since were dropped for a newer checkpoint, the client then needs the checkpoint update
+func (c *MonitorContext) GetREVsSince(CAURL string, since uint64) ([]definition.Gossip_object, bool) {
+	c.CKP_lock.RLock()
+	defer c.CKP_lock.RUnlock()
+	if ckp, ok := c.Storage_CKP_FULL[CAURL]; ok {
+		checkpoint, _, _ := definition.ExtractCheckpoint(ckp)
+		if since < checkpoint.Sequence {
+			return nil, false
+		}
+	}
+	return c.revHistorySince(CAURL, since), true
+}
+
+// serve the REVs of the CA named by ?ca= after the REV with the sequence number ?since=
+func requestREVsSince(c *MonitorContext, w http.ResponseWriter, r *http.Request) {
+	CAURL := r.URL.Query().Get("ca")
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if CAURL == "" || err != nil {
+		http.Error(w, "missing ca or since", http.StatusBadRequest)
+		return
+	}
+	revs, ok := c.GetREVsSince(CAURL, since)
+	if !ok {
+		http.Error(w, "REVs since this REV are covered by a checkpoint", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revs)
+}
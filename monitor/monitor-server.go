@@ -24,6 +24,8 @@ func handleMonitorRequests(c *MonitorContext) {
 	gorillaRouter := mux.NewRouter().StrictSlash(true)
 	// POST functions
 	gorillaRouter.HandleFunc("/monitor/get-update", bindMonitorContext(c, requestupdate)).Methods("GET")
+	gorillaRouter.HandleFunc("/monitor/get-crv-checkpoint", bindMonitorContext(c, requestCheckpoint)).Methods("GET")
+	gorillaRouter.HandleFunc("/monitor/get-revocations", bindMonitorContext(c, requestREVsSince)).Methods("GET")
 	//gorillaRouter.HandleFunc("/monitor/receive-gossip", bindMonitorContext(c, handle_gossip)).Methods("POST")
 	gorillaRouter.HandleFunc("/monitor/receive-gossip-from-gossiper", bindMonitorContext(c, handle_gossip_from_gossiper)).Methods("POST")
 	// Start the HTTP server.
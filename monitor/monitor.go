@@ -2,7 +2,9 @@ package monitor
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,6 +14,7 @@ import (
 
 	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/gossiper"
 	"github.com/jik18001/CTngV2/util"
 
 	"github.com/bits-and-blooms/bitset"
@@ -56,7 +59,7 @@ func handle_gossip_from_gossiper(c *MonitorContext, w http.ResponseWriter, r *ht
 	} else {
 		fmt.Println("received new, valid", definition.TypeString(gossip_obj.Type), "from gossiper.")
 		switch gossip_obj.Type {
-		case definition.STH_INIT, definition.REV_INIT:
+		case definition.STH_INIT, definition.REV_INIT, definition.CKP_INIT:
 			c.StoreObject(gossip_obj)
 		default:
 			Process_valid_object(c, gossip_obj)
@@ -161,7 +164,7 @@ func QueryLoggers(c *MonitorContext) {
 						if err3 != nil {
 							log.Println(util.RED+"STH signature verification failed"+err3.Error(), util.RESET)
 							Wait_then_accuse(c, loggerURL, "logger")
-						} else {
+						} else if CheckConsistency(c, loggerURL, STH) {
 							// Process valid object
 							Process_valid_object(c, STH)
 						}
@@ -172,6 +175,85 @@ func QueryLoggers(c *MonitorContext) {
 	}
 }
 
+// Check that the new STH extends the latest STH seen from this logger
+// If the logger forked its history, a conflict PoM made of the two STHs is sent to the gossiper
+// The lock is not held while the proof is fetched, a slow logger does not hold up the checks of the others
+func CheckConsistency(c *MonitorContext, loggerURL string, newSTH definition.Gossip_object) bool {
+	c.Latest_STH_lock.Lock()
+	oldSTH, ok := c.Storage_Latest_STH[loggerURL]
+	if !ok {
+		c.Storage_Latest_STH[loggerURL] = newSTH
+	}
+	c.Latest_STH_lock.Unlock()
+	if !ok {
+		return true
+	}
+	old_sth, err1 := definition.ExtractSTH(oldSTH)
+	new_sth, err2 := definition.ExtractSTH(newSTH)
+	if err1 != nil || err2 != nil {
+		log.Println(util.RED+"Failed to parse STH from "+loggerURL, util.RESET)
+		return false
+	}
+	old_root, _ := hex.DecodeString(old_sth.RootHash)
+	new_root, _ := hex.DecodeString(new_sth.RootHash)
+	if new_sth.TreeSize < old_sth.TreeSize {
+		fmt.Println(util.RED+"Logger "+loggerURL+" shrank its tree from", old_sth.TreeSize, "to", new_sth.TreeSize, util.RESET)
+		RaiseConflict(c, oldSTH, newSTH)
+		return false
+	}
+	proof := [][]byte{}
+	if new_sth.TreeSize > old_sth.TreeSize {
+		consistency, err := FetchConsistencyProof(c, loggerURL, old_sth.TreeSize, new_sth.TreeSize)
+		if err != nil {
+			// no answer is not a fork, the logger is accused like for any query it does not answer
+			log.Println(util.RED+"Failed to get consistency proof from "+loggerURL+": "+err.Error(), util.RESET)
+			Wait_then_accuse(c, loggerURL, "logger")
+			return false
+		}
+		proof = consistency.Proof
+	}
+	err := crypto.VerifyConsistency(old_sth.TreeSize, new_sth.TreeSize, old_root, new_root, proof)
+	if err != nil {
+		fmt.Println(util.RED+"Consistency check failed for Logger "+loggerURL+": "+err.Error(), util.RESET)
+		RaiseConflict(c, oldSTH, newSTH)
+		return false
+	}
+	c.Latest_STH_lock.Lock()
+	defer c.Latest_STH_lock.Unlock()
+	// the STH is only moved forward from the one it was checked against
+	if latest := c.Storage_Latest_STH[loggerURL]; latest.Signature == oldSTH.Signature {
+		c.Storage_Latest_STH[loggerURL] = newSTH
+	}
+	return true
+}
+
+func FetchConsistencyProof(c *MonitorContext, loggerURL string, first int, second int) (definition.STH_Consistency, error) {
+	var consistency definition.STH_Consistency
+	resp, err := c.Client.Get(PROTOCOL + loggerURL + "/ctng/v2/get-sth-consistency?first=" + strconv.Itoa(first) + "&second=" + strconv.Itoa(second))
+	if err != nil {
+		return consistency, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return consistency, errors.New(resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&consistency)
+	if err != nil {
+		return consistency, err
+	}
+	if consistency.First != first || consistency.Second != second {
+		return consistency, errors.New("consistency proof for the wrong tree sizes")
+	}
+	return consistency, nil
+}
+
+// the two STHs are signed by the logger, together they prove the fork
+func RaiseConflict(c *MonitorContext, obj1 definition.Gossip_object, obj2 definition.Gossip_object) {
+	CON := gossiper.Generate_CON_INIT(obj1, obj2)
+	c.StoreObject(CON)
+	Send_to_gossiper(c, CON)
+}
+
 /*
 // Queries CAs for revocation information
 // The revocation datapath hasn't been very fleshed out currently, nor has this function.
@@ -269,20 +351,157 @@ func QueryAuthorities(c *MonitorContext) {
 					return
 				}
 
-				SRH, DCRV := Get_SRH_and_DCRV(REV)
 				key := REV.Payload[0]
-				pass := c.VerifySRH(SRH, &DCRV, key, REV.Period)
-				if !pass {
-					fmt.Println("SRH verification failed")
+				revocation, DCRV, err5 := definition.ExtractRevocation(REV)
+				if err5 == nil {
+					err5 = c.VerifySRH(revocation, DCRV, key, REV.Period)
+				}
+				if errors.Is(err5, definition.ErrREVGap) {
+					// some REVs of the CA never reached this monitor, get them from the CA before judging this one
+					fmt.Println(util.RED, "Missing REVs of "+key+", requesting them from the CA", util.RESET)
+					err5 = BackfillREVs(c, CAURL, key, revocation)
+					if err5 == nil {
+						err5 = c.VerifySRH(revocation, DCRV, key, REV.Period)
+					}
+				}
+				if err5 != nil {
+					fmt.Println("SRH verification failed: ", err5)
 					Wait_then_accuse(c, CAURL, "ca")
 				} else {
 					Process_valid_object(c, REV)
+					QueryCheckpoint(c, CAURL, REV.Period)
 				}
 			}(CA)
 		}
 	}
 }
 
+// Fetch the latest CRV checkpoint of a CA and send it to the gossiper if it was published with the REV of Period
+// CAs publish checkpoints only every few periods, so a missing checkpoint is not an accusation
+func QueryCheckpoint(c *MonitorContext, CAURL string, Period string) {
+	CKP, err := FetchCheckpoint(c, CAURL)
+	if err != nil {
+		if err != errNoCheckpoint {
+			log.Println(util.RED+"Query CA checkpoint failed: "+err.Error(), util.RESET)
+		}
+		return
+	}
+	err = CKP.Verify(c.Monitor_crypto_config)
+	if err == nil && CKP.Type != definition.CKP_INIT {
+		err = errors.New(definition.Invalid_Type)
+	}
+	if err != nil {
+		log.Println(util.RED+"Checkpoint signature verification failed", err.Error(), util.RESET)
+		Wait_then_accuse(c, CAURL, "ca")
+		return
+	}
+	checkpoint, _, err := definition.VerifyCheckpoint(CKP, c.Monitor_crypto_config)
+	if err != nil {
+		log.Println(util.RED+"Checkpoint verification failed", err.Error(), util.RESET)
+		Wait_then_accuse(c, CAURL, "ca")
+		return
+	}
+	if checkpoint.Period == Period {
+		Process_valid_object(c, CKP)
+	}
+}
+
+// the most REVs a monitor gets from a CA to close a gap
+const MaxREVBackfill = 100
+
+// BackfillREVs gets the REVs between the last REV applied for the CA key and rev from the CA and applies them
+// The monitor walks the chain back from rev, a monitor without any REV of the CA starts from the checkpoint of the CA
+func BackfillREVs(c *MonitorContext, CAURL string, key string, rev definition.Revocation) error {
+	c.CRV_lock.Lock()
+	last, known := c.Storage_Last_REV[key]
+	c.CRV_lock.Unlock()
+	if !known {
+		ckp, err := FetchCheckpoint(c, CAURL)
+		if err == nil {
+			checkpoint, crv, err := definition.VerifyCheckpoint(ckp, c.Monitor_crypto_config)
+			start := definition.Revocation{Period: checkpoint.Period, SRH: checkpoint.SRH, Size: checkpoint.Size, Sequence: checkpoint.Sequence}
+			// the checkpoint is only a starting point if rev comes after it
+			if err == nil && checkpoint.SRH != "" && !errors.Is(definition.CheckREVChain(&start, rev), definition.ErrREVStale) {
+				c.CRV_lock.Lock()
+				c.Storage_CRV[key] = crv
+				c.Storage_Last_REV[key] = start
+				c.CRV_lock.Unlock()
+				last, known = c.Storage_Last_REV[key], true
+			}
+		}
+	}
+	// the chain ends at the last REV applied, or at the first REV of the CA
+	reached := func(prev_srh string) bool {
+		if known {
+			return prev_srh == definition.SRH_chain(last.SRH)
+		}
+		return prev_srh == ""
+	}
+	missing := []definition.Gossip_object{}
+	prev_period, prev_srh := rev.Prev_period, rev.Prev_SRH
+	for !reached(prev_srh) {
+		if prev_srh == "" || len(missing) == MaxREVBackfill {
+			return errors.New("the last REV applied is not in the REV chain of the CA")
+		}
+		REV, err := FetchREV(c, CAURL, prev_period)
+		if err != nil {
+			return err
+		}
+		err = REV.Verify(c.Monitor_crypto_config)
+		if err != nil {
+			return err
+		}
+		revocation, _, err := definition.ExtractRevocation(REV)
+		if err != nil {
+			return err
+		}
+		if revocation.Period != prev_period || definition.SRH_chain(revocation.SRH) != prev_srh {
+			return errors.New("the CA served a REV that is not in its REV chain")
+		}
+		missing = append(missing, REV)
+		prev_period, prev_srh = revocation.Prev_period, revocation.Prev_SRH
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		err := c.ApplyREV(missing[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fetch the REV of a past period from a CA
+func FetchREV(c *MonitorContext, CAURL string, Period string) (definition.Gossip_object, error) {
+	var REV definition.Gossip_object
+	revResp, err := http.Get(PROTOCOL + CAURL + "/ctng/v2/get-revocation?period=" + Period)
+	if err != nil {
+		return REV, err
+	}
+	defer revResp.Body.Close()
+	if revResp.StatusCode != http.StatusOK {
+		return REV, fmt.Errorf("CA has no REV for period %s", Period)
+	}
+	err = json.NewDecoder(revResp.Body).Decode(&REV)
+	return REV, err
+}
+
+var errNoCheckpoint = errors.New("CA has not published a checkpoint")
+
+// Fetch the latest CRV checkpoint of a CA
+func FetchCheckpoint(c *MonitorContext, CAURL string) (definition.Gossip_object, error) {
+	var CKP definition.Gossip_object
+	ckpResp, err := http.Get(PROTOCOL + CAURL + "/ctng/v2/get-checkpoint")
+	if err != nil {
+		return CKP, err
+	}
+	defer ckpResp.Body.Close()
+	if ckpResp.StatusCode != http.StatusOK {
+		return CKP, errNoCheckpoint
+	}
+	err = json.NewDecoder(ckpResp.Body).Decode(&CKP)
+	return CKP, err
+}
+
 // This function accuses the entity if the domain name is provided
 // It is called when the gossip object received is not valid, or the monitor didn't get response when querying the logger or the CA
 // Accused = Domain name of the accused entity (logger etc.)
@@ -355,6 +574,10 @@ func Send_to_gossiper(c *MonitorContext, g definition.Gossip_object) {
 		gossiperendpoint = "/gossip/sth_init"
 	case definition.REV_INIT:
 		gossiperendpoint = "/gossip/rev_init"
+	case definition.CON_INIT:
+		gossiperendpoint = "/gossip/con_init"
+	case definition.CKP_INIT:
+		gossiperendpoint = "/gossip/ckp_init"
 	}
 	resp, postErr := c.Client.Post(PROTOCOL+c.Monitor_private_config.Gossiper_URL+gossiperendpoint, "application/json", bytes.NewBuffer(msg))
 	if postErr != nil {
@@ -483,39 +706,93 @@ func Process_valid_object(c *MonitorContext, g definition.Gossip_object) {
 		// Send an unsigned copy to the gossiper if the REV is received from a CA
 		Send_to_gossiper(c, g)
 	}
+	//this handles CRV checkpoints from querying CAs
+	if g.Type == definition.CKP_INIT && IsAuthority(c, g.Signer) {
+		Send_to_gossiper(c, g)
+	}
 	//this handles processed gossip object from the gossiper, verfications will be added when if needed
-	if g.Type == definition.ACC_FULL || g.Type == definition.CON_INIT || g.Type == definition.STH_FULL || g.Type == definition.REV_FULL {
+	if g.Type == definition.ACC_FULL || g.Type == definition.CON_INIT || g.Type == definition.STH_FULL || g.Type == definition.REV_FULL || g.Type == definition.CKP_FULL {
 		c.StoreObject(g)
 	}
 	return
 }
 
-func (ctx *MonitorContext) VerifySRH(srh string, dCRV *bitset.BitSet, CAID string, Period string) bool {
-	// find the corresponding CRV
+// VerifySRH checks the SRH of a REV of CAID against the CRV of the CA, and that the REV directly follows the last REV applied
+// It returns definition.ErrREVGap if REVs of the CA are missing, and definition.ErrREVStale if the REV is not newer
+func (ctx *MonitorContext) VerifySRH(revocation definition.Revocation, dCRV *bitset.BitSet, CAID string, Period string) error {
+	ctx.CRV_lock.Lock()
+	defer ctx.CRV_lock.Unlock()
+	_, err := ctx.verifySRH(revocation, dCRV, CAID, Period)
+	return err
+}
+
+// verifySRH returns the CRV of CAID after the REV, the caller must hold CRV_lock
+func (ctx *MonitorContext) verifySRH(revocation definition.Revocation, dCRV *bitset.BitSet, CAID string, Period string) (*bitset.BitSet, error) {
+	// find the corresponding CRV and the last REV applied
 	CRV_old := ctx.Storage_CRV[CAID]
-	if CRV_old == nil {
-		CRV_old = dCRV
+	var last *definition.Revocation
+	if rev, ok := ctx.Storage_Last_REV[CAID]; ok {
+		last = &rev
+	}
+	err := definition.CheckREVChain(last, revocation)
+	if err != nil {
+		return nil, err
+	}
+	var localhash []byte
+	var CRV_new *bitset.BitSet
+	size := revocation.Size
+	if size == 0 {
+		// REV without a committed CRV size
+		if CRV_old == nil {
+			CRV_old = dCRV
+		}
+		// verify the SRH
+		hashmsg1, _ := CRV_old.MarshalBinary()
+		hashmsg2, _ := dCRV.MarshalBinary()
+		hash_old, _ := crypto.GenerateSHA256(hashmsg1)
+		hash_delta, _ := crypto.GenerateSHA256(hashmsg2)
+		localhash, _ = crypto.GenerateSHA256([]byte(Period + string(hash_old) + string(hash_delta)))
+		CRV_new, _ = definition.ApplyDeltaCRV(CRV_old, dCRV, size)
+	} else {
+		// the SRH commits to the CRV after the delta, to its size and to the previous REV
+		CRV_new, err = definition.ApplyDeltaCRV(CRV_old, dCRV, size)
+		if err == nil {
+			localhash, err = definition.SRH_hash(Period, CRV_new, dCRV, size, revocation.Prev_period, revocation.Prev_SRH)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fail to apply the delta CRV: %v", err)
+		}
 	}
-	// verify the SRH
-	hashmsg1, _ := CRV_old.MarshalBinary()
-	hashmsg2, _ := dCRV.MarshalBinary()
-	hash_old, _ := crypto.GenerateSHA256(hashmsg1)
-	hash_delta, _ := crypto.GenerateSHA256(hashmsg2)
-
-	localhash, _ := crypto.GenerateSHA256([]byte(Period + string(hash_old) + string(hash_delta)))
 	// the localhash will be te message we used to verify the Signature on the SRH
 	// verify the signature
-	rsasig, err := crypto.RSASigFromString(srh)
+	rsasig, err := crypto.RSASigFromString(revocation.SRH)
 	if err != nil {
-		fmt.Println("Fail to convert the signature from the SRH to RSA signature")
+		return nil, errors.New("fail to convert the signature from the SRH to RSA signature")
 	}
 	ca_publickey := ctx.Monitor_crypto_config.SignPublicMap[rsasig.ID]
 	err = crypto.RSAVerify(localhash, rsasig, &ca_publickey)
 	if err != nil {
-		fmt.Println("Fail to verify the signature on the SRH: ", err)
-		fmt.Println(dCRV)
-		return false
+		return nil, fmt.Errorf("fail to verify the signature on the SRH: %v", err)
 	}
 	//fmt.Println("SRH verification success")
-	return true
+	return CRV_new, nil
+}
+
+// ApplyREV updates the CRV of the CA of a REV if the REV directly follows the last REV applied
+func (ctx *MonitorContext) ApplyREV(rev definition.Gossip_object) error {
+	revocation, DCRV, err := definition.ExtractRevocation(rev)
+	if err != nil {
+		return err
+	}
+	key := rev.Payload[0]
+	ctx.CRV_lock.Lock()
+	defer ctx.CRV_lock.Unlock()
+	CRV_new, err := ctx.verifySRH(revocation, DCRV, key, rev.Period)
+	if err != nil {
+		return err
+	}
+	ctx.Storage_CRV[key] = CRV_new
+	revocation.Delta_CRV = nil
+	ctx.Storage_Last_REV[key] = revocation
+	return nil
 }
@@ -2,14 +2,22 @@ package monitor
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/jik18001/CTngV2/CA"
+	"github.com/jik18001/CTngV2/crypto"
 	"github.com/jik18001/CTngV2/definition"
+	"github.com/jik18001/CTngV2/gossiper"
 )
 
 type ClientMock struct{}
@@ -63,6 +71,297 @@ func testPanicOnBadReceiveGossip(t *testing.T) {
 	t.Errorf("Expected panic")
 }*/
 
+func TestCheckpointUpdate(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_ca := CA.InitializeCAContext(testconfig+"ca_testconfig/1/CA_public_config.json", testconfig+"ca_testconfig/1/CA_private_config.json", testconfig+"ca_testconfig/1/CA_crypto_config.json")
+	ctx_ca.CRV = CA.New_CRV(64)
+	ctx_ca.CA_private_config.Checkpoint_interval = 5
+	gossipers := []*gossiper.GossiperContext{}
+	for _, id := range []string{"1", "2"} {
+		dir := testconfig + "gossiper_testconfig/" + id + "/"
+		gossipers = append(gossipers, gossiper.InitializeGossiperContext(dir+"Gossiper_public_config.json", dir+"Gossiper_private_config.json", dir+"Gossiper_crypto_config.json", id))
+	}
+	// threshold sign an object as the gossipers would, in the period it was published for
+	certify := func(g definition.Gossip_object) definition.Gossip_object {
+		frags := []definition.Gossip_object{}
+		for _, ctx_g := range gossipers {
+			frags = append(frags, ctx_g.Generate_Gossip_Object_FRAG(g))
+		}
+		full := gossipers[0].Generate_Gossip_Object_FULL(frags, frags[0].GetTargetType())
+		full.Period = g.Period
+		return full
+	}
+	publish := func(period string) (definition.Gossip_object, definition.Gossip_object) {
+		ckp := definition.Gossip_object{}
+		if CA.Publish_Revocation(ctx_ca, period) {
+			ckp = ctx_ca.Checkpoint
+		}
+		return ctx_ca.REV_storage[period], ckp
+	}
+	ctx_ca.CRV.Revoke(3)
+	rev_9, _ := publish("9")
+	ctx_ca.CRV.Revoke(7)
+	rev_10, ckp_10 := publish("10")
+	ctx_ca.CRV.Revoke(100)
+	rev_11, ckp_11 := publish("11")
+	if ckp_10.Type != definition.CKP_INIT || ckp_11.Type != "" {
+		t.Fatalf("checkpoint not published every 5 periods")
+	}
+	if err := ckp_10.Verify(ctx_ca.CA_crypto_config); err != nil {
+		t.Fatal(err)
+	}
+	ctx_m := InitializeMonitorContext(testconfig+"monitor_testconfig/1/Monitor_public_config.json", testconfig+"monitor_testconfig/1/Monitor_private_config.json", testconfig+"monitor_testconfig/1/Monitor_crypto_config.json", "1")
+	caURL := ctx_ca.CA_private_config.Signer
+	request := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		requestCheckpoint(ctx_m, w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	if w := request("/monitor/get-crv-checkpoint?ca=" + caURL); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before any checkpoint, got %d", w.Code)
+	}
+	ctx_m.StoreObject(certify(rev_9))
+	ckp_full := certify(ckp_10)
+	if err := ckp_full.Verify(ctx_m.Monitor_crypto_config); err != nil {
+		t.Fatal(err)
+	}
+	ctx_m.StoreObject(ckp_full)
+	ctx_m.StoreObject(certify(rev_10))
+	ctx_m.StoreObject(certify(rev_11))
+	// a checkpoint that is not signed by the CA is dropped
+	forged := ckp_full
+	forged.Period = "20"
+	var checkpoint definition.Checkpoint
+	json.Unmarshal([]byte(forged.Payload[2]), &checkpoint)
+	checkpoint.Period = "20"
+	payload, _ := json.Marshal(checkpoint)
+	forged.Payload[2] = string(payload)
+	if ctx_m.StoreCheckpoint(forged) {
+		t.Errorf("forged checkpoint was stored")
+	}
+	if w := request("/monitor/get-crv-checkpoint"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a CA, got %d", w.Code)
+	}
+	w := request("/monitor/get-crv-checkpoint?ca=" + caURL)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get-crv-checkpoint returned %d", w.Code)
+	}
+	var update CheckpointUpdate
+	if err := json.NewDecoder(w.Body).Decode(&update); err != nil {
+		t.Fatal(err)
+	}
+	// the REVs up to the checkpoint are covered by it
+	if update.Checkpoint.Type != definition.CKP_FULL || len(update.REVs) != 1 || update.REVs[0].Period != "11" {
+		t.Fatalf("checkpoint update does not hold the checkpoint and the REV since then")
+	}
+	// a new verifier starts from the checkpoint and checks the SRH of the following REVs
+	checkpoint, crv, err := definition.VerifyCheckpoint(update.Checkpoint, ctx_m.Monitor_crypto_config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !crv.Test(3) || !crv.Test(7) || crv.Test(100) {
+		t.Errorf("checkpoint CRV is wrong")
+	}
+	ctx_m.Storage_CRV[caURL] = crv
+	ctx_m.Storage_Last_REV[caURL] = definition.Revocation{Period: checkpoint.Period, SRH: checkpoint.SRH, Sequence: checkpoint.Sequence}
+	revocation, DCRV, _ := definition.ExtractRevocation(update.REVs[0])
+	if err := ctx_m.VerifySRH(revocation, DCRV, caURL, update.REVs[0].Period); err != nil {
+		t.Errorf("REV after the checkpoint does not verify against the checkpoint CRV: %v", err)
+	}
+	// periods wrap every hour, the checkpoint of period 60 is newer than the one of period 10 and REV 1 follows it
+	ctx_ca.CRV.Revoke(9)
+	rev_60, ckp_60 := publish("60")
+	ctx_ca.CRV.Revoke(11)
+	rev_1, _ := publish("1")
+	ctx_m.StoreObject(certify(rev_60))
+	if !ctx_m.StoreCheckpoint(certify(ckp_60)) {
+		t.Fatalf("checkpoint of period 60 was not stored")
+	}
+	ctx_m.StoreObject(certify(rev_1))
+	if ctx_m.StoreCheckpoint(ckp_full) {
+		t.Errorf("older checkpoint replaced a newer one")
+	}
+	update, _ = ctx_m.GetCheckpointUpdate(caURL)
+	checkpoint, _, _ = definition.ExtractCheckpoint(update.Checkpoint)
+	if checkpoint.Period != "60" || len(update.REVs) != 1 || update.REVs[0].Period != "1" {
+		t.Fatalf("checkpoint update across the hour does not hold checkpoint 60 and REV 1")
+	}
+	if revs, ok := ctx_m.GetREVsSince(caURL, checkpoint.Sequence); !ok || len(revs) != 1 || revs[0].Period != "1" {
+		t.Errorf("expected REV 1 after the REV of period 60, got %d REVs", len(revs))
+	}
+	if _, ok := ctx_m.GetREVsSince(caURL, checkpoint.Sequence-1); ok {
+		t.Errorf("REVs covered by the checkpoint were served")
+	}
+}
+
+func TestRequestUpdate(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_m := InitializeMonitorContext(testconfig+"monitor_testconfig/1/Monitor_public_config.json", testconfig+"monitor_testconfig/1/Monitor_private_config.json", testconfig+"monitor_testconfig/1/Monitor_crypto_config.json", "1")
+	ctx_m.StorageDirectory = t.TempDir()
+	ctx_m.StorageFile_CRV = ctx_m.StorageDirectory + "/CRV.json"
+	request := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		requestupdate(ctx_m, w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	if w := request("/monitor/get-update"); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d before the first update, got %d", http.StatusNotFound, w.Code)
+	}
+	ctx_m.SaveStorage("1", ClientUpdate{Period: "41"})
+	ctx_m.SaveStorage("2", ClientUpdate{Period: "42"})
+	// the latest update by default, an older one by its storage period
+	for url, period := range map[string]string{"/monitor/get-update": "42", "/monitor/get-update?period=1": "41"} {
+		var update ClientUpdate
+		w := request(url)
+		if err := json.Unmarshal(w.Body.Bytes(), &update); err != nil || update.Period != period {
+			t.Errorf("%s: expected the update of period %s, got %q", url, period, w.Body.String())
+		}
+	}
+	if w := request("/monitor/get-update?period=3"); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for a missing period, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_m := InitializeMonitorContext(testconfig+"monitor_testconfig/1/Monitor_public_config.json", testconfig+"monitor_testconfig/1/Monitor_private_config.json", testconfig+"monitor_testconfig/1/Monitor_crypto_config.json", "1")
+	// the logger is not accused while the test runs
+	ctx_m.Monitor_public_config.Gossip_wait_time = 3600
+	ctx_m.Client = &http.Client{}
+	merkle := crypto.NewMerkleLog()
+	for i := 0; i < 4; i++ {
+		merkle.AppendLeafHash(crypto.HashLeaf([]byte{byte(i)}))
+	}
+	sth := func(size int) definition.Gossip_object {
+		root, _ := merkle.RootHashAt(size)
+		payload, _ := json.Marshal(definition.STH{RootHash: hex.EncodeToString(root), TreeSize: size})
+		return definition.Gossip_object{Signature: [2]string{strconv.Itoa(size)}, Payload: [3]string{"logger", hex.EncodeToString(payload)}}
+	}
+	down := true
+	locked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the checks of other loggers go on while this one answers
+		if ctx_m.Latest_STH_lock.TryLock() {
+			ctx_m.Latest_STH_lock.Unlock()
+		} else {
+			locked = true
+		}
+		if down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		second, _ := strconv.Atoi(r.URL.Query().Get("second"))
+		proof, _ := merkle.ConsistencyProof(first, second)
+		json.NewEncoder(w).Encode(definition.STH_Consistency{First: first, Second: second, Proof: proof})
+	}))
+	defer server.Close()
+	logger := strings.TrimPrefix(server.URL, PROTOCOL)
+	if !CheckConsistency(ctx_m, logger, sth(2)) {
+		t.Fatal("first STH of the logger rejected")
+	}
+	// a logger that does not answer has not forked its log
+	if CheckConsistency(ctx_m, logger, sth(4)) {
+		t.Error("STH accepted without a consistency proof")
+	}
+	if len(*ctx_m.Storage_CONFLICT_POM) != 0 {
+		t.Error("conflict raised for a logger that did not answer")
+	}
+	down = false
+	if !CheckConsistency(ctx_m, logger, sth(4)) {
+		t.Error("consistent STH rejected")
+	}
+	if ctx_m.Storage_Latest_STH[logger].Signature != sth(4).Signature {
+		t.Error("latest STH not moved forward")
+	}
+	if locked {
+		t.Error("lock held while the proof was fetched")
+	}
+}
+
+func TestREVChain(t *testing.T) {
+	testconfig := "../CA/testFiles/"
+	ctx_ca := CA.InitializeCAContext(testconfig+"ca_testconfig/1/CA_public_config.json", testconfig+"ca_testconfig/1/CA_private_config.json", testconfig+"ca_testconfig/1/CA_crypto_config.json")
+	ctx_ca.CRV = CA.New_CRV(64)
+	for i, period := range []string{"1", "2", "3", "4", "5"} {
+		ctx_ca.CRV.Revoke(i + 1)
+		CA.Publish_Revocation(ctx_ca, period)
+	}
+	// the CA serves past REVs with ?period=, it has no checkpoint
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rev, ok := ctx_ca.REV_storage[r.URL.Query().Get("period")]
+		if r.URL.Path != "/ctng/v2/get-revocation" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(rev)
+	}))
+	defer ca.Close()
+	caURL := strings.TrimPrefix(ca.URL, PROTOCOL)
+	key := ctx_ca.CA_private_config.Signer
+	ctx_m := InitializeMonitorContext(testconfig+"monitor_testconfig/1/Monitor_public_config.json", testconfig+"monitor_testconfig/1/Monitor_private_config.json", testconfig+"monitor_testconfig/1/Monitor_crypto_config.json", "1")
+	if err := ctx_m.ApplyREV(ctx_ca.REV_storage["1"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx_m.ApplyREV(ctx_ca.REV_storage["3"]); !errors.Is(err, definition.ErrREVGap) {
+		t.Errorf("expected a gap, got %v", err)
+	}
+	if err := ctx_m.ApplyREV(ctx_ca.REV_storage["2"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx_m.ApplyREV(ctx_ca.REV_storage["1"]); !errors.Is(err, definition.ErrREVStale) {
+		t.Errorf("expected a stale REV, got %v", err)
+	}
+	// REV 5 arrives after REVs 3 and 4 were lost, the monitor gets them from the CA
+	revocation, DCRV, _ := definition.ExtractRevocation(ctx_ca.REV_storage["5"])
+	if err := ctx_m.VerifySRH(revocation, DCRV, key, "5"); !errors.Is(err, definition.ErrREVGap) {
+		t.Fatalf("expected a gap, got %v", err)
+	}
+	if err := BackfillREVs(ctx_m, caURL, key, revocation); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx_m.ApplyREV(ctx_ca.REV_storage["5"]); err != nil {
+		t.Fatal(err)
+	}
+	if !ctx_m.Storage_CRV[key].Equal(ctx_ca.CRV.CRV_current) || ctx_m.Storage_Last_REV[key].Period != "5" {
+		t.Errorf("CRV after the backfill does not match the CA")
+	}
+	// periods wrap every hour, REV 1 of the next hour follows REV 60
+	for i, period := range []string{"59", "60", "1"} {
+		ctx_ca.CRV.Revoke(10 + i)
+		CA.Publish_Revocation(ctx_ca, period)
+	}
+	if err := ctx_m.ApplyREV(ctx_ca.REV_storage["59"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx_m.ApplyREV(ctx_ca.REV_storage["1"]); !errors.Is(err, definition.ErrREVGap) {
+		t.Errorf("expected a gap, got %v", err)
+	}
+	for _, period := range []string{"60", "1"} {
+		if err := ctx_m.ApplyREV(ctx_ca.REV_storage[period]); err != nil {
+			t.Fatalf("REV %s: %v", period, err)
+		}
+	}
+	for _, period := range []string{"60", "5"} {
+		if err := ctx_m.ApplyREV(ctx_ca.REV_storage[period]); !errors.Is(err, definition.ErrREVStale) {
+			t.Errorf("REV %s after REV 1: expected a stale REV, got %v", period, err)
+		}
+	}
+	if !ctx_m.Storage_CRV[key].Equal(ctx_ca.CRV.CRV_current) || ctx_m.Storage_Last_REV[key].Period != "1" {
+		t.Errorf("CRV across the hour does not match the CA")
+	}
+	// a REV relinked to skip REV 4 fails the signature on its SRH
+	rev_3, _, _ := definition.ExtractRevocation(ctx_ca.REV_storage["3"])
+	ctx_m.Storage_Last_REV[key] = rev_3
+	forged := ctx_ca.REV_storage["5"]
+	revocation.Prev_period, revocation.Prev_SRH, revocation.Sequence = "3", definition.SRH_chain(rev_3.SRH), 4
+	payload, _ := json.Marshal(revocation)
+	forged.Payload[2] = string(payload)
+	if err := ctx_m.ApplyREV(forged); err == nil || errors.Is(err, definition.ErrREVGap) {
+		t.Errorf("REV with a forged link was applied")
+	}
+}
+
 func testPrepareClientupdate(t *testing.T) {
 	// TODO
 	ctx_monitor_1 := InitializeMonitorContext("../Gen/monitor_testconfig/1/Monitor_public_config.json", "../Gen/monitor_testconfig/1/Monitor_private_config.json", "../Gen/monitor_testconfig/1/Monitor_crypto_config.json", "1")
@@ -30,11 +30,20 @@ type MonitorContext struct {
 	Storage_STH_FULL             *definition.Gossip_Storage
 	Storage_REV_FULL             *definition.Gossip_Storage
 	Storage_CRV                  map[string]*bitset.BitSet
+	// last REV applied to the CRV of each CA, without its delta, the next REV must be chained to it
+	Storage_Last_REV map[string]definition.Revocation
+	// latest certified CRV checkpoint of each CA, and the REV_FULLs of each CA since then by period
+	Storage_CKP_FULL    map[string]definition.Gossip_object
+	Storage_REV_history map[string]map[uint64]definition.Gossip_object
+	// latest STH of each logger whose history has been checked
+	Storage_Latest_STH map[string]definition.Gossip_object
 	// Utilize Storage directory: A folder for the files of each MMD.
 	// Folder should be set to the current MMD "Period" String upon initialization.
 	StorageFile_CRV  string
 	StorageDirectory string
 	StorageID        string
+	// storage period of the last client update saved, served when a client asks for the latest update
+	Latest_update_period string
 	// The below could be used to prevent a Monitor from sending duplicate Accusations,
 	// Currently, if a monitor accuses two entities in the same Period, it will trigger a gossip PoM.
 	// Therefore, a monitor can only accuse once per Period. I believe this is a temporary solution.
@@ -53,6 +62,9 @@ type MonitorContext struct {
 	STH_FULL_lock          *sync.RWMutex
 	REV_FULL_lock          *sync.RWMutex
 	TEMP_lock              *sync.RWMutex
+	Latest_STH_lock        *sync.Mutex
+	CKP_lock               *sync.RWMutex
+	Update_lock            *sync.RWMutex
 }
 
 type Monitor_private_config struct {
@@ -119,6 +131,9 @@ func (c *MonitorContext) SaveStorage(Period string, update ClientUpdate) error {
 	clientUpdate_path := newdir + "/ClientUpdate.json"
 	util.CreateFile(clientUpdate_path)
 	util.WriteData(clientUpdate_path, update)
+	c.Update_lock.Lock()
+	c.Latest_update_period = Period
+	c.Update_lock.Unlock()
 	//save CRV
 	var crvstorage = make(map[string][]byte)
 	for key, value := range c.Storage_CRV {
@@ -190,11 +205,18 @@ func (c *MonitorContext) GetObject(id definition.Gossip_ID) definition.Gossip_ob
 		obj := (*c.Storage_TEMP)[id]
 		c.TEMP_lock.RUnlock()
 		return obj
-	case definition.REV_INIT:
+	case definition.REV_INIT, definition.CKP_INIT:
 		c.TEMP_lock.RLock()
 		obj := (*c.Storage_TEMP)[id]
 		c.TEMP_lock.RUnlock()
 		return obj
+	case definition.CKP_FULL:
+		c.CKP_lock.RLock()
+		obj := c.Storage_CKP_FULL[id.Entity_URL]
+		c.CKP_lock.RUnlock()
+		if obj.GetID() == id {
+			return obj
+		}
 	}
 	return definition.Gossip_object{}
 
@@ -212,7 +234,7 @@ func (c *MonitorContext) StoreObject(o definition.Gossip_object) {
 		c.TEMP_lock.Lock()
 		(*c.Storage_TEMP)[o.GetID()] = o
 		c.TEMP_lock.Unlock()
-	case definition.REV_INIT:
+	case definition.REV_INIT, definition.CKP_INIT:
 		c.TEMP_lock.Lock()
 		(*c.Storage_TEMP)[o.GetID()] = o
 		c.TEMP_lock.Unlock()
@@ -238,35 +260,75 @@ func (c *MonitorContext) StoreObject(o definition.Gossip_object) {
 		c.REV_FULL_lock.Lock()
 		(*c.Storage_REV_FULL)[o.GetID()] = o
 		c.REV_FULL_lock.Unlock()
-		_, DCRV := Get_SRH_and_DCRV(o)
-		key := o.Payload[0]
-		//verif REV_FULL
-		//verify SRH
-		/*
-			if !c.VerifySRH(SRH, &DCRV, key, o.Period) {
-				return
-			}*/
+		c.StoreREVHistory(o)
 		//Update CRV
-		// look for CRV first
 		f := func() {
-			if _, ok := c.Storage_CRV[key]; !ok {
-				c.CRV_lock.Lock()
-				c.Storage_CRV[key] = &DCRV
-				c.CRV_lock.Unlock()
-			} else {
-				c.CRV_lock.Lock()
-				c.Storage_CRV[key].Union(&DCRV)
-				c.CRV_lock.Unlock()
+			err := c.ApplyREV(o)
+			// a REV already applied while closing a gap is stale
+			if err != nil && !errors.Is(err, definition.ErrREVStale) {
+				fmt.Println(util.RED, "Fail to apply the REV of "+o.Payload[0]+": ", err, util.RESET)
 			}
 		}
 		time.AfterFunc(20*time.Second, f)
 		fmt.Println(util.BLUE, "REV_FULL Stored", util.RESET)
+	case definition.CKP_FULL:
+		if c.StoreCheckpoint(o) {
+			fmt.Println(util.BLUE, "CKP_FULL Stored", util.RESET)
+		}
 	default:
 		(*c.Storage_TEMP)[o.GetID()] = o
 	}
 
 }
 
+// keep the checkpoint if it is newer than the stored one, and drop the REVs it covers
+// periods wrap every hour, checkpoints and REVs are ordered by the sequence number of their REV
+func (c *MonitorContext) StoreCheckpoint(o definition.Gossip_object) bool {
+	checkpoint, _, err := definition.VerifyCheckpoint(o, c.Monitor_crypto_config)
+	if err != nil {
+		fmt.Println(util.RED, "Invalid checkpoint from CA "+o.Payload[0]+": ", err, util.RESET)
+		return false
+	}
+	key := o.Payload[0]
+	c.CKP_lock.Lock()
+	defer c.CKP_lock.Unlock()
+	if old, ok := c.Storage_CKP_FULL[key]; ok {
+		oldcheckpoint, _, _ := definition.ExtractCheckpoint(old)
+		if checkpoint.Sequence <= oldcheckpoint.Sequence {
+			return false
+		}
+	}
+	c.Storage_CKP_FULL[key] = o
+	for sequence := range c.Storage_REV_history[key] {
+		if sequence <= checkpoint.Sequence {
+			delete(c.Storage_REV_history[key], sequence)
+		}
+	}
+	return true
+}
+
+// record a REV_FULL by the sequence number of its revocation, unless it is covered by the checkpoint of its CA
+// REVs without a sequence number predate the chain and are not recorded
+func (c *MonitorContext) StoreREVHistory(o definition.Gossip_object) {
+	var revocation definition.Revocation
+	if err := json.Unmarshal([]byte(o.Payload[2]), &revocation); err != nil || revocation.Sequence == 0 {
+		return
+	}
+	key := o.Payload[0]
+	c.CKP_lock.Lock()
+	defer c.CKP_lock.Unlock()
+	if ckp, ok := c.Storage_CKP_FULL[key]; ok {
+		checkpoint, _, _ := definition.ExtractCheckpoint(ckp)
+		if revocation.Sequence <= checkpoint.Sequence {
+			return
+		}
+	}
+	if c.Storage_REV_history[key] == nil {
+		c.Storage_REV_history[key] = make(map[uint64]definition.Gossip_object)
+	}
+	c.Storage_REV_history[key][revocation.Sequence] = o
+}
+
 // wipe all temp data
 func (c *MonitorContext) WipeStorage() {
 	for key := range *c.Storage_TEMP {
@@ -346,6 +408,10 @@ func InitializeMonitorContext(public_config_path string, private_config_path str
 		Storage_STH_FULL:             storage_sth_full,
 		Storage_REV_FULL:             storage_rev_full,
 		Storage_CRV:                  make(map[string]*bitset.BitSet),
+		Storage_Last_REV:             make(map[string]definition.Revocation),
+		Storage_CKP_FULL:             make(map[string]definition.Gossip_object),
+		Storage_REV_history:          make(map[string]map[uint64]definition.Gossip_object),
+		Storage_Latest_STH:           make(map[string]definition.Gossip_object),
 		StorageID:                    storageID,
 		Mode:                         0,
 		Max_latency:                  290,
@@ -356,6 +422,9 @@ func InitializeMonitorContext(public_config_path string, private_config_path str
 		REV_FULL_lock:                &sync.RWMutex{},
 		TEMP_lock:                    &sync.RWMutex{},
 		CRV_lock:                     &sync.Mutex{},
+		Latest_STH_lock:              &sync.Mutex{},
+		CKP_lock:                     &sync.RWMutex{},
+		Update_lock:                  &sync.RWMutex{},
 	}
 	return &ctx
 }
@@ -119,7 +119,7 @@ func TestCertificateResult(t *testing.T) {
 	ctx.HandleUpdate(update_1, true, true)
 	ctx.HandleUpdate(update_2, true, true)
 	ctx.HandleUpdate(update_3, true, true)
-	if !ctx.VerifyCTngextension(cert) {
+	if !ctx.VerifyCTngextension(cert).Valid {
 		fmt.Println("Certificate verification failed")
 		//t.Fail()
 	}
@@ -50,8 +50,9 @@ func Test2(t *testing.T) {
 	POI := CTngExtension.LoggerInformation[0].POI.Poi
 	POI_json, _ := json.Marshal(CTngExtension.LoggerInformation[0].POI)
 	fmt.Println(POI_json)
-	precert := util.ParseTBSCertificate(cert)
-	pass, err := crypto.VerifyPOI(roothash1, POI, *precert)
+	// leaves are hashed from the TBS of the certificate, with the CTng extension left out, so the signed
+	// certificate is checked as is, a copy from ParseTBSCertificate has no TBS to hash
+	pass, err := crypto.VerifyPOI(roothash1, POI, *cert)
 	if !pass {
 		fmt.Println("VerifyPOI failed")
 		fmt.Println(err)
@@ -188,6 +188,10 @@ func ParseTBSCertificate(cert *x509.Certificate) *x509.Certificate {
 		RawSubject:            cert.RawSubject,
 		Issuer:                cert.Issuer,
 		PublicKey:             cert.PublicKey,
+		DNSNames:              cert.DNSNames,
+		EmailAddresses:        cert.EmailAddresses,
+		IPAddresses:           cert.IPAddresses,
+		URIs:                  cert.URIs,
 	}
 }
 